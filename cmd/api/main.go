@@ -1,25 +1,274 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/rs/zerolog"
 	"go-server/cmd"
+	"go-server/pkg/controllers/reload"
 	"go-server/pkg/routing"
+	"go-server/pkg/services/auth"
+	"go-server/pkg/services/certs"
+	"go-server/pkg/services/domains"
+	"go-server/pkg/services/metrics"
+	"go-server/pkg/services/proxy"
+	"go-server/pkg/services/registry"
+	"go-server/pkg/services/sni"
+	"go-server/pkg/services/tracing"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 )
 
 func main() {
-	pc, sc := cmd.ParseArgs()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	logger := zerolog.New(os.Stdout).Level(zerolog.DebugLevel).With().Timestamp().Logger()
 
-	r := routing.GetRouter(pc, logger)
+	pc, sc, err := cmd.ParseArgs()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to load configuration")
+	}
+
+	if sc.OTLPEndpoint != "" {
+		exporter, err := tracing.NewOTLPExporter(ctx, sc.OTLPEndpoint, sc.OTLPInsecure)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to set up trace exporter")
+		}
+
+		shutdownTracing := tracing.Setup(exporter)
+		defer func() {
+			err := shutdownTracing(context.Background())
+			if err != nil {
+				logger.Err(err).Msg("failed to flush traces")
+			}
+		}()
+	}
+
+	store := certs.NewStore()
+	if len(sc.TLSCertFiles) != 0 {
+		store, err = certs.LoadStore(sc.TLSCertFiles, sc.TLSKeyFiles)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to load certificates")
+		}
+	}
+
+	var acme *certs.AcmeManager
+	if sc.Acme != nil {
+		acme, err = certs.NewAcmeManager(logger.With().Str("module", "acme").Logger(), *sc.Acme, store)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to set up acme")
+		}
+
+		go acme.Run(ctx)
+	}
+
+	keyStore, err := auth.NewKeyStore(sc.APIKeysFile, sc.RequireAPIKey)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to load api keys")
+	}
+
+	var tunnels registry.Store = registry.NopStore{}
+	if sc.RegistryPath != "" {
+		tunnels, err = registry.NewBoltStore(sc.RegistryPath)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to open tunnel registry")
+		}
+	}
+	defer tunnels.Close()
+
+	domainRegistry, err := domains.NewRegistry(tunnels, domains.NewResolver(sc.DNSResolver))
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to load custom domains")
+	}
+	if acme != nil {
+		domainRegistry.Notify(acme.AddDomain, acme.RemoveDomain)
+	}
+
+	proxyManager := proxy.NewTcpProxyManager(logger.With().Str("module", "proxy-manager").Logger(), pc, tunnels, domainRegistry)
+	metrics.Registry.MustRegister(proxy.NewCollector(proxyManager))
+
+	reloadConfig := reloader(logger, sc, proxyManager)
+
+	admin := routing.GetAdminRouter(proxyManager, logger, acme, keyStore, sc.Admin, reloadConfig)
+	if sc.AdminListen == "" && !sc.AdminPublic {
+		logger.Warn().Msg("admin api is disabled, set --admin-listen or --admin-public to serve it")
+	}
+
+	var servers []*http.Server
+
+	if sc.AdminListen != "" {
+		servers = append(servers, serveAdmin(logger, sc, routing.GetAdminServerRouter(admin)))
+	}
+
+	var h http.Handler
+	if sc.AdminPublic {
+		h = routing.GetRouter(proxyManager, logger, keyStore, domainRegistry, admin)
+	} else {
+		h = routing.GetRouter(proxyManager, logger, keyStore, domainRegistry, nil)
+	}
+	if acme != nil {
+		h = acme.HTTPHandler(h)
+	}
+
+	err = proxyManager.Restore()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("failed to restore tunnels")
+	}
+
+	servers = append(servers, serveTLS(logger, sc, h, store, proxyManager), serve(logger, sc, h))
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			_, _, err := reloadConfig()
+			if err != nil {
+				logger.Err(err).Msg("failed to reload config")
+			}
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	shutdown(logger, sc, proxyManager, servers)
+}
+
+// reloader re-reads the configuration on SIGHUP or via the admin API. Proxy
+// settings are applied to the manager and running tunnels, server settings
+// such as listeners and certificates are only reported as needing a restart.
+func reloader(logger zerolog.Logger, sc *cmd.ServerConfig, proxyManager *proxy.TcpProxyManager) reload.Reloader {
+	m := sync.Mutex{}
+
+	return func() ([]string, []string, error) {
+		m.Lock()
+		defer m.Unlock()
+
+		pc, newSc, err := cmd.Reload()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// the TLS port follows --tls-listen-port, which needs a restart
+		pc.TLSPort = proxyManager.Config().TLSPort
+
+		applied := cmd.Changes(proxyManager.Config(), pc)
+		restartRequired := cmd.Changes(sc, newSc)
+
+		proxyManager.Reload(pc)
+
+		logger.Info().Strs("applied", applied).Strs("restart-required", restartRequired).Msg("reloaded config")
+
+		return applied, restartRequired, nil
+	}
+}
+
+// shutdown stops accepting tunnels and visitors, then gives in-flight
+// requests and tunnel connections up to --shutdown-timeout to finish.
+func shutdown(logger zerolog.Logger, sc *cmd.ServerConfig, proxyManager *proxy.TcpProxyManager, servers []*http.Server) {
+	logger.Info().Dur("timeout", sc.ShutdownTimeout).Msg("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), sc.ShutdownTimeout)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		proxyManager.Shutdown(ctx)
+	}()
+
+	for _, srv := range servers {
+		if srv == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				logger.Err(err).Msgf("failed to shut down server: %s", srv.Addr)
+				srv.Close()
+			}
+		}(srv)
+	}
+
+	wg.Wait()
+	logger.Info().Msg("shutdown complete")
+}
+
+func serve(logger zerolog.Logger, sc *cmd.ServerConfig, h http.Handler) *http.Server {
+	srv := &http.Server{Addr: fmt.Sprintf("%s:%d", sc.ListenHost, sc.ListenPort), Handler: h}
 
 	logger.Info().Msgf("starting api: %s:%d", sc.ListenHost, sc.ListenPort)
 
-	err := http.ListenAndServe(fmt.Sprintf("%s:%d", sc.ListenHost, sc.ListenPort), r)
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logger.Fatal().Err(err).Msgf("failed to listen port: %d", sc.ListenPort)
+		}
+	}()
+
+	return srv
+}
+
+func serveAdmin(logger zerolog.Logger, sc *cmd.ServerConfig, h http.Handler) *http.Server {
+	srv := &http.Server{Addr: sc.AdminListen, Handler: h}
+
+	logger.Info().Msgf("starting admin api: %s", sc.AdminListen)
+
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logger.Err(err).Msgf("failed to listen admin address: %s", sc.AdminListen)
+		}
+	}()
+
+	return srv
+}
+
+// serveTLS runs the public TLS listener. Passthrough tunnels are picked by
+// SNI before the handshake, everything else is terminated with certificates
+// from the store and served by h.
+func serveTLS(logger zerolog.Logger, sc *cmd.ServerConfig, h http.Handler, store *certs.Store, proxyManager *proxy.TcpProxyManager) *http.Server {
+	addr := fmt.Sprintf("%s:%d", sc.ListenHost, sc.TLSListenPort)
+
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		logger.Err(err).Msgf("failed to listen port: %d", sc.ListenPort)
-		return
+		logger.Err(err).Msgf("failed to listen port: %d", sc.TLSListenPort)
+		return nil
 	}
+
+	mux := sni.NewListener(logger.With().Str("module", "sni").Logger(), ln, func(serverName string) func(net.Conn) {
+		instance := proxyManager.Passthrough(serverName)
+		if instance == nil {
+			return nil
+		}
+
+		return instance.Splice
+	})
+
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   h,
+		TLSConfig: &tls.Config{GetCertificate: store.GetCertificate},
+	}
+
+	logger.Info().Msgf("starting https api: %s:%d", sc.ListenHost, sc.TLSListenPort)
+
+	go func() {
+		err := srv.ServeTLS(mux, "", "")
+		if err != nil && err != http.ErrServerClosed {
+			logger.Err(err).Msgf("failed to listen port: %d", sc.TLSListenPort)
+		}
+	}()
+
+	return srv
 }
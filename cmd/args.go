@@ -1,11 +1,20 @@
 package cmd
 
 import (
+	"fmt"
+	"go-server/pkg/services/auth"
+	"go-server/pkg/services/certs"
+	"go-server/pkg/services/inspector"
+	"go-server/pkg/services/ipfilter"
 	"go-server/pkg/services/proxy"
+	"go-server/pkg/services/ratelimit"
+	"time"
 )
 import flag "github.com/spf13/pflag"
 
 var (
+	configFile = flag.String("config", "", "YAML config file with flag names as keys, also read from "+envPrefix+"CONFIG")
+
 	minPort = flag.Int("min-port", 30000, "Minimal port to generate socket addrs")
 	maxPort = flag.Int("max-port", 30100, "Max port to generate socket addrs")
 
@@ -16,26 +25,219 @@ var (
 	listenPort = flag.Int("listen-port", 3001, "ProxyEndpointUrl for API to listen")
 	listenHost = flag.String("listen-host", "0.0.0.0", "Host for API to listen")
 
+	tlsListenPort = flag.Int("tls-listen-port", 3443, "Port for HTTPS API and TLS passthrough tunnels to listen")
+	tlsCertFiles  = flag.StringSlice("tls-cert", nil, "PEM certificate files for HTTPS, e.g. a wildcard for *.domain")
+	tlsKeyFiles   = flag.StringSlice("tls-key", nil, "PEM key files for HTTPS, in the same order as --tls-cert")
+
+	apiKeysFile   = flag.String("api-keys-file", "", "JSON file with hashed API keys, keys created via the admin API are saved there")
+	requireAPIKey = flag.Bool("require-api-key", false, "Require an API key to create and delete tunnels")
+
+	registryPath = flag.String("registry-path", "", "BoltDB file to persist tunnels in, so they survive restarts")
+	dnsResolver  = flag.String("dns-resolver", "", "DNS server (host:port) for custom domain verification, defaults to the system resolver")
+
+	adminListen   = flag.String("admin-listen", "", "Separate host:port for the admin API, requires admin credentials unless it is a loopback address")
+	adminPublic   = flag.Bool("admin-public", false, "Also mount the admin API on the public listener, requires admin credentials")
+	adminToken    = flag.String("admin-token", "", "Bearer token for the admin API")
+	adminUser     = flag.String("admin-user", "", "Basic auth user for the admin API")
+	adminPassword = flag.String("admin-password", "", "Basic auth password for the admin API")
+
+	acmeEnabled     = flag.Bool("acme", false, "Obtain and renew HTTPS certificates via ACME")
+	acmeDirectory   = flag.String("acme-directory", "https://acme-v02.api.letsencrypt.org/directory", "ACME directory URL")
+	acmeEmail       = flag.String("acme-email", "", "Contact email for the ACME account")
+	acmeCacheDir    = flag.String("acme-cache-dir", "acme", "Directory to cache the ACME account and certificates")
+	acmeDomains     = flag.StringSlice("acme-domains", nil, "Additional hostnames to obtain certificates for via HTTP-01")
+	acmeDNSHook     = flag.String("acme-dns-hook", "", "Executable creating DNS-01 TXT records, called as: hook present|cleanup <name> <value>. Enables the wildcard certificate for --domain")
+	acmeRenewBefore = flag.Duration("acme-renew-before", 30*24*time.Hour, "Renew certificates this long before they expire")
+	acmeCheckEvery  = flag.Duration("acme-check-interval", 12*time.Hour, "How often certificates are checked for renewal")
+
+	otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP collector to export traces to, e.g. localhost:4318, tracing is off when empty")
+	otlpInsecure = flag.Bool("otlp-insecure", false, "Export traces over plain HTTP")
+
+	tunnelRate   = flag.Float64("rate-limit-tunnel", 0, "Requests per second allowed per tunnel, 0 disables the limit")
+	tunnelBurst  = flag.Int("rate-limit-tunnel-burst", 0, "Burst of requests allowed per tunnel, defaults to one second worth")
+	visitorRate  = flag.Float64("rate-limit-visitor", 0, "Requests per second allowed per visitor IP of a tunnel, 0 disables the limit")
+	visitorBurst = flag.Int("rate-limit-visitor-burst", 0, "Burst of requests allowed per visitor IP, defaults to one second worth")
+
+	tunnelUpload           = flag.Int64("bandwidth-tunnel-upload", 0, "Bytes per second visitors may send to a tunnel, 0 is unlimited")
+	tunnelUploadBurst      = flag.Int("bandwidth-tunnel-upload-burst", 0, "Burst of bytes visitors may send to a tunnel at once, defaults to one second worth")
+	tunnelDownload         = flag.Int64("bandwidth-tunnel-download", 0, "Bytes per second a tunnel may send back to its visitors, 0 is unlimited")
+	tunnelDownloadBurst    = flag.Int("bandwidth-tunnel-download-burst", 0, "Burst of bytes a tunnel may send back at once, defaults to one second worth")
+	maxTunnelUpload        = flag.Int64("bandwidth-max-upload", 0, "Highest upload bandwidth a tunnel may choose at creation, 0 is no maximum")
+	maxTunnelUploadBurst   = flag.Int("bandwidth-max-upload-burst", 0, "Highest upload burst a tunnel may choose at creation, defaults to one second worth")
+	maxTunnelDownload      = flag.Int64("bandwidth-max-download", 0, "Highest download bandwidth a tunnel may choose at creation, 0 is no maximum")
+	maxTunnelDownloadBurst = flag.Int("bandwidth-max-download-burst", 0, "Highest download burst a tunnel may choose at creation, defaults to one second worth")
+	serverUpload           = flag.Int64("bandwidth-server-upload", 0, "Bytes per second visitors may send to all tunnels together, 0 is unlimited")
+	serverUploadBurst      = flag.Int("bandwidth-server-upload-burst", 0, "Burst of bytes visitors may send to all tunnels together, defaults to one second worth")
+	serverDownload         = flag.Int64("bandwidth-server-download", 0, "Bytes per second all tunnels together may send back to visitors, 0 is unlimited")
+	serverDownloadBurst    = flag.Int("bandwidth-server-download-burst", 0, "Burst of bytes all tunnels together may send back at once, defaults to one second worth")
+
+	inspectBufferSize = flag.Int("inspect-buffer-size", 100, "Number of recent requests kept for tunnels with inspection on")
+	inspectBodyLimit  = flag.Int("inspect-body-limit", 64*1024, "Bytes of each request and response body kept by the inspector")
+	inspectRedact     = flag.StringSlice("inspect-redact-headers", []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}, "Headers whose values the inspector never stores")
+
+	denyCIDRs      = flag.StringSlice("deny-cidrs", nil, "Visitor IPs or CIDRs turned away from every tunnel")
+	trustedProxies = flag.StringSlice("trusted-proxies", nil, "Proxy IPs or CIDRs whose X-Forwarded-For tells the visitor IP")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests and tunnel connections on shutdown")
+
 	timeoutInactiveHours   = flag.Int("timeout-inactive-hours", 24, "Number of hours to wait before closing client sockets")
 	timeoutNoActiveSockets = flag.Int("timeout-inactive-sockets", 10, "Number of minutes between checks to wait before treating client as inactive")
 	noActiveSocketsChecks  = flag.Int("checks-inactive-sockets", 3, "Number of checks to wait before treating client as inactive")
+
+	inactivityCheckInterval = flag.Duration("inactivity-check-interval", 30*time.Minute, "How often tunnels are checked against --timeout-inactive-hours")
+	poolGCInterval          = flag.Duration("pool-gc-interval", 3*time.Second, "How often closed forward connections are removed from the pool")
+	forwardIdleTimeout      = flag.Duration("forward-idle-timeout", 60*time.Second, "How long a forward connection may stay silent while serving a visitor")
+	udpSessionIdleTimeout   = flag.Duration("udp-session-idle-timeout", 2*time.Minute, "How long a UDP visitor keeps its forward connection after its last datagram")
+	acquireRetries          = flag.Int("acquire-retries", 5, "Number of retries to get a free forward connection for a visitor")
+	acquireRetryDelay       = flag.Duration("acquire-retry-delay", 200*time.Millisecond, "Delay between retries to get a free forward connection")
 )
 
 type ServerConfig struct {
 	ListenPort int
 	ListenHost string
+
+	TLSListenPort int
+	TLSCertFiles  []string
+	TLSKeyFiles   []string
+
+	// Acme is nil unless ACME is enabled.
+	Acme *certs.AcmeConfig
+
+	APIKeysFile   string
+	RequireAPIKey bool
+
+	// RegistryPath is empty when tunnels are kept in memory only.
+	RegistryPath string
+	// DNSResolver is empty to verify custom domains with the system
+	// resolver.
+	DNSResolver string
+
+	// AdminListen is empty when the admin API has no listener of its own,
+	// it is then only served with AdminPublic.
+	AdminListen string
+	AdminPublic bool
+	Admin       auth.AdminCredentials
+
+	// OTLPEndpoint is empty when traces are not exported.
+	OTLPEndpoint string
+	OTLPInsecure bool
+
+	ShutdownTimeout time.Duration
 }
 
-func ParseArgs() (*proxy.Config, *ServerConfig) {
+// ParseArgs reads the settings from flags, GREENCOBRA_* environment
+// variables and the config file, in this order of precedence.
+func ParseArgs() (*proxy.Config, *ServerConfig, error) {
 	flag.Parse()
+	cliFlags = givenFlags(flag.CommandLine)
+
+	return load()
+}
+
+// Reload reads the config file and environment again, the command line
+// given at startup still takes precedence. Calls must not overlap.
+func Reload() (*proxy.Config, *ServerConfig, error) {
+	resetFlags(flag.CommandLine, cliFlags)
+
+	return load()
+}
 
-	return &proxy.Config{
+func load() (*proxy.Config, *ServerConfig, error) {
+	err := applyConfig(flag.CommandLine, cliFlags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var acme *certs.AcmeConfig
+	if *acmeEnabled {
+		acme = &certs.AcmeConfig{
+			DirectoryURL:  *acmeDirectory,
+			Email:         *acmeEmail,
+			CacheDir:      *acmeCacheDir,
+			Domains:       *acmeDomains,
+			DNSHook:       *acmeDNSHook,
+			RenewBefore:   *acmeRenewBefore,
+			CheckInterval: *acmeCheckEvery,
+		}
+		if *acmeDNSHook != "" {
+			acme.WildcardDomain = *baseDomain
+		}
+	}
+
+	denyVisitors, err := ipfilter.ParseList(*denyCIDRs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: deny-cidrs: %w", err)
+	}
+
+	trusted, err := ipfilter.ParseList(*trustedProxies)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration: trusted-proxies: %w", err)
+	}
+
+	pc := &proxy.Config{
 		MinPort:                       *minPort,
 		MaxPort:                       *maxPort,
 		BaseDomain:                    *baseDomain,
 		MaxConnsPerClient:             *maxConnsPerClient,
+		TLSPort:                       *tlsListenPort,
 		InactiveHoursTimeout:          *timeoutInactiveHours,
 		NoActiveSocketsChecks:         *noActiveSocketsChecks,
 		NoActiveSocketsMinutesTimeout: *timeoutNoActiveSockets,
-	}, &ServerConfig{ListenPort: *listenPort, ListenHost: *listenHost}
+		InactivityCheckInterval:       *inactivityCheckInterval,
+		PoolGCInterval:                *poolGCInterval,
+		ForwardIdleTimeout:            *forwardIdleTimeout,
+		UdpSessionIdleTimeout:         *udpSessionIdleTimeout,
+		AcquireRetries:                *acquireRetries,
+		AcquireRetryDelay:             *acquireRetryDelay,
+		TunnelRateLimit:               ratelimit.Limit{Rate: *tunnelRate, Burst: *tunnelBurst},
+		VisitorRateLimit:              ratelimit.Limit{Rate: *visitorRate, Burst: *visitorBurst},
+		TunnelUpload:                  bytesPerSecond(*tunnelUpload, *tunnelUploadBurst),
+		TunnelDownload:                bytesPerSecond(*tunnelDownload, *tunnelDownloadBurst),
+		MaxTunnelUpload:               bytesPerSecond(*maxTunnelUpload, *maxTunnelUploadBurst),
+		MaxTunnelDownload:             bytesPerSecond(*maxTunnelDownload, *maxTunnelDownloadBurst),
+		ServerUpload:                  bytesPerSecond(*serverUpload, *serverUploadBurst),
+		ServerDownload:                bytesPerSecond(*serverDownload, *serverDownloadBurst),
+		InspectBufferSize:             *inspectBufferSize,
+		Inspect: inspector.Settings{
+			BodyLimit: *inspectBodyLimit,
+			Redact:    *inspectRedact,
+		},
+		DenyVisitors:   denyVisitors,
+		TrustedProxies: trusted,
+	}
+	sc := &ServerConfig{
+		ListenPort:    *listenPort,
+		ListenHost:    *listenHost,
+		TLSListenPort: *tlsListenPort,
+		TLSCertFiles:  *tlsCertFiles,
+		TLSKeyFiles:   *tlsKeyFiles,
+		Acme:          acme,
+		APIKeysFile:   *apiKeysFile,
+		RequireAPIKey: *requireAPIKey,
+		RegistryPath:  *registryPath,
+		DNSResolver:   *dnsResolver,
+		AdminListen:   *adminListen,
+		AdminPublic:   *adminPublic,
+		Admin: auth.AdminCredentials{
+			Token:          *adminToken,
+			User:           *adminUser,
+			Password:       *adminPassword,
+			AllowAnonymous: loopbackAddr(*adminListen),
+		},
+		OTLPEndpoint:    *otlpEndpoint,
+		OTLPInsecure:    *otlpInsecure,
+		ShutdownTimeout: *shutdownTimeout,
+	}
+
+	err = validate(pc, sc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pc, sc, nil
+}
+
+// bytesPerSecond is a bandwidth cap, a zero burst defaults to one second.
+func bytesPerSecond(rate int64, burst int) ratelimit.Limit {
+	return ratelimit.Limit{Rate: float64(rate), Burst: burst}
 }
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	flag "github.com/spf13/pflag"
+	"go-server/pkg/services/proxy"
+	"go-server/pkg/services/ratelimit"
+	"strings"
+	"testing"
+)
+
+// loadArgs loads the config as the server would with args on the command
+// line. The flags are shared with fresh flag sets, the command line one
+// remembers every flag it was ever given. A list set by an earlier test
+// appends the parsed items, so the given lists are emptied and args parsed
+// once more.
+func loadArgs(t *testing.T, args ...string) (*proxy.Config, *ServerConfig, error) {
+	t.Helper()
+
+	resetFlags(flag.CommandLine, nil)
+	t.Cleanup(func() { resetFlags(flag.CommandLine, nil) })
+
+	fs := sharedFlags(t, args)
+	cliFlags = givenFlags(fs)
+	for name := range cliFlags {
+		f := fs.Lookup(name)
+		if s, ok := f.Value.(flag.SliceValue); ok {
+			s.Replace(nil)
+			f.Changed = false
+		}
+	}
+	sharedFlags(t, args)
+
+	return load()
+}
+
+func sharedFlags(t *testing.T, args []string) *flag.FlagSet {
+	t.Helper()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		fs.AddFlag(f)
+	})
+
+	err := fs.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fs
+}
+
+func TestLoadAdmin(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		wantErr       string
+		wantAnonymous bool
+	}{
+		{name: "disabled", args: nil},
+		{name: "public without credentials", args: []string{"--admin-public"}, wantErr: "admin-public requires"},
+		{name: "public with token", args: []string{"--admin-public", "--admin-token", "tok"}},
+		{name: "public with user only", args: []string{"--admin-public", "--admin-user", "admin"}, wantErr: "admin-password is required"},
+		{name: "public with basic auth", args: []string{"--admin-public", "--admin-user", "admin", "--admin-password", "pw"}},
+		{name: "loopback listener", args: []string{"--admin-listen", "127.0.0.1:9000"}, wantAnonymous: true},
+		{name: "localhost listener", args: []string{"--admin-listen", "localhost:9000"}, wantAnonymous: true},
+		{name: "ipv6 loopback listener", args: []string{"--admin-listen", "[::1]:9000"}, wantAnonymous: true},
+		{name: "every interface without credentials", args: []string{"--admin-listen", ":9000"}, wantErr: "admin-listen on a non-loopback address requires"},
+		{name: "public address without credentials", args: []string{"--admin-listen", "192.0.2.1:9000"}, wantErr: "admin-listen on a non-loopback address requires"},
+		{name: "every interface with token", args: []string{"--admin-listen", ":9000", "--admin-token", "tok"}},
+		{name: "every interface with basic auth", args: []string{"--admin-listen", "0.0.0.0:9000", "--admin-user", "admin", "--admin-password", "pw"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, sc, err := loadArgs(t, tt.args...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sc.Admin.AllowAnonymous != tt.wantAnonymous {
+				t.Errorf("AllowAnonymous = %v, want %v", sc.Admin.AllowAnonymous, tt.wantAnonymous)
+			}
+		})
+	}
+}
+
+func TestLoadBandwidth(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantErr    string
+		wantUpload ratelimit.Limit
+	}{
+		{name: "unlimited"},
+		{name: "rate and burst", args: []string{"--bandwidth-tunnel-upload", "1000", "--bandwidth-tunnel-upload-burst", "4000"}, wantUpload: ratelimit.Limit{Rate: 1000, Burst: 4000}},
+		{name: "negative burst", args: []string{"--bandwidth-server-download-burst", "-1"}, wantErr: "must not be negative"},
+		{name: "over the maximum", args: []string{"--bandwidth-tunnel-upload", "1000", "--bandwidth-max-upload", "500"}, wantErr: "at most bandwidth-max-upload"},
+		{name: "burst over the maximum", args: []string{"--bandwidth-tunnel-upload", "500", "--bandwidth-tunnel-upload-burst", "2000", "--bandwidth-max-upload", "500", "--bandwidth-max-upload-burst", "1000"}, wantErr: "at most bandwidth-max-upload"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc, _, err := loadArgs(t, tt.args...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pc.TunnelUpload != tt.wantUpload {
+				t.Errorf("TunnelUpload = %+v, want %+v", pc.TunnelUpload, tt.wantUpload)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	flag "github.com/spf13/pflag"
+	"go-server/pkg/services/proxy"
+	"go-server/pkg/services/ratelimit"
+	"gopkg.in/yaml.v3"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+)
+
+const envPrefix = "GREENCOBRA_"
+
+// cliFlags names the flags given on the command line. It is taken once
+// after parsing, setFlag marks config and env values as set as well.
+var cliFlags map[string]bool
+
+func givenFlags(fs *flag.FlagSet) map[string]bool {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	return given
+}
+
+// applyConfig fills the flags not given on the command line, first from the
+// config file and then from the environment, so env wins over the file.
+func applyConfig(fs *flag.FlagSet, cli map[string]bool) error {
+	path := *configFile
+	if !cli["config"] {
+		if v, ok := os.LookupEnv(envName("config")); ok {
+			path = v
+		}
+	}
+
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+
+		for name, value := range values {
+			f := fs.Lookup(name)
+			if f == nil || name == "config" {
+				return fmt.Errorf("config %s: unknown setting %q", path, name)
+			}
+			if cli[name] {
+				continue
+			}
+
+			err = setFlag(fs, f, value)
+			if err != nil {
+				return fmt.Errorf("config %s: %s: %w", path, name, err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || cli[f.Name] || f.Name == "config" || err != nil {
+			return
+		}
+
+		var values []string
+		if _, isSlice := f.Value.(flag.SliceValue); isSlice {
+			values = splitList(v)
+		} else {
+			values = []string{v}
+		}
+
+		setErr := setFlag(fs, f, values)
+		if setErr != nil {
+			err = fmt.Errorf("%s: %w", envName(f.Name), setErr)
+		}
+	})
+
+	return err
+}
+
+// readConfigFile returns the values of each setting as strings, lists are
+// kept as separate items for slice flags.
+func readConfigFile(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	values := make(map[string][]string, len(raw))
+	for name, v := range raw {
+		switch v := v.(type) {
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = items
+		case nil:
+			values[name] = nil
+		default:
+			values[name] = []string{fmt.Sprint(v)}
+		}
+	}
+
+	return values, nil
+}
+
+// resetFlags puts every flag but the kept ones back to its default, so a
+// reload does not see values of a previous config file or environment.
+// Flags given on the command line are kept rather than parsed again, a list
+// set before would append the parsed items to its default.
+func resetFlags(fs *flag.FlagSet, keep map[string]bool) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if keep[f.Name] {
+			return
+		}
+
+		if s, ok := f.Value.(flag.SliceValue); ok {
+			s.Replace(splitList(strings.Trim(f.DefValue, "[]")))
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+
+		f.Changed = false
+	})
+}
+
+// Changes lists the names of the fields which differ between two configs
+// of the same struct type.
+func Changes(old, new interface{}) []string {
+	ov := reflect.Indirect(reflect.ValueOf(old))
+	nv := reflect.Indirect(reflect.ValueOf(new))
+
+	var changed []string
+	for i := 0; i < ov.NumField(); i++ {
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			changed = append(changed, ov.Type().Field(i).Name)
+		}
+	}
+
+	return changed
+}
+
+// setFlag sets f through the flag set, so it is marked as changed like a
+// flag given on the command line. Set appends to a list set before, lists
+// are emptied first and set at once.
+func setFlag(fs *flag.FlagSet, f *flag.Flag, values []string) error {
+	if s, ok := f.Value.(flag.SliceValue); ok {
+		err := s.Replace(nil)
+		if err != nil {
+			return err
+		}
+
+		list, err := joinList(values)
+		if err != nil {
+			return err
+		}
+
+		return fs.Set(f.Name, list)
+	}
+
+	if len(values) != 1 {
+		return errors.New("expected a single value")
+	}
+
+	return fs.Set(f.Name, values[0])
+}
+
+// joinList quotes items the way slice flags read them back.
+func joinList(items []string) (string, error) {
+	var b strings.Builder
+	w := csv.NewWriter(&b)
+	err := w.Write(items)
+	if err != nil {
+		return "", err
+	}
+	w.Flush()
+
+	return strings.TrimSuffix(b.String(), "\n"), w.Error()
+}
+
+// envName maps a flag name to its variable, e.g. min-port to GREENCOBRA_MIN_PORT.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func splitList(v string) []string {
+	if v == "" {
+		return nil
+	}
+
+	items := strings.Split(v, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+
+	return items
+}
+
+func validate(pc *proxy.Config, sc *ServerConfig) error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	validPort := func(p int) bool { return p > 0 && p <= 65535 }
+
+	check(validPort(pc.MinPort) && validPort(pc.MaxPort), "min-port and max-port must be between 1 and 65535")
+	check(pc.MinPort < pc.MaxPort, "min-port must be lower than max-port")
+	check(pc.MaxConnsPerClient > 0, "max-client-conns must be positive")
+	check(validPort(sc.ListenPort), "listen-port must be between 1 and 65535")
+	check(validPort(sc.TLSListenPort), "tls-listen-port must be between 1 and 65535")
+	check(sc.ListenPort != sc.TLSListenPort, "listen-port and tls-listen-port must differ")
+	check(len(sc.TLSCertFiles) == len(sc.TLSKeyFiles), "tls-cert and tls-key must be given in pairs")
+	check(pc.InactiveHoursTimeout > 0, "timeout-inactive-hours must be positive")
+	check(pc.NoActiveSocketsMinutesTimeout > 0, "timeout-inactive-sockets must be positive")
+	check(pc.NoActiveSocketsChecks > 0, "checks-inactive-sockets must be positive")
+	check(pc.InactivityCheckInterval > 0, "inactivity-check-interval must be positive")
+	check(pc.PoolGCInterval > 0, "pool-gc-interval must be positive")
+	check(pc.ForwardIdleTimeout >= 0, "forward-idle-timeout must not be negative")
+	check(pc.UdpSessionIdleTimeout > 0, "udp-session-idle-timeout must be positive")
+	check(pc.AcquireRetries >= 0, "acquire-retries must not be negative")
+	check(pc.AcquireRetryDelay >= 0, "acquire-retry-delay must not be negative")
+	check(pc.TunnelRateLimit.Validate() == nil, "rate-limit-tunnel and rate-limit-tunnel-burst must not be negative")
+	check(pc.VisitorRateLimit.Validate() == nil, "rate-limit-visitor and rate-limit-visitor-burst must not be negative")
+	for _, l := range []ratelimit.Limit{pc.TunnelUpload, pc.TunnelDownload, pc.MaxTunnelUpload, pc.MaxTunnelDownload, pc.ServerUpload, pc.ServerDownload} {
+		check(l.Validate() == nil, "bandwidth caps and bursts must not be negative")
+	}
+	check(pc.TunnelUpload.Within(pc.MaxTunnelUpload), "bandwidth-tunnel-upload must be set and at most bandwidth-max-upload")
+	check(pc.TunnelDownload.Within(pc.MaxTunnelDownload), "bandwidth-tunnel-download must be set and at most bandwidth-max-download")
+	check(pc.InspectBufferSize > 0, "inspect-buffer-size must be positive")
+	check(pc.Inspect.BodyLimit >= 0, "inspect-body-limit must not be negative")
+	check(sc.ShutdownTimeout >= 0, "shutdown-timeout must not be negative")
+	check(sc.Admin.User == "" || sc.Admin.Password != "", "admin-password is required with admin-user")
+	check(!sc.AdminPublic || sc.Admin.Configured(), "admin-public requires admin-token or admin-user and admin-password")
+	check(sc.AdminListen == "" || sc.Admin.Configured() || loopbackAddr(sc.AdminListen), "admin-listen on a non-loopback address requires admin-token or admin-user and admin-password")
+
+	if sc.Acme != nil {
+		check(sc.Acme.DirectoryURL != "", "acme-directory is required with acme")
+		check(sc.Acme.CacheDir != "", "acme-cache-dir is required with acme")
+		check(sc.Acme.RenewBefore > 0, "acme-renew-before must be positive")
+		check(sc.Acme.CheckInterval > 0, "acme-check-interval must be positive")
+	}
+
+	if len(errs) != 0 {
+		return errors.New("invalid configuration: " + strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// loopbackAddr reports whether the host:port addr only listens on loopback,
+// an empty host listens on every interface.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
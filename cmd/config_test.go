@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	flag "github.com/spf13/pflag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	config := writeConfig(t, `
+min-port: 31000
+max-port: 31500
+max-client-conns: 4
+inspect-redact-headers: [X-Secret, "X-Api-Key"]
+`)
+
+	tests := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		wantMin     int
+		wantMax     int
+		wantConns   int
+		wantRedact  []string
+		wantChanged bool
+	}{
+		{
+			name:       "defaults",
+			wantMin:    30000,
+			wantMax:    30100,
+			wantConns:  10,
+			wantRedact: []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"},
+		},
+		{
+			name:        "config file",
+			args:        []string{"--config", config},
+			wantMin:     31000,
+			wantMax:     31500,
+			wantConns:   4,
+			wantRedact:  []string{"X-Secret", "X-Api-Key"},
+			wantChanged: true,
+		},
+		{
+			name:        "config file from env",
+			env:         map[string]string{"GREENCOBRA_CONFIG": config},
+			wantMin:     31000,
+			wantMax:     31500,
+			wantConns:   4,
+			wantRedact:  []string{"X-Secret", "X-Api-Key"},
+			wantChanged: true,
+		},
+		{
+			name:        "env over config file",
+			args:        []string{"--config", config},
+			env:         map[string]string{"GREENCOBRA_MIN_PORT": "31100", "GREENCOBRA_INSPECT_REDACT_HEADERS": "Cookie, X-Token"},
+			wantMin:     31100,
+			wantMax:     31500,
+			wantConns:   4,
+			wantRedact:  []string{"Cookie", "X-Token"},
+			wantChanged: true,
+		},
+		{
+			name:        "command line over env",
+			args:        []string{"--config", config, "--min-port", "31200", "--inspect-redact-headers", "X-Cli"},
+			env:         map[string]string{"GREENCOBRA_MIN_PORT": "31100", "GREENCOBRA_INSPECT_REDACT_HEADERS": "X-Env"},
+			wantMin:     31200,
+			wantMax:     31500,
+			wantConns:   4,
+			wantRedact:  []string{"X-Cli"},
+			wantChanged: true,
+		},
+		{
+			name:        "env only",
+			env:         map[string]string{"GREENCOBRA_MAX_CLIENT_CONNS": "7"},
+			wantMin:     30000,
+			wantMax:     30100,
+			wantConns:   7,
+			wantRedact:  []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"},
+			wantChanged: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			pc, _, err := loadArgs(t, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pc.MinPort != tt.wantMin || pc.MaxPort != tt.wantMax || pc.MaxConnsPerClient != tt.wantConns {
+				t.Errorf("ports %d-%d conns %d, want %d-%d conns %d", pc.MinPort, pc.MaxPort, pc.MaxConnsPerClient, tt.wantMin, tt.wantMax, tt.wantConns)
+			}
+			if !reflect.DeepEqual(pc.Inspect.Redact, tt.wantRedact) {
+				t.Errorf("redact = %q, want %q", pc.Inspect.Redact, tt.wantRedact)
+			}
+			if changed := flag.CommandLine.Lookup("inspect-redact-headers").Changed; changed != tt.wantChanged {
+				t.Errorf("inspect-redact-headers Changed = %v, want %v", changed, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "unknown setting", config: "min-prot: 1\n", wantErr: `unknown setting "min-prot"`},
+		{name: "config in config", config: "config: other.yaml\n", wantErr: `unknown setting "config"`},
+		{name: "list for a number", config: "min-port: [1, 2]\n", wantErr: "expected a single value"},
+		{name: "invalid yaml", config: "min-port: [\n", wantErr: "config "},
+		{name: "invalid env", env: map[string]string{"GREENCOBRA_MIN_PORT": "low"}, wantErr: "GREENCOBRA_MIN_PORT"},
+		{name: "invalid value", config: "min-port: 40000\nmax-port: 30000\n", wantErr: "min-port must be lower than max-port"},
+		{name: "no udp session timeout", config: "udp-session-idle-timeout: 0s\n", wantErr: "udp-session-idle-timeout must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []string
+			if tt.config != "" {
+				args = []string{"--config", writeConfig(t, tt.config)}
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			_, _, err := loadArgs(t, args...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	config := writeConfig(t, "max-client-conns: 4\n")
+	t.Setenv("GREENCOBRA_MAX_PORT", "31500")
+
+	_, _, err := loadArgs(t, "--config", config, "--min-port", "30050", "--inspect-redact-headers", "X-Cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file and environment change while the server runs
+	err = os.WriteFile(config, []byte("max-client-conns: 8\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Unsetenv("GREENCOBRA_MAX_PORT")
+
+	for i := 0; i < 2; i++ {
+		pc, _, err := Reload()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if pc.MaxConnsPerClient != 8 {
+			t.Errorf("reload %d: conns = %d, want the new file's 8", i, pc.MaxConnsPerClient)
+		}
+		if pc.MaxPort != 30100 {
+			t.Errorf("reload %d: max port = %d, want the default once the env is gone", i, pc.MaxPort)
+		}
+		if pc.MinPort != 30050 || !reflect.DeepEqual(pc.Inspect.Redact, []string{"X-Cli"}) {
+			t.Errorf("reload %d: min port %d redact %q, want the command line kept", i, pc.MinPort, pc.Inspect.Redact)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	type config struct {
+		Port   int
+		Hosts  []string
+		Admin  struct{ Token string }
+		Limits *struct{ Rate float64 }
+	}
+
+	base := config{Port: 1, Hosts: []string{"a"}}
+	base.Admin.Token = "t"
+
+	tests := []struct {
+		name   string
+		change func(c *config)
+		want   []string
+	}{
+		{name: "same", change: func(c *config) {}, want: nil},
+		{name: "scalar", change: func(c *config) { c.Port = 2 }, want: []string{"Port"}},
+		{name: "slice", change: func(c *config) { c.Hosts = []string{"a", "b"} }, want: []string{"Hosts"}},
+		{name: "nested", change: func(c *config) { c.Admin.Token = "u" }, want: []string{"Admin"}},
+		{name: "pointer", change: func(c *config) { c.Limits = &struct{ Rate float64 }{Rate: 1} }, want: []string{"Limits"}},
+		{name: "several", change: func(c *config) { c.Port = 2; c.Admin.Token = "u" }, want: []string{"Port", "Admin"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := base
+			new := base
+			new.Hosts = append([]string(nil), base.Hosts...)
+			tt.change(&new)
+
+			got := Changes(&old, &new)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Changes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
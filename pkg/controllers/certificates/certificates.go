@@ -0,0 +1,35 @@
+package certificates
+
+import (
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"go-server/pkg/services/certs"
+	"net/http"
+)
+
+type Controller struct {
+	logger zerolog.Logger
+
+	acme *certs.AcmeManager
+}
+
+func NewCertificatesController(logger zerolog.Logger, acme *certs.AcmeManager) *Controller {
+	return &Controller{logger: logger, acme: acme}
+}
+
+func (c Controller) Get(w http.ResponseWriter, r *http.Request) {
+	response := Response{Enabled: c.acme != nil, Certificates: []certs.CertStatus{}}
+	if c.acme != nil {
+		response.Certificates = c.acme.Statuses()
+	}
+
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(500)
+		c.logger.Err(err).Msg("failed to marshal response")
+
+		return
+	}
+
+	w.Write(bytes)
+}
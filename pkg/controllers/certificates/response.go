@@ -0,0 +1,8 @@
+package certificates
+
+import "go-server/pkg/services/certs"
+
+type Response struct {
+	Enabled      bool               `json:"acme_enabled"`
+	Certificates []certs.CertStatus `json:"certificates"`
+}
@@ -0,0 +1,83 @@
+package keys
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"go-server/pkg/services/auth"
+	"net/http"
+)
+
+type Controller struct {
+	logger zerolog.Logger
+
+	keys *auth.KeyStore
+}
+
+func NewKeysController(logger zerolog.Logger, keys *auth.KeyStore) *Controller {
+	return &Controller{logger: logger, keys: keys}
+}
+
+func (c Controller) List(w http.ResponseWriter, r *http.Request) {
+	response := make([]keyResponse, 0)
+	for _, k := range c.keys.List() {
+		response = append(response, newKeyResponse(k))
+	}
+
+	c.writeJSON(w, response)
+}
+
+func (c Controller) Create(w http.ResponseWriter, r *http.Request) {
+	kq := keyRequest{}
+	err := json.NewDecoder(r.Body).Decode(&kq)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("invalid json"))
+		return
+	}
+
+	secret, key, err := c.keys.Create(kq.Name)
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to create api key")
+		w.WriteHeader(500)
+		return
+	}
+
+	c.logger.Info().Str("key-id", key.ID).Str("name", key.Name).Msg("created api key")
+
+	response := newKeyResponse(key)
+	response.Key = secret
+	c.writeJSON(w, response)
+}
+
+func (c Controller) Delete(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	err := c.keys.Revoke(id)
+	if errors.Is(err, auth.ErrKeyNotFound) {
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+		return
+	}
+	if err != nil {
+		c.logger.Error().Err(err).Msg("failed to revoke api key")
+		w.WriteHeader(500)
+		return
+	}
+
+	c.logger.Info().Str("key-id", id).Msg("revoked api key")
+	w.Write([]byte("{}"))
+}
+
+func (c Controller) writeJSON(w http.ResponseWriter, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(500)
+		c.logger.Err(err).Msg("failed to marshal response")
+
+		return
+	}
+
+	w.Write(bytes)
+}
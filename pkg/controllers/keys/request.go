@@ -0,0 +1,5 @@
+package keys
+
+type keyRequest struct {
+	Name string `json:"name"`
+}
@@ -0,0 +1,17 @@
+package keys
+
+import (
+	"go-server/pkg/services/auth"
+	"time"
+)
+
+type keyResponse struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newKeyResponse(k auth.Key) keyResponse {
+	return keyResponse{ID: k.ID, Name: k.Name, CreatedAt: k.CreatedAt}
+}
@@ -0,0 +1,49 @@
+package reload
+
+import (
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"net/http"
+)
+
+// Reloader reads and applies the configuration again. It reports the
+// settings which were applied and the ones which need a restart.
+type Reloader func() (applied, restartRequired []string, err error)
+
+type Controller struct {
+	logger zerolog.Logger
+
+	reload Reloader
+}
+
+func NewReloadController(logger zerolog.Logger, reload Reloader) *Controller {
+	return &Controller{logger: logger, reload: reload}
+}
+
+func (c Controller) Post(w http.ResponseWriter, r *http.Request) {
+	applied, restartRequired, err := c.reload()
+	if err != nil {
+		c.logger.Err(err).Msg("failed to reload config")
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	response := Response{Applied: applied, RestartRequired: restartRequired}
+	if response.Applied == nil {
+		response.Applied = []string{}
+	}
+	if response.RestartRequired == nil {
+		response.RestartRequired = []string{}
+	}
+
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(500)
+		c.logger.Err(err).Msg("failed to marshal response")
+
+		return
+	}
+
+	w.Write(bytes)
+}
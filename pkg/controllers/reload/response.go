@@ -0,0 +1,6 @@
+package reload
+
+type Response struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
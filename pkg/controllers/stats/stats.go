@@ -2,6 +2,7 @@ package stats
 
 import (
 	"encoding/json"
+	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
 	"go-server/pkg/services/proxy"
 	"net/http"
@@ -33,3 +34,22 @@ func (s Controller) Get(w http.ResponseWriter, r *http.Request) {
 
 	w.Write(bytes)
 }
+
+func (s Controller) GetTunnel(w http.ResponseWriter, r *http.Request) {
+	stats, ok := s.proxyManager.GetConnectionStats(chi.URLParam(r, "id"))
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+		return
+	}
+
+	bytes, err := json.Marshal(stats)
+	if err != nil {
+		w.WriteHeader(500)
+		s.logger.Err(err).Msg("failed to marshal response")
+
+		return
+	}
+
+	w.Write(bytes)
+}
@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// visitorIP is the address the visitor connected from. Requests coming from
+// --trusted-proxies are followed back through X-Forwarded-For, up to the
+// first hop which isn't a trusted proxy.
+func (t Controller) visitorIP(r *http.Request) string {
+	ip := parseHop(r.RemoteAddr)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+
+	trusted := t.proxyManager.Config().TrustedProxies
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0 && trusted.Contains(ip); i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			// a trusted proxy sent garbage, it is the last address known
+			break
+		}
+		ip = hop
+	}
+
+	return ip.String()
+}
+
+// forwardedFor returns the X-Forwarded-For hops, the closest one last.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	return hops
+}
+
+// parseHop reads an address with or without a port, nil if it isn't one.
+func parseHop(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// UpdateConnection changes the settings of a running tunnel, currently its
+// IP filter. An empty filter removes it.
+func (t *Controller) UpdateConnection(w http.ResponseWriter, r *http.Request) {
+	connection := t.proxyManager.Get(chi.URLParam(r, "id"))
+	if connection == nil || !t.isOwner(r, connection) {
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+		return
+	}
+
+	update := tunnelUpdate{}
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if update.IPFilter == nil {
+		w.WriteHeader(400)
+		w.Write([]byte("nothing to update"))
+		return
+	}
+
+	rules := update.IPFilter
+	if len(rules.Allow) == 0 && len(rules.Deny) == 0 {
+		rules = nil
+	}
+
+	err = t.proxyManager.SetIPFilter(connection, rules)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	t.logger.Info().Str("name", connection.ID).Interface("ip-filter", rules).Msg("updated tunnel")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tunnelUpdate{IPFilter: rules})
+}
@@ -0,0 +1,188 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"go-server/pkg/services/auth"
+	"go-server/pkg/services/ipfilter"
+	"go-server/pkg/services/proxy"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func basicAuth(user, password string) http.Header {
+	return http.Header{"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))}}
+}
+
+func TestVisitorAuth(t *testing.T) {
+	const token = "0123456789abcdef"
+
+	hashed, err := auth.VisitorCredentials{Bearer: token}.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lowest cost, so spending login attempts is fast
+	password, err := bcrypt.GenerateFromPassword([]byte("p"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed.Username, hashed.PasswordHash = "u", string(password)
+
+	s := newTestServer(t, testConfig(), nil, nil)
+	auths := make(chan string, 20)
+	s.tunnel(t, "app", proxy.Options{Auth: hashed}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths <- r.Header.Get("Authorization")
+	}))
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		ip        string
+		repeat    int
+		status    int
+		wantRetry bool
+	}{
+		{name: "anonymous", ip: "192.0.2.1", status: 401},
+		{name: "token", header: http.Header{"Authorization": {"Bearer " + token}}, ip: "192.0.2.1", status: 200},
+		{name: "basic", header: basicAuth("u", "p"), ip: "192.0.2.1", status: 200},
+		{name: "wrong password", header: basicAuth("u", "x"), ip: "192.0.2.2", repeat: 9, status: 401},
+		{name: "attempts exhausted", header: basicAuth("u", "x"), ip: "192.0.2.2", status: 429, wantRetry: true},
+		{name: "remembered login while exhausted", header: basicAuth("u", "p"), ip: "192.0.2.1", status: 200},
+		{name: "other visitor", header: basicAuth("u", "x"), ip: "192.0.2.3", status: 401},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i <= tt.repeat; i++ {
+				w := s.do("GET", "http://app.localhost/", "", tt.header, tt.ip+":1234")
+				if w.Code != tt.status {
+					t.Fatalf("request %d: status = %d, want %d", i+1, w.Code, tt.status)
+				}
+				if got := w.Header().Get("Retry-After") != ""; got != tt.wantRetry {
+					t.Errorf("Retry-After = %q", w.Header().Get("Retry-After"))
+				}
+			}
+
+			if tt.status == 200 {
+				if got := <-auths; got != "" {
+					t.Errorf("client got Authorization %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestVisitorIP(t *testing.T) {
+	conf := testConfig()
+	conf.TrustedProxies, _ = ipfilter.ParseList([]string{"10.0.0.0/8", "2001:db8::1"})
+	s := newTestServer(t, conf, nil, nil)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "untrusted forwarder", remoteAddr: "192.0.2.1:1234", xff: []string{"198.51.100.1"}, want: "192.0.2.1"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.1:1234", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "trusted proxy without header", remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "chain of trusted proxies", remoteAddr: "10.0.0.1:1234", xff: []string{"198.51.100.1, 10.0.0.3", "10.0.0.2"}, want: "198.51.100.1"},
+		{name: "spoofed first hop", remoteAddr: "10.0.0.1:1234", xff: []string{"203.0.113.9, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "garbage hop", remoteAddr: "10.0.0.1:1234", xff: []string{"198.51.100.1, unknown"}, want: "10.0.0.1"},
+		{name: "hop with port", remoteAddr: "10.0.0.1:1234", xff: []string{"198.51.100.1:5678"}, want: "198.51.100.1"},
+		{name: "ipv6 proxy", remoteAddr: "[2001:db8::1]:1234", xff: []string{"[2001:db8::2]:5678"}, want: "2001:db8::2"},
+		{name: "unparsable remote", remoteAddr: "pipe", xff: []string{"198.51.100.1"}, want: "pipe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+
+			if got := s.controller.visitorIP(r); got != tt.want {
+				t.Errorf("visitorIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	conf := testConfig()
+	conf.DenyVisitors, _ = ipfilter.ParseList([]string{"203.0.113.0/24"})
+	conf.TrustedProxies, _ = ipfilter.ParseList([]string{"10.0.0.1"})
+	s := newTestServer(t, conf, nil, nil)
+	s.tunnel(t, "app", proxy.Options{IPFilter: &ipfilter.Rules{Allow: []string{"192.0.2.0/24", "203.0.113.0/24"}}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		update     string
+		remoteAddr string
+		xff        string
+		status     int
+	}{
+		{name: "allowed", remoteAddr: "192.0.2.1:1234", status: 200},
+		{name: "not allowed", remoteAddr: "198.51.100.1:1234", status: 403},
+		{name: "denied by the server", remoteAddr: "203.0.113.1:1234", status: 403},
+		{name: "allowed behind a trusted proxy", remoteAddr: "10.0.0.1:1234", xff: "192.0.2.1", status: 200},
+		{name: "not allowed behind a trusted proxy", remoteAddr: "10.0.0.1:1234", xff: "198.51.100.1", status: 403},
+		{name: "spoofed header", remoteAddr: "198.51.100.1:1234", xff: "192.0.2.1", status: 403},
+		{name: "deny added", update: `{"ip_filter":{"deny":["192.0.2.1"]}}`, remoteAddr: "192.0.2.1:1234", status: 403},
+		{name: "filter removed", update: `{"ip_filter":{}}`, remoteAddr: "198.51.100.1:1234", status: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.update != "" {
+				w := s.do("PATCH", "/api/v1/tunnel/app", tt.update, nil, "")
+				if w.Code != 200 {
+					t.Fatalf("update: status = %d: %s", w.Code, w.Body)
+				}
+			}
+
+			var header http.Header
+			if tt.xff != "" {
+				header = http.Header{"X-Forwarded-For": {tt.xff}}
+			}
+			w := s.do("GET", "http://app.localhost/", "", header, tt.remoteAddr)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestUpdateConnection(t *testing.T) {
+	s := newTestServer(t, testConfig(), nil, nil)
+	s.tunnel(t, "app", proxy.Options{}, http.NotFoundHandler())
+
+	tests := []struct {
+		name       string
+		body       string
+		remoteAddr string
+		status     int
+	}{
+		{name: "not the owner", body: `{"ip_filter":{"allow":["192.0.2.1"]}}`, remoteAddr: "192.0.2.1:1234", status: 404},
+		{name: "invalid json", body: `{`, status: 400},
+		{name: "nothing to update", body: `{}`, status: 400},
+		{name: "invalid rules", body: `{"ip_filter":{"allow":["nope"]}}`, status: 400},
+		{name: "rules", body: `{"ip_filter":{"allow":["192.0.2.1"]}}`, status: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do("PATCH", "/api/v1/tunnel/app", tt.body, nil, tt.remoteAddr)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	if rules := s.manager.Get("app").IPFilter(); rules == nil || len(rules.Allow) != 1 {
+		t.Errorf("IPFilter() = %+v, want the last valid rules", rules)
+	}
+}
@@ -0,0 +1,185 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"go-server/pkg/services/auth"
+	"go-server/pkg/services/domains"
+	"go-server/pkg/services/inspector"
+	"go-server/pkg/services/origin"
+	"go-server/pkg/services/proxy"
+	"go-server/pkg/services/registry"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testConfig() *proxy.Config {
+	return &proxy.Config{
+		MinPort:                       32000,
+		MaxPort:                       32100,
+		BaseDomain:                    "localhost",
+		MaxConnsPerClient:             4,
+		InactiveHoursTimeout:          24,
+		NoActiveSocketsMinutesTimeout: 10,
+		NoActiveSocketsChecks:         3,
+		InactivityCheckInterval:       time.Hour,
+		PoolGCInterval:                time.Minute,
+		ForwardIdleTimeout:            time.Minute,
+		UdpSessionIdleTimeout:         time.Minute,
+		AcquireRetries:                20,
+		AcquireRetryDelay:             10 * time.Millisecond,
+		InspectBufferSize:             10,
+		Inspect: inspector.Settings{
+			BodyLimit: 1024,
+			Redact:    []string{"Authorization"},
+		},
+	}
+}
+
+// testServer routes API requests like the public router and sends requests
+// for tunnel hosts to Proxy.
+type testServer struct {
+	manager    *proxy.TcpProxyManager
+	controller *Controller
+	router     *chi.Mux
+}
+
+func newTestServer(t *testing.T, conf *proxy.Config, keys *auth.KeyStore, domainRegistry *domains.Registry) *testServer {
+	t.Helper()
+
+	if keys == nil {
+		keys, _ = auth.NewKeyStore("", false)
+	}
+
+	m := proxy.NewTcpProxyManager(zerolog.Nop(), conf, registry.NopStore{}, domainRegistry)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		m.Shutdown(ctx)
+	})
+
+	c := NewTunnelController(zerolog.Nop(), m, keys, domainRegistry)
+
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if m.HostTunnel(r.Host) != nil {
+				c.Proxy(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	r.With(keys.Middleware).Post("/api/v1/tunnel", c.CreateConnection)
+	r.With(keys.Middleware).Patch("/api/v1/tunnel/{id}", c.UpdateConnection)
+	r.With(keys.Middleware).Post("/api/v1/tunnel/{id}/requests/{reqId}/replay", c.Replay)
+	r.With(keys.Middleware).Get("/api/v1/tunnel/{id}/requests/har", c.HAR)
+	r.With(keys.Middleware).Get("/api/v1/tunnel/{id}/domains", c.ListDomains)
+	r.With(keys.Middleware).Post("/api/v1/tunnel/{id}/domains", c.AddDomain)
+	r.With(keys.Middleware).Post("/api/v1/tunnel/{id}/domains/{host}/verify", c.VerifyDomain)
+	r.With(keys.Middleware).Delete("/api/v1/tunnel/{id}/domains/{host}", c.RemoveDomain)
+	r.With(keys.Middleware).Get("/api/v1/domains", c.ListKeyDomains)
+	r.With(keys.Middleware).Post("/api/v1/domains/{host}/verify", c.VerifyDomain)
+	r.With(keys.Middleware).Delete("/api/v1/domains/{host}", c.RemoveDomain)
+	r.HandleFunc("/*", c.Proxy)
+
+	return &testServer{manager: m, controller: c, router: r}
+}
+
+// clientAddr is where tunnel clients and their API calls come from.
+const clientAddr = "127.0.0.1:40000"
+
+// tunnel creates a tunnel whose client serves its forward connections with
+// h, like the tunnel client would with the local service.
+func (s *testServer) tunnel(t *testing.T, id string, opts proxy.Options, h http.Handler) *proxy.TcpProxyInstance {
+	t.Helper()
+
+	if opts.Kind == "" {
+		opts.Kind = proxy.KindHTTP
+	}
+
+	u, _ := url.Parse("http://" + id + ".localhost")
+	instance, err := s.manager.New(id, origin.NewMeta(u, net.IPv4(127, 0, 0, 1)), opts)
+	if err != nil {
+		t.Fatalf("tunnel %s was not created: %v", id, err)
+	}
+
+	ln := &connListener{conns: make(chan net.Conn, 2), closed: make(chan struct{})}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	_, port, _ := net.SplitHostPort(instance.GetAddr())
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.conns <- conn
+	}
+	for instance.Connections() < 2 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return instance
+}
+
+// do sends a request to the server as if it came from remoteAddr, or from
+// the tunnel client when empty.
+func (s *testServer) do(method, target, body string, header http.Header, remoteAddr string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+
+	req := httptest.NewRequest(method, target, r)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if remoteAddr == "" {
+		remoteAddr = clientAddr
+	}
+	req.RemoteAddr = remoteAddr
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+
+	return w
+}
+
+// connListener hands dialed connections to an http.Server, the client end
+// of forward connections.
+type connListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
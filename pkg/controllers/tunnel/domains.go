@@ -0,0 +1,203 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"go-server/pkg/services"
+	"go-server/pkg/services/auth"
+	"go-server/pkg/services/domains"
+	"go-server/pkg/services/proxy"
+	"go-server/pkg/services/registry"
+	"net/http"
+	"strings"
+)
+
+// AddDomain maps a custom domain to the tunnel. Visitors are routed through
+// it once VerifyDomain found the TXT record of the answer. The domain
+// belongs to the API key of the tunnel, which can still manage it once the
+// tunnel is gone.
+func (t *Controller) AddDomain(w http.ResponseWriter, r *http.Request) {
+	connection, ok := t.ownedTunnel(w, r)
+	if !ok {
+		return
+	}
+	if connection.Owner == "" {
+		w.WriteHeader(403)
+		w.Write([]byte(domains.ErrNoOwner.Error()))
+		return
+	}
+
+	dq := domainRequest{}
+	err := json.NewDecoder(r.Body).Decode(&dq)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	host, err := domains.Normalize(dq.Host)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	base := strings.ToLower(t.proxyManager.BaseDomain())
+	if base != "" && (host == base || services.IsTunnelHost(host, base)) {
+		w.WriteHeader(400)
+		w.Write([]byte("tunnel subdomains can't be added as custom domains"))
+		return
+	}
+
+	d, err := t.domains.Add(host, connection.ID, connection.Owner)
+	if err != nil {
+		t.domainError(w, err)
+		return
+	}
+
+	t.logger.Info().Str("name", connection.ID).Str("domain", host).Msg("added custom domain")
+
+	t.writeJSON(w, 201, newDomainResponse(d))
+}
+
+// ListDomains lists the domains of the tunnel which belong to the API key
+// of the caller, the tunnel doesn't have to be running.
+func (t *Controller) ListDomains(w http.ResponseWriter, r *http.Request) {
+	key := auth.KeyFromContext(r.Context())
+	if key == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+		return
+	}
+
+	res := domainsResponse{Domains: make([]domainResponse, 0)}
+	for _, d := range t.domains.List(chi.URLParam(r, "id")) {
+		if d.Owner == key.ID {
+			res.Domains = append(res.Domains, newDomainResponse(d))
+		}
+	}
+
+	t.writeJSON(w, 200, res)
+}
+
+// ListKeyDomains lists every domain of the API key of the caller, including
+// the ones of tunnels which were closed.
+func (t *Controller) ListKeyDomains(w http.ResponseWriter, r *http.Request) {
+	key := auth.KeyFromContext(r.Context())
+	if key == nil {
+		w.WriteHeader(401)
+		w.Write([]byte("api key required"))
+		return
+	}
+
+	res := domainsResponse{Domains: make([]domainResponse, 0)}
+	for _, d := range t.domains.ListOwned(key.ID) {
+		res.Domains = append(res.Domains, newDomainResponse(d))
+	}
+
+	t.writeJSON(w, 200, res)
+}
+
+// VerifyDomain looks up the TXT record of a domain of the tunnel.
+func (t *Controller) VerifyDomain(w http.ResponseWriter, r *http.Request) {
+	d, ok := t.ownedDomain(w, r)
+	if !ok {
+		return
+	}
+
+	d, err := t.domains.Verify(r.Context(), d.Host)
+	if err != nil {
+		t.domainError(w, err)
+		return
+	}
+
+	t.logger.Info().Str("name", d.TunnelID).Str("domain", d.Host).Msg("verified custom domain")
+
+	t.writeJSON(w, 200, newDomainResponse(d))
+}
+
+func (t *Controller) RemoveDomain(w http.ResponseWriter, r *http.Request) {
+	d, ok := t.ownedDomain(w, r)
+	if !ok {
+		return
+	}
+
+	err := t.domains.Remove(d.Host)
+	if err != nil {
+		t.domainError(w, err)
+		return
+	}
+
+	t.logger.Info().Str("name", d.TunnelID).Str("domain", d.Host).Msg("removed custom domain")
+
+	w.WriteHeader(200)
+	w.Write([]byte("{}"))
+}
+
+// ownedTunnel finds the tunnel of the URL if the caller may manage it, it
+// writes the error response otherwise.
+func (t *Controller) ownedTunnel(w http.ResponseWriter, r *http.Request) (*proxy.TcpProxyInstance, bool) {
+	connection := t.proxyManager.Get(chi.URLParam(r, "id"))
+	if connection == nil || !t.isOwner(r, connection) {
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+		return nil, false
+	}
+
+	return connection, true
+}
+
+// ownedDomain finds the domain of the URL if it belongs to the API key of
+// the caller, and to the tunnel of the URL when there is one. The tunnel
+// doesn't have to be running, so domains of closed tunnels can be removed.
+// It writes the error response otherwise.
+func (t *Controller) ownedDomain(w http.ResponseWriter, r *http.Request) (registry.DomainRecord, bool) {
+	key := auth.KeyFromContext(r.Context())
+	host, _ := domains.Normalize(chi.URLParam(r, "host"))
+	d, ok := t.domains.Get(host)
+
+	tunnelID := chi.URLParam(r, "id")
+	if key == nil || !ok || d.Owner != key.ID || (tunnelID != "" && d.TunnelID != tunnelID) {
+		w.WriteHeader(404)
+		w.Write([]byte("domain not found"))
+		return registry.DomainRecord{}, false
+	}
+
+	return d, true
+}
+
+func (t *Controller) domainError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, domains.ErrNotFound):
+		w.WriteHeader(404)
+	case errors.Is(err, domains.ErrTaken):
+		w.WriteHeader(409)
+	case errors.Is(err, domains.ErrNotVerified):
+		w.WriteHeader(422)
+	case errors.Is(err, domains.ErrLookup):
+		w.WriteHeader(502)
+	case errors.Is(err, domains.ErrNoOwner):
+		w.WriteHeader(403)
+	default:
+		t.logger.Err(err).Msg("failed to update custom domain")
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Write([]byte(err.Error()))
+}
+
+func (t *Controller) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(500)
+		t.logger.Err(err).Msg("failed to marshal response")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bytes)
+}
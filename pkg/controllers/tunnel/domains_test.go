@@ -0,0 +1,114 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go-server/pkg/services/auth"
+	"go-server/pkg/services/domains"
+	"go-server/pkg/services/proxy"
+	"go-server/pkg/services/registry"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// txtRecords is a resolver answering from a map, names without records are
+// not found.
+type txtRecords map[string][]string
+
+func (t txtRecords) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if name == domains.ChallengePrefix+"broken.example.com" {
+		return nil, errors.New("server misbehaving")
+	}
+
+	records, ok := t[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	return records, nil
+}
+
+func TestDomains(t *testing.T) {
+	keys, _ := auth.NewKeyStore("", false)
+	secret, key, _ := keys.Create("ci")
+	otherSecret, otherKey, _ := keys.Create("other")
+
+	records := txtRecords{}
+	domainRegistry, err := domains.NewRegistry(registry.NopStore{}, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestServer(t, testConfig(), keys, domainRegistry)
+	s.tunnel(t, "app", proxy.Options{Owner: key.ID}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("app"))
+	}))
+	s.tunnel(t, "other", proxy.Options{Owner: otherKey.ID}, http.NotFoundHandler())
+	s.tunnel(t, "anonymous", proxy.Options{}, http.NotFoundHandler())
+
+	bearer := func(secret string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + secret}}
+	}
+
+	// the token of app.example.com is published once it was added
+	publish := func(t *testing.T) {
+		d, ok := domainRegistry.Get("app.example.com")
+		if !ok {
+			t.Fatal("app.example.com was not added")
+		}
+		records[domains.ChallengePrefix+d.Host] = []string{d.Token}
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		header http.Header
+		before func(t *testing.T)
+		status int
+	}{
+		{name: "anonymous tunnel", method: "POST", target: "/api/v1/tunnel/anonymous/domains", body: `{"host":"app.example.com"}`, status: 403},
+		{name: "invalid host", method: "POST", target: "/api/v1/tunnel/app/domains", body: `{"host":"localhost"}`, header: bearer(secret), status: 400},
+		{name: "tunnel subdomain", method: "POST", target: "/api/v1/tunnel/app/domains", body: `{"host":"other.localhost"}`, header: bearer(secret), status: 400},
+		{name: "other key", method: "POST", target: "/api/v1/tunnel/app/domains", body: `{"host":"app.example.com"}`, header: bearer(otherSecret), status: 404},
+		{name: "add", method: "POST", target: "/api/v1/tunnel/app/domains", body: `{"host":"App.Example.com."}`, header: bearer(secret), status: 201},
+		{name: "add broken", method: "POST", target: "/api/v1/tunnel/app/domains", body: `{"host":"broken.example.com"}`, header: bearer(secret), status: 201},
+		{name: "not routed yet", method: "GET", target: "http://app.example.com/", status: 404},
+		{name: "record missing", method: "POST", target: "/api/v1/tunnel/app/domains/app.example.com/verify", header: bearer(secret), status: 422},
+		{name: "lookup failed", method: "POST", target: "/api/v1/tunnel/app/domains/broken.example.com/verify", header: bearer(secret), status: 502},
+		{name: "verify with other key", method: "POST", target: "/api/v1/domains/app.example.com/verify", header: bearer(otherSecret), before: publish, status: 404},
+		{name: "verify", method: "POST", target: "/api/v1/domains/app.example.com/verify", header: bearer(secret), status: 200},
+		{name: "routed", method: "GET", target: "http://app.example.com/", status: 200},
+		{name: "taken", method: "POST", target: "/api/v1/tunnel/other/domains", body: `{"host":"app.example.com"}`, header: bearer(otherSecret), status: 409},
+		{name: "remove with other key", method: "DELETE", target: "/api/v1/domains/app.example.com", header: bearer(otherSecret), status: 404},
+		{name: "remove", method: "DELETE", target: "/api/v1/tunnel/app/domains/app.example.com", header: bearer(secret), status: 200},
+		{name: "no longer routed", method: "GET", target: "http://app.example.com/", status: 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.before != nil {
+				tt.before(t)
+			}
+
+			w := s.do(tt.method, tt.target, tt.body, tt.header, "")
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	w := s.do("GET", "/api/v1/domains", "", bearer(secret), "")
+	var res struct {
+		Domains []struct {
+			Host string `json:"host"`
+		} `json:"domains"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	if len(res.Domains) != 1 || res.Domains[0].Host != "broken.example.com" {
+		t.Errorf("domains of the key = %s", w.Body)
+	}
+}
@@ -0,0 +1,20 @@
+package tunnel
+
+import "net/http"
+
+// flushWriter pushes every chunk to the visitor as soon as it is written, so
+// slow or long-lived responses are not held back in the server buffers.
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	fw.f.Flush()
+	return n, nil
+}
@@ -0,0 +1,176 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"go-server/pkg/services/inspector"
+	"go-server/pkg/services/proxy"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// keepAliveInterval is how often an idle request stream sends a comment, so
+// proxies in between don't time it out.
+const keepAliveInterval = 15 * time.Second
+
+// Requests lists the recent requests of a tunnel which has inspection on.
+func (t *Controller) Requests(w http.ResponseWriter, r *http.Request) {
+	_, buffer, ok := t.inspected(w, r)
+	if !ok {
+		return
+	}
+
+	filter, err := requestFilter(r)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	bytes, err := json.Marshal(requestsResponse{Requests: filter.Apply(buffer.List())})
+	if err != nil {
+		w.WriteHeader(500)
+		t.logger.Err(err).Msg("failed to marshal response")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// HAR exports the recent requests of a tunnel as an HTTP Archive.
+func (t *Controller) HAR(w http.ResponseWriter, r *http.Request) {
+	conn, buffer, ok := t.inspected(w, r)
+	if !ok {
+		return
+	}
+
+	filter, err := requestFilter(r)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	har := inspector.NewHAR(filter.Apply(buffer.List()), queryList(r, "redact"))
+
+	bytes, err := json.Marshal(har)
+	if err != nil {
+		w.WriteHeader(500)
+		t.logger.Err(err).Msg("failed to marshal response")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", conn.ID+".har"))
+	w.Write(bytes)
+}
+
+// StreamRequests sends each new request of the tunnel as a Server-Sent
+// Event until the visitor or the tunnel goes away.
+func (t *Controller) StreamRequests(w http.ResponseWriter, r *http.Request) {
+	_, buffer, ok := t.inspected(w, r)
+	if !ok {
+		return
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(500)
+		t.logger.Error().Msg("request stream: response can't be flushed")
+		return
+	}
+
+	entries, cancel := buffer.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	f.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e, ok := <-entries:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(e)
+			if err != nil {
+				t.logger.Err(err).Msg("request stream: failed to marshal entry")
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: request\ndata: %s\n\n", e.ID, data)
+		}
+
+		f.Flush()
+	}
+}
+
+// inspected finds a tunnel the caller may manage and its captured requests,
+// it writes the error response otherwise.
+func (t *Controller) inspected(w http.ResponseWriter, r *http.Request) (*proxy.TcpProxyInstance, *inspector.Buffer, bool) {
+	connection := t.proxyManager.Get(chi.URLParam(r, "id"))
+	if connection == nil || !t.isOwner(r, connection) {
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+		return nil, nil, false
+	}
+
+	buffer := connection.Inspector()
+	if buffer == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("request inspection is off for this tunnel"))
+		return nil, nil, false
+	}
+
+	return connection, buffer, true
+}
+
+// requestFilter reads the from and to times (RFC 3339) and the path
+// prefixes of the query.
+func requestFilter(r *http.Request) (inspector.Filter, error) {
+	f := inspector.Filter{Paths: queryList(r, "path")}
+
+	for name, t := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			continue
+		}
+
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("invalid %s: %w", name, err)
+		}
+		*t = parsed
+	}
+
+	return f, nil
+}
+
+// queryList returns the values of a repeated or comma separated query
+// parameter.
+func queryList(r *http.Request, name string) []string {
+	var list []string
+	for _, v := range r.URL.Query()[name] {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,76 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"go-server/pkg/services/inspector"
+	"go-server/pkg/services/proxy"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestHAR(t *testing.T) {
+	s := newTestServer(t, testConfig(), nil, nil)
+	s.tunnel(t, "app", proxy.Options{Inspect: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Write([]byte("ok"))
+	}))
+	s.tunnel(t, "plain", proxy.Options{}, http.NotFoundHandler())
+
+	for _, path := range []string{"/api/orders", "/api/users", "/static/app.js"} {
+		s.do("GET", "http://app.localhost"+path, "", http.Header{"Cookie": {"theme=dark"}}, "192.0.2.1:1234")
+	}
+
+	tests := []struct {
+		name       string
+		target     string
+		remoteAddr string
+		status     int
+		wantURLs   []string
+		wantCookie string
+	}{
+		{name: "all", target: "/api/v1/tunnel/app/requests/har", status: 200, wantURLs: []string{"http://app.localhost/api/orders", "http://app.localhost/api/users", "http://app.localhost/static/app.js"}, wantCookie: "theme=dark"},
+		{name: "path prefixes", target: "/api/v1/tunnel/app/requests/har?path=/api/users,/static", status: 200, wantURLs: []string{"http://app.localhost/api/users", "http://app.localhost/static/app.js"}, wantCookie: "theme=dark"},
+		{name: "until before any", target: "/api/v1/tunnel/app/requests/har?to=2000-01-01T00:00:00Z", status: 200, wantURLs: []string{}},
+		{name: "redacted", target: "/api/v1/tunnel/app/requests/har?path=/static&redact=cookie&redact=set-cookie", status: 200, wantURLs: []string{"http://app.localhost/static/app.js"}, wantCookie: "[REDACTED]"},
+		{name: "invalid time", target: "/api/v1/tunnel/app/requests/har?from=yesterday", status: 400},
+		{name: "not the owner", target: "/api/v1/tunnel/app/requests/har", remoteAddr: "192.0.2.1:1234", status: 404},
+		{name: "inspection off", target: "/api/v1/tunnel/plain/requests/har", status: 404},
+		{name: "unknown tunnel", target: "/api/v1/tunnel/nope/requests/har", status: 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do("GET", tt.target, "", nil, tt.remoteAddr)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != 200 {
+				return
+			}
+
+			if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="app.har"` {
+				t.Errorf("Content-Disposition = %q", got)
+			}
+
+			var har inspector.HAR
+			err := json.Unmarshal(w.Body.Bytes(), &har)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			urls := []string{}
+			for _, e := range har.Log.Entries {
+				urls = append(urls, e.Request.URL)
+				for _, h := range e.Request.Headers {
+					if h.Name == "Cookie" && h.Value != tt.wantCookie {
+						t.Errorf("Cookie = %q, want %q", h.Value, tt.wantCookie)
+					}
+				}
+			}
+			if !reflect.DeepEqual(urls, tt.wantURLs) {
+				t.Errorf("urls = %v, want %v", urls, tt.wantURLs)
+			}
+		})
+	}
+}
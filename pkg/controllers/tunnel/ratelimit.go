@@ -0,0 +1,35 @@
+package tunnel
+
+import (
+	"go-server/pkg/services/ratelimit"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// tooManyRequests rejects a rate limited visitor with the RateLimit header
+// fields of the IETF draft and Retry-After.
+func tooManyRequests(w http.ResponseWriter, res ratelimit.Result) {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	rateLimitHeaders(w, res)
+
+	w.WriteHeader(429)
+	w.Write([]byte("too many requests"))
+}
+
+// rateLimitHeaders tells visitors how much of the limit is left, it does
+// nothing when no limit applies.
+func rateLimitHeaders(w http.ResponseWriter, res ratelimit.Result) {
+	if res.Limit == 0 {
+		return
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"go-server/pkg/services/ratelimit"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		res        ratelimit.Result
+		denied     bool
+		want       map[string]string
+		wantStatus int
+	}{
+		{
+			name: "no limit",
+			res:  ratelimit.Result{Allowed: true},
+			want: map[string]string{"RateLimit-Limit": "", "RateLimit-Remaining": "", "Retry-After": ""},
+		},
+		{
+			name: "allowed",
+			res:  ratelimit.Result{Allowed: true, Limit: 10, Remaining: 9, Reset: 100 * time.Millisecond},
+			want: map[string]string{"RateLimit-Limit": "10", "RateLimit-Remaining": "9", "RateLimit-Reset": "1", "Retry-After": ""},
+		},
+		{
+			name:       "denied",
+			res:        ratelimit.Result{Limit: 10, Remaining: 0, Reset: 9500 * time.Millisecond, RetryAfter: 1500 * time.Millisecond},
+			denied:     true,
+			want:       map[string]string{"RateLimit-Limit": "10", "RateLimit-Remaining": "0", "RateLimit-Reset": "10", "Retry-After": "2"},
+			wantStatus: 429,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if tt.denied {
+				tooManyRequests(w, tt.res)
+			} else {
+				rateLimitHeaders(w, tt.res)
+			}
+
+			for name, want := range tt.want {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if tt.wantStatus != 0 && w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
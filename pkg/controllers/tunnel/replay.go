@@ -0,0 +1,79 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"go-server/pkg/services/inspector"
+	"go-server/pkg/services/proxy"
+	"io"
+	"net/http"
+)
+
+// Replay sends a captured request through the tunnel again, optionally
+// edited, and answers with the response of the client. The replay is
+// captured as well.
+func (t *Controller) Replay(w http.ResponseWriter, r *http.Request) {
+	conn, buffer, ok := t.inspected(w, r)
+	if !ok {
+		return
+	}
+
+	entry, ok := buffer.Get(chi.URLParam(r, "reqId"))
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("request not found"))
+		return
+	}
+
+	edit := inspector.Edit{}
+	err := json.NewDecoder(r.Body).Decode(&edit)
+	if err != nil && err != io.EOF {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	req, err := entry.Replay(r.Context(), edit)
+	if errors.Is(err, inspector.ErrTruncated) || errors.Is(err, inspector.ErrUpgrade) || errors.Is(err, inspector.ErrRedacted) {
+		w.WriteHeader(409)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+
+	req, capture := conn.Inspect(req, entry.VisitorIP)
+	capture.ReplayOf(entry.ID)
+
+	err, resp := conn.Proxy(req)
+	if resp != nil {
+		capture.Response(resp)
+	}
+	defer func() {
+		capture.Finish(sw.Status(), err)
+	}()
+
+	if errors.Is(err, proxy.ErrDraining) {
+		sw.WriteHeader(503)
+		sw.Write([]byte("tunnel is shutting down"))
+		return
+	}
+	if err != nil {
+		t.logger.Error().Err(err).Msg("failed to replay request")
+		sw.WriteHeader(502)
+		sw.Write([]byte(err.Error()))
+		return
+	}
+	defer resp.Body.Close()
+
+	t.clearHeaders(sw)
+	t.replicateHeaders(sw, resp)
+
+	err = t.replicateBody(sw, resp)
+}
@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"go-server/pkg/services/proxy"
+	"net/http"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	s := newTestServer(t, testConfig(), nil, nil)
+
+	auths := make(chan string, 10)
+	s.tunnel(t, "app", proxy.Options{Inspect: true}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths <- r.Header.Get("Authorization")
+		w.Write([]byte(r.Method + " " + r.URL.Path))
+	}))
+
+	w := s.do("POST", "http://app.localhost/orders", "{}", http.Header{"Authorization": {"Bearer visitor"}}, "")
+	if w.Code != 200 {
+		t.Fatalf("visitor request: status %d", w.Code)
+	}
+	if got := <-auths; got != "Bearer visitor" {
+		t.Fatalf("client got Authorization %q", got)
+	}
+
+	tests := []struct {
+		name     string
+		reqId    string
+		edit     string
+		status   int
+		wantAuth string
+		wantBody string
+	}{
+		{name: "unknown request", reqId: "99", status: 404},
+		{name: "redacted header", reqId: "1", status: 409},
+		{name: "invalid edit", reqId: "1", edit: "{", status: 400},
+		{name: "header sent again", reqId: "1", edit: `{"headers":{"Authorization":["Bearer again"]}}`, status: 200, wantAuth: "Bearer again", wantBody: "POST /orders"},
+		{name: "header removed", reqId: "1", edit: `{"method":"PUT","remove_headers":["Authorization"]}`, status: 200, wantAuth: "", wantBody: "PUT /orders"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := s.do("POST", "/api/v1/tunnel/app/requests/"+tt.reqId+"/replay", tt.edit, nil, "")
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != 200 {
+				return
+			}
+
+			if got := <-auths; got != tt.wantAuth {
+				t.Errorf("client got Authorization %q, want %q", got, tt.wantAuth)
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+
+	// replays are captured and point at their origin
+	instance := s.manager.Get("app")
+	entries := instance.Inspector().List()
+	last := entries[len(entries)-1]
+	if last.ReplayOf != "1" {
+		data, _ := json.Marshal(last)
+		t.Errorf("last entry %s, want a replay of 1", data)
+	}
+}
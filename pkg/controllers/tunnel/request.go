@@ -1,6 +1,9 @@
 package tunnel
 
 import (
+	"go-server/pkg/services/auth"
+	"go-server/pkg/services/ipfilter"
+	"go-server/pkg/services/proxy"
 	"net"
 	"net/http"
 	"net/url"
@@ -9,11 +12,28 @@ import (
 
 type tunnelRequest struct {
 	Name string `json:"name"`
+	Type string `json:"type"`
+
+	RateLimit *proxy.RateLimits `json:"rate_limit"`
+	Bandwidth *proxy.Bandwidth  `json:"bandwidth"`
+	Inspect   bool              `json:"inspect"`
+
+	Auth     *auth.VisitorCredentials `json:"auth"`
+	IPFilter *ipfilter.Rules          `json:"ip_filter"`
 
 	originalIP net.IP
 	originURL  *url.URL
 }
 
+type domainRequest struct {
+	Host string `json:"host"`
+}
+
+// tunnelUpdate are the settings of a running tunnel which can be changed.
+type tunnelUpdate struct {
+	IPFilter *ipfilter.Rules `json:"ip_filter"`
+}
+
 func newTunnelRequest(r *http.Request) tunnelRequest {
 	tq := tunnelRequest{}
 	tq.withMeta(r)
@@ -23,8 +43,10 @@ func newTunnelRequest(r *http.Request) tunnelRequest {
 func (t *tunnelRequest) withMeta(r *http.Request) *tunnelRequest {
 	r.URL.Host = r.Host
 
-	//TODO: read from request
 	r.URL.Scheme = "http"
+	if r.TLS != nil {
+		r.URL.Scheme = "https"
+	}
 
 	parts := strings.Split(r.RemoteAddr, ":")
 	t.originalIP = net.ParseIP(parts[0])
@@ -1,8 +1,55 @@
 package tunnel
 
+import (
+	"go-server/pkg/services/domains"
+	"go-server/pkg/services/inspector"
+	"go-server/pkg/services/registry"
+	"time"
+)
+
 type tunnelResponse struct {
 	Name             string `json:"id,omitempty"`
 	ProxyEndpointUrl string `json:"proxy_endpoint_url,omitempty"`
 	ClientUrl        string `json:"client_url,omitempty"`
+	Type             string `json:"type,omitempty"`
+	PublicAddr       string `json:"public_addr,omitempty"`
 	MaxConns         int    `json:"max_conn_count,omitempty"`
 }
+
+type domainResponse struct {
+	Host       string     `json:"host"`
+	TunnelID   string     `json:"tunnel_id"`
+	Verified   bool       `json:"verified"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+
+	// Verification tells which TXT record to create, until it was found.
+	Verification *domainVerification `json:"verification,omitempty"`
+}
+
+type domainVerification struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type domainsResponse struct {
+	Domains []domainResponse `json:"domains"`
+}
+
+func newDomainResponse(d registry.DomainRecord) domainResponse {
+	res := domainResponse{
+		Host:       d.Host,
+		TunnelID:   d.TunnelID,
+		Verified:   d.VerifiedAt != nil,
+		VerifiedAt: d.VerifiedAt,
+	}
+	if d.VerifiedAt == nil {
+		res.Verification = &domainVerification{Type: "TXT", Name: domains.ChallengePrefix + d.Host, Value: d.Token}
+	}
+
+	return res
+}
+
+type requestsResponse struct {
+	Requests []inspector.Entry `json:"requests"`
+}
@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// statusWriter remembers the status code sent to the visitor. It keeps the
+// Flusher and Hijacker of the wrapped writer, which streaming and protocol
+// upgrades rely on.
+type statusWriter struct {
+	http.ResponseWriter
+
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is only used for 101 Switching Protocols, whose status line is
+// written to the raw connection.
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can't be hijacked")
+	}
+
+	if sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+
+	return hj.Hijack()
+}
+
+func (sw *statusWriter) Status() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+
+	return sw.status
+}
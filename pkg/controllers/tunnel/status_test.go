@@ -0,0 +1,32 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w http.ResponseWriter)
+		want  int
+	}{
+		{name: "nothing written", write: func(w http.ResponseWriter) {}, want: 200},
+		{name: "body only", write: func(w http.ResponseWriter) { w.Write([]byte("ok")) }, want: 200},
+		{name: "explicit status", write: func(w http.ResponseWriter) { w.WriteHeader(404) }, want: 404},
+		{name: "first status wins", write: func(w http.ResponseWriter) { w.WriteHeader(502); w.WriteHeader(200) }, want: 502},
+		{name: "status after body", write: func(w http.ResponseWriter) { w.Write([]byte("ok")); w.WriteHeader(500) }, want: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sw := &statusWriter{ResponseWriter: httptest.NewRecorder()}
+			tt.write(sw)
+
+			if got := sw.Status(); got != tt.want {
+				t.Errorf("Status() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
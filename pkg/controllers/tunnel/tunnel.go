@@ -1,29 +1,42 @@
 package tunnel
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
 	"go-server/pkg/services"
+	"go-server/pkg/services/auth"
+	"go-server/pkg/services/domains"
+	"go-server/pkg/services/metrics"
 	"go-server/pkg/services/origin"
 	"go-server/pkg/services/proxy"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"strconv"
 	"strings"
+	"time"
 )
 
+var tracer = otel.Tracer("go-server/pkg/controllers/tunnel")
+
 type Controller struct {
 	logger zerolog.Logger
 
 	proxyManager *proxy.TcpProxyManager
+	keys         *auth.KeyStore
+	domains      *domains.Registry
 }
 
-func NewTunnelController(logger zerolog.Logger, proxyManager *proxy.TcpProxyManager) *Controller {
-	return &Controller{logger: logger, proxyManager: proxyManager}
+func NewTunnelController(logger zerolog.Logger, proxyManager *proxy.TcpProxyManager, keys *auth.KeyStore, domainRegistry *domains.Registry) *Controller {
+	return &Controller{logger: logger, proxyManager: proxyManager, keys: keys, domains: domainRegistry}
 }
 
 func (t *Controller) CreateConnection(w http.ResponseWriter, r *http.Request) {
@@ -41,96 +54,147 @@ func (t *Controller) CreateConnection(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	t.createTunnelResponse(w, tq)
+	t.createTunnelResponse(w, r, tq)
 	return
 }
 
 func (t Controller) TryProxy(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" && r.URL.Query().Has("new") {
-		tq := newTunnelRequest(r)
-		tq.Name = r.URL.Query().Get("new")
-
-		t.createTunnelResponse(w, tq)
+		t.keys.Middleware(http.HandlerFunc(t.createConnectionFromQuery)).ServeHTTP(w, r)
 		return
 	}
 
 	t.Proxy(w, r)
 }
 
+func (t Controller) createConnectionFromQuery(w http.ResponseWriter, r *http.Request) {
+	tq := newTunnelRequest(r)
+	tq.Name = r.URL.Query().Get("new")
+	tq.Type = r.URL.Query().Get("type")
+	tq.Inspect = r.URL.Query().Has("inspect")
+
+	t.createTunnelResponse(w, r, tq)
+}
+
 func (t Controller) Proxy(w http.ResponseWriter, r *http.Request) {
-	tunnelId := services.GetTunnelNameFromHost(r.Host)
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "Controller.Proxy", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		semconv.HTTPMethodKey.String(r.Method),
+		semconv.HTTPTargetKey.String(r.URL.RequestURI()),
+		semconv.HTTPHostKey.String(r.Host),
+	))
+	defer span.End()
+
+	sw := &statusWriter{ResponseWriter: w}
+	t.proxy(sw, r.WithContext(ctx))
+
+	status := sw.Status()
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
 
-	ok := t.proxyManager.Exists(tunnelId)
-	if !ok {
-		w.Write([]byte("not found"))
+	metrics.VisitorRequests.WithLabelValues(strconv.Itoa(status)).Inc()
+}
+
+func (t Controller) proxy(w *statusWriter, r *http.Request) {
+	conn := t.proxyManager.HostTunnel(r.Host)
+	if conn == nil || conn.Kind != proxy.KindHTTP {
 		w.WriteHeader(404)
+		w.Write([]byte("not found"))
 		return
 	}
+	tunnelId := conn.ID
 
-	conn := t.proxyManager.Get(tunnelId)
-	if conn == nil {
-		w.Write([]byte("no tunnel connection available"))
-		w.WriteHeader(504)
+	ip := t.visitorIP(r)
+	if !conn.Permit(ip) {
+		w.WriteHeader(403)
+		w.Write([]byte("forbidden"))
 		return
 	}
 
-	input, err := httputil.DumpRequest(r, true)
-	if err != nil {
-		t.logger.Error().Err(err).Msg("failed to read client data")
-		w.WriteHeader(500)
+	limit := conn.Allow(ip)
+	if !limit.Allowed {
+		tooManyRequests(w, limit)
 		return
 	}
 
-	// err might be non nil because of response read timeout
-	// Timeout will be triggered because of deadline exceed
-	// timeout exceed can be caused by 2 reasons:
-	// 1. Real client timeout
-	// 2. Read data timeout caused by data receive finish
-	// Here it ignores err in case response size is non 0
-	err, resp := conn.Proxy(input)
-	if err != nil && len(resp) == 0 {
+	if guard := conn.Guard(); guard != nil {
+		ok, attempt := guard.Authorized(r, ip)
+		if !attempt.Allowed {
+			tooManyRequests(w, attempt)
+			return
+		}
+		if !ok {
+			guard.Challenge(w, r, tunnelId)
+			return
+		}
+
+		// the credentials are for the tunnel, the client never sees them
+		r.Header.Del("Authorization")
+	}
+
+	r, capture := conn.Inspect(r, ip)
+
+	upgrade := proxy.UpgradeType(r.Header)
+	if upgrade != "" {
+		t.logger.Debug().Str("tunnel-id", tunnelId).Str("upgrade", upgrade).Msg("visitor requested protocol upgrade")
+	}
+
+	err, resp := conn.Proxy(r)
+	if capture != nil {
+		if resp != nil {
+			capture.Response(resp)
+		}
+		defer func() {
+			capture.Finish(w.Status(), err)
+		}()
+	}
+
+	if errors.Is(err, proxy.ErrDraining) {
+		w.WriteHeader(503)
+		w.Write([]byte("tunnel is shutting down"))
+		return
+	}
+	if err != nil {
 		t.logger.Error().Err(err).Msg("failed to proxy data")
 		w.WriteHeader(500)
 		return
 	}
+	defer resp.Body.Close()
 
-	parsedResp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), r)
-	if err != nil {
-		netErr, ok := err.(*net.OpError)
-		if !ok || (ok && !netErr.Timeout()) {
-			t.logger.Error().Err(err).Msg("failed to parse req")
-			w.WriteHeader(500)
-			return
-		}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		t.switchProtocols(w, resp)
+		return
 	}
 
 	t.clearHeaders(w)
-	t.replicateHeaders(w, parsedResp)
-
-	t.replicateBody(w, err, parsedResp)
+	rateLimitHeaders(w, limit)
+	t.replicateHeaders(w, resp)
 
+	err = t.replicateBody(w, resp)
 }
 
-func (t Controller) replicateBody(w http.ResponseWriter, err error, parsedResp *http.Response) {
-	body, err := io.ReadAll(parsedResp.Body)
-	if err != nil {
-		t.logger.Error().Err(err).Msg("failed to parse req body")
+func (t Controller) replicateBody(w http.ResponseWriter, resp *http.Response) error {
+	var dst io.Writer = w
+	if f, ok := w.(http.Flusher); ok {
+		dst = flushWriter{w: w, f: f}
 	}
 
-	_, err = w.Write(body)
+	_, err := io.Copy(dst, resp.Body)
 	if err != nil {
-		t.logger.Error().Err(err).Msg("failed to write data")
-		w.WriteHeader(500)
-		return
+		t.logger.Error().Err(err).Msg("failed to stream response body")
 	}
-}
 
-func (Controller) replicateHeaders(w http.ResponseWriter, parsedResp *http.Response) {
-	w.WriteHeader(parsedResp.StatusCode)
+	return err
+}
 
-	for s := range parsedResp.Header {
-		w.Header().Set(s, parsedResp.Header.Get(s))
+func (Controller) replicateHeaders(w http.ResponseWriter, resp *http.Response) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
 	}
+
+	w.WriteHeader(resp.StatusCode)
 }
 
 func (Controller) clearHeaders(w http.ResponseWriter) {
@@ -139,11 +203,84 @@ func (Controller) clearHeaders(w http.ResponseWriter) {
 	}
 }
 
-func (t Controller) createTunnelResponse(w http.ResponseWriter, tq tunnelRequest) {
-	c := t.createTunnel(tq)
-	if c == nil {
-		t.logger.Error().Msgf("failed to create proxy for request: %+v", tq)
+func (t Controller) createTunnelResponse(w http.ResponseWriter, r *http.Request, tq tunnelRequest) {
+	kind, err := proxy.ParseKind(tq.Type)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if tq.RateLimit != nil {
+		err = tq.RateLimit.Validate()
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	if tq.Bandwidth != nil {
+		conf := t.proxyManager.Config()
+		err = tq.Bandwidth.Validate(conf.MaxTunnelUpload, conf.MaxTunnelDownload)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	opts := proxy.Options{Kind: kind, RateLimit: tq.RateLimit, Bandwidth: tq.Bandwidth, Inspect: tq.Inspect}
+
+	if tq.IPFilter != nil {
+		_, err = tq.IPFilter.Compile()
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		opts.IPFilter = tq.IPFilter
+	}
+
+	if tq.Auth != nil {
+		err = tq.Auth.Validate()
+		if err == nil && kind != proxy.KindHTTP {
+			err = errors.New("auth is only supported for http tunnels")
+		}
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		opts.Auth, err = tq.Auth.Hash()
+		if err != nil {
+			t.logger.Err(err).Msg("failed to hash visitor credentials")
+			w.WriteHeader(500)
+			return
+		}
+	}
+
+	if key := auth.KeyFromContext(r.Context()); key != nil {
+		opts.Owner = key.ID
+	}
+
+	if t.proxyManager.ShuttingDown() {
+		w.WriteHeader(503)
+		w.Write([]byte("server is shutting down"))
+		return
+	}
+
+	c, err := t.createTunnel(tq, opts)
+	if errors.Is(err, proxy.ErrShuttingDown) {
+		w.WriteHeader(503)
+		w.Write([]byte("server is shutting down"))
+		return
+	}
+	if err != nil {
+		t.logger.Error().Err(err).Msgf("failed to create proxy for request: %+v", tq)
 		w.WriteHeader(500)
+		w.Write([]byte("failed to create tunnel"))
 		return
 	}
 
@@ -152,10 +289,12 @@ func (t Controller) createTunnelResponse(w http.ResponseWriter, tq tunnelRequest
 		ProxyEndpointUrl: c.ProxyEndpointUrl(),
 		ClientUrl:        c.ClientUrl(),
 		MaxConns:         c.MaxConns(),
+		Type:             string(c.Kind),
+		PublicAddr:       c.PublicAddr(),
 	}
 
 	enc := json.NewEncoder(w)
-	err := enc.Encode(tr)
+	err = enc.Encode(tr)
 
 	if err != nil {
 		t.logger.Error().Err(err).Msg("failed to encode response")
@@ -163,10 +302,10 @@ func (t Controller) createTunnelResponse(w http.ResponseWriter, tq tunnelRequest
 		return
 	}
 
-	t.logger.Info().Str("name", c.ID).Int("port", c.Port).Str("url", c.ClientUrl()).Msg("opened new tunnel")
+	t.logger.Info().Str("name", c.ID).Str("type", string(c.Kind)).Int("port", c.Port).Str("url", c.ClientUrl()).Msg("opened new tunnel")
 }
 
-func (t Controller) createTunnel(tq tunnelRequest) *proxy.TcpProxyInstance {
+func (t Controller) createTunnel(tq tunnelRequest, opts proxy.Options) (*proxy.TcpProxyInstance, error) {
 	if tq.Name == "" {
 		tq.Name = services.GenerateTunnelName()
 	}
@@ -175,8 +314,7 @@ func (t Controller) createTunnel(tq tunnelRequest) *proxy.TcpProxyInstance {
 		tq.Name = services.GenerateTunnelName()
 	}
 
-	c := t.proxyManager.New(tq.Name, origin.NewMeta(tq.originURL, tq.originalIP))
-	return c
+	return t.proxyManager.New(tq.Name, origin.NewMeta(tq.originURL, tq.originalIP), opts)
 }
 
 func (t *Controller) DeleteConnection(w http.ResponseWriter, r *http.Request) {
@@ -184,21 +322,46 @@ func (t *Controller) DeleteConnection(w http.ResponseWriter, r *http.Request) {
 
 	ok := t.proxyManager.Exists(tunnelId)
 	if !ok {
-		w.Write([]byte("not found"))
 		w.WriteHeader(404)
+		w.Write([]byte("not found"))
 		return
 	}
 
 	connection := t.proxyManager.Get(tunnelId)
 
-	creatorIP := connection.GetCreatorIP()
-	requestIP := net.ParseIP(strings.Split(r.RemoteAddr, ":")[0])
-	if !creatorIP.Equal(requestIP) {
+	if !t.isOwner(r, connection) {
 		w.WriteHeader(404)
 		return
 	}
 
-	connection.RequestClose()
-	w.WriteHeader(200)
+	drain := r.URL.Query().Get("drain")
+	if drain == "" {
+		connection.RequestClose()
+		w.WriteHeader(200)
+		w.Write([]byte("{}"))
+		return
+	}
+
+	timeout, err := time.ParseDuration(drain)
+	if err != nil || timeout < 0 {
+		w.WriteHeader(400)
+		w.Write([]byte("invalid drain duration"))
+		return
+	}
+
+	go connection.Drain(timeout)
+	w.WriteHeader(202)
 	w.Write([]byte("{}"))
 }
+
+// isOwner tells whether the request may manage the tunnel. Tunnels created
+// with an API key belong to that key, anonymous ones to the creator's IP.
+func (t Controller) isOwner(r *http.Request, connection *proxy.TcpProxyInstance) bool {
+	if connection.Owner != "" {
+		key := auth.KeyFromContext(r.Context())
+		return key != nil && key.ID == connection.Owner
+	}
+
+	requestIP := net.ParseIP(strings.Split(r.RemoteAddr, ":")[0])
+	return connection.GetCreatorIP().Equal(requestIP)
+}
@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"go-server/pkg/services/proxy"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyExpectContinue(t *testing.T) {
+	s := newTestServer(t, testConfig(), nil, nil)
+	s.tunnel(t, "app", proxy.Options{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		fmt.Fprintf(w, "%s:%d", r.URL.Path, n)
+	}))
+
+	srv := httptest.NewServer(s.router)
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		expect bool
+		want   string
+	}{
+		// like curl uploading more than 1 KB
+		{name: "upload", method: "POST", path: "/a", body: strings.Repeat("x", 4096), expect: true, want: "/a:4096"},
+		{name: "next visitor", method: "GET", path: "/b", want: "/b:0"},
+		{name: "upload again", method: "PUT", path: "/c", body: "hello", expect: true, want: "/c:5"},
+		{name: "after upload", method: "GET", path: "/d", want: "/d:0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			r, _ := http.NewRequest(tt.method, srv.URL+tt.path, body)
+			r.Host = "app.localhost"
+			if tt.expect {
+				r.Header.Set("Expect", "100-continue")
+			}
+
+			resp, err := client.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != 200 || string(data) != tt.want {
+				t.Errorf("got %d %q, want 200 %q", resp.StatusCode, data, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyResponseHopHeaders(t *testing.T) {
+	s := newTestServer(t, testConfig(), nil, nil)
+	s.tunnel(t, "app", proxy.Options{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-End", "2")
+		w.Write([]byte("ok"))
+	}))
+
+	w := s.do("GET", "http://app.localhost/", "", nil, "")
+	if w.Code != 200 {
+		t.Fatalf("status = %d", w.Code)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "Connection", want: ""},
+		{name: "X-Hop", want: ""},
+		{name: "Keep-Alive", want: ""},
+		{name: "Proxy-Authenticate", want: ""},
+		{name: "Transfer-Encoding", want: ""},
+		{name: "X-End", want: "2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := w.Header().Get(tt.name); got != tt.want {
+				t.Errorf("%s = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateTunnelFailure(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, conf *proxy.Config)
+		shutdown bool
+		body     string
+		want     int
+	}{
+		{
+			name: "no free port",
+			setup: func(t *testing.T, conf *proxy.Config) {
+				conf.MaxPort = conf.MinPort
+			},
+			body: `{"name":"app","type":"http"}`,
+			want: 500,
+		},
+		{
+			name: "port in use",
+			setup: func(t *testing.T, conf *proxy.Config) {
+				ln, err := net.Listen("tcp", ":0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { ln.Close() })
+				conf.MinPort = ln.Addr().(*net.TCPAddr).Port
+				conf.MaxPort = conf.MinPort + 2
+			},
+			body: `{"name":"app","type":"tcp"}`,
+			want: 500,
+		},
+		{
+			name:     "shutting down",
+			setup:    func(t *testing.T, conf *proxy.Config) {},
+			shutdown: true,
+			body:     `{"name":"app","type":"http"}`,
+			want:     503,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := testConfig()
+			tt.setup(t, conf)
+			s := newTestServer(t, conf, nil, nil)
+			if tt.shutdown {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				s.manager.Shutdown(ctx)
+			}
+
+			w := s.do("POST", "/api/v1/tunnel", tt.body, nil, "")
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			if s.manager.Exists("app") {
+				t.Error("failed tunnel is registered")
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// switchProtocols takes over the visitor connection after the client
+// answered 101 Switching Protocols and splices it with the forward
+// connection until either side goes away.
+func (t Controller) switchProtocols(w http.ResponseWriter, resp *http.Response) {
+	backend, ok := resp.Body.(io.ReadWriter)
+	if !ok {
+		t.logger.Error().Msg("switching protocols: response body is not writable")
+		w.WriteHeader(502)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		t.logger.Error().Msg("switching protocols: connection can't be hijacked")
+		w.WriteHeader(500)
+		return
+	}
+
+	visitor, brw, err := hj.Hijack()
+	if err != nil {
+		t.logger.Error().Err(err).Msg("switching protocols: failed to hijack connection")
+		return
+	}
+	defer visitor.Close()
+
+	fmt.Fprintf(brw, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status)
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+	err = brw.Flush()
+	if err != nil {
+		t.logger.Error().Err(err).Msg("switching protocols: failed to write response")
+		return
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backend, brw)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(visitor, backend)
+		errc <- err
+	}()
+
+	err = <-errc
+	if err != nil {
+		t.logger.Debug().Err(err).Msg("switching protocols: session closed")
+	}
+}
@@ -5,12 +5,22 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/httplog"
 	"github.com/rs/zerolog"
+	"go-server/pkg/controllers/certificates"
+	"go-server/pkg/controllers/keys"
+	"go-server/pkg/controllers/reload"
 	"go-server/pkg/controllers/stats"
 	"go-server/pkg/controllers/tunnel"
+	"go-server/pkg/services/auth"
+	"go-server/pkg/services/certs"
+	"go-server/pkg/services/domains"
+	"go-server/pkg/services/metrics"
 	"go-server/pkg/services/proxy"
+	"net/http"
 )
 
-func GetRouter(pc *proxy.Config, logger zerolog.Logger) *chi.Mux {
+// GetRouter builds the public router. admin is mounted under /api/v1/admin
+// when given, pass nil when the admin API has a listener of its own.
+func GetRouter(proxyManager *proxy.TcpProxyManager, logger zerolog.Logger, keyStore *auth.KeyStore, domainRegistry *domains.Registry, admin http.Handler) *chi.Mux {
 	r := chi.NewRouter()
 
 	httpLogger := httplog.NewLogger("http", httplog.Options{
@@ -20,14 +30,27 @@ func GetRouter(pc *proxy.Config, logger zerolog.Logger) *chi.Mux {
 	r.Use(httplog.RequestLogger(httpLogger))
 	r.Use(middleware.Recoverer)
 
-	proxyManager := proxy.NewTcpProxyManager(logger.With().Str("module", "proxy-manager").Logger(), pc)
+	tunnelController := tunnel.NewTunnelController(logger.With().Str("module", "controller:tunnel").Logger(), proxyManager, keyStore, domainRegistry)
 
-	tunnelController := tunnel.NewTunnelController(logger.With().Str("module", "controller:tunnel").Logger(), proxyManager)
-	statsController := stats.NewStatsController(logger.With().Str("module", "controller:stats").Logger(), proxyManager)
+	r.Use(tunnelHosts(proxyManager, tunnelController.Proxy))
 
-	r.Post("/api/v1/tunnel", tunnelController.CreateConnection)
-	r.Delete("/api/v1/tunnel/{id}", tunnelController.DeleteConnection)
-	r.Get("/api/v1/admin/stats", statsController.Get)
+	r.With(keyStore.Middleware).Post("/api/v1/tunnel", tunnelController.CreateConnection)
+	r.With(keyStore.Middleware).Delete("/api/v1/tunnel/{id}", tunnelController.DeleteConnection)
+	r.With(keyStore.Middleware).Patch("/api/v1/tunnel/{id}", tunnelController.UpdateConnection)
+	r.With(keyStore.Middleware).Get("/api/v1/tunnel/{id}/requests", tunnelController.Requests)
+	r.With(keyStore.Middleware).Get("/api/v1/tunnel/{id}/requests/stream", tunnelController.StreamRequests)
+	r.With(keyStore.Middleware).Get("/api/v1/tunnel/{id}/requests/har", tunnelController.HAR)
+	r.With(keyStore.Middleware).Post("/api/v1/tunnel/{id}/requests/{reqId}/replay", tunnelController.Replay)
+	r.With(keyStore.Middleware).Get("/api/v1/tunnel/{id}/domains", tunnelController.ListDomains)
+	r.With(keyStore.Middleware).Post("/api/v1/tunnel/{id}/domains", tunnelController.AddDomain)
+	r.With(keyStore.Middleware).Post("/api/v1/tunnel/{id}/domains/{host}/verify", tunnelController.VerifyDomain)
+	r.With(keyStore.Middleware).Delete("/api/v1/tunnel/{id}/domains/{host}", tunnelController.RemoveDomain)
+	r.With(keyStore.Middleware).Get("/api/v1/domains", tunnelController.ListKeyDomains)
+	r.With(keyStore.Middleware).Post("/api/v1/domains/{host}/verify", tunnelController.VerifyDomain)
+	r.With(keyStore.Middleware).Delete("/api/v1/domains/{host}", tunnelController.RemoveDomain)
+	if admin != nil {
+		r.Mount("/api/v1/admin", admin)
+	}
 	r.Get("/*", tunnelController.TryProxy)
 	r.Post("/*", tunnelController.Proxy)
 	r.Delete("/*", tunnelController.Proxy)
@@ -38,3 +61,59 @@ func GetRouter(pc *proxy.Config, logger zerolog.Logger) *chi.Mux {
 
 	return r
 }
+
+// GetAdminRouter builds the admin API, routed under /api/v1/admin. acme may
+// be nil when certificates are not managed via ACME.
+func GetAdminRouter(proxyManager *proxy.TcpProxyManager, logger zerolog.Logger, acme *certs.AcmeManager, keyStore *auth.KeyStore, creds auth.AdminCredentials, reloader reload.Reloader) *chi.Mux {
+	r := chi.NewRouter()
+
+	r.Use(creds.Middleware)
+
+	statsController := stats.NewStatsController(logger.With().Str("module", "controller:stats").Logger(), proxyManager)
+	keysController := keys.NewKeysController(logger.With().Str("module", "controller:keys").Logger(), keyStore)
+	certificatesController := certificates.NewCertificatesController(logger.With().Str("module", "controller:certificates").Logger(), acme)
+	reloadController := reload.NewReloadController(logger.With().Str("module", "controller:reload").Logger(), reloader)
+
+	r.Get("/stats", statsController.Get)
+	r.Get("/stats/{id}", statsController.GetTunnel)
+	r.Get("/certificates", certificatesController.Get)
+	r.Get("/keys", keysController.List)
+	r.Post("/keys", keysController.Create)
+	r.Delete("/keys/{id}", keysController.Delete)
+	r.Post("/reload", reloadController.Post)
+	r.Handle("/metrics", metrics.Handler())
+
+	return r
+}
+
+// GetAdminServerRouter wraps the admin API for its own listener.
+func GetAdminServerRouter(admin http.Handler) *chi.Mux {
+	r := chi.NewRouter()
+
+	httpLogger := httplog.NewLogger("http-admin", httplog.Options{
+		JSON: true,
+	})
+
+	r.Use(httplog.RequestLogger(httpLogger))
+	r.Use(middleware.Recoverer)
+
+	r.Mount("/api/v1/admin", admin)
+
+	return r
+}
+
+// tunnelHosts sends every request addressed to an existing tunnel's host
+// straight to the tunnel, so API paths like /api/v1/admin are never served
+// on tunnel hosts and visitors reach the same paths on the client.
+func tunnelHosts(proxyManager *proxy.TcpProxyManager, proxyHandler http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if proxyManager.HostTunnel(r.Host) != nil {
+				proxyHandler(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package routing
+
+import (
+	"github.com/rs/zerolog"
+	"go-server/pkg/services/auth"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminKeyRoutes(t *testing.T) {
+	keyStore, _ := auth.NewKeyStore("", true)
+	admin := GetAdminRouter(nil, zerolog.Nop(), nil, keyStore, auth.AdminCredentials{Token: "admin-secret"}, nil)
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		body          string
+		authorization string
+		status        int
+	}{
+		{name: "list anonymous", method: "GET", path: "/keys", status: 401},
+		{name: "create anonymous", method: "POST", path: "/keys", body: `{"name":"x"}`, status: 401},
+		{name: "revoke anonymous", method: "DELETE", path: "/keys/abc", status: 401},
+		{name: "wrong token", method: "GET", path: "/keys", authorization: "Bearer nope", status: 401},
+		{name: "list", method: "GET", path: "/keys", authorization: "Bearer admin-secret", status: 200},
+		{name: "create", method: "POST", path: "/keys", body: `{"name":"x"}`, authorization: "Bearer admin-secret", status: 200},
+		{name: "revoke unknown", method: "DELETE", path: "/keys/abc", authorization: "Bearer admin-secret", status: 404},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+
+	if n := len(keyStore.List()); n != 1 {
+		t.Errorf("store has %d keys, want only the authorized one", n)
+	}
+}
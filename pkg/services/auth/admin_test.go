@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminMiddleware(t *testing.T) {
+	both := AdminCredentials{Token: "tok", User: "admin", Password: "pw"}
+
+	tests := []struct {
+		name          string
+		creds         AdminCredentials
+		token         string
+		user          string
+		password      string
+		status        int
+		wantChallenge []string
+	}{
+		{name: "token", creds: both, token: "tok", status: 200},
+		{name: "wrong token", creds: both, token: "nope", status: 401, wantChallenge: []string{`Basic realm="admin"`, `Bearer realm="admin"`}},
+		{name: "basic auth", creds: both, user: "admin", password: "pw", status: 200},
+		{name: "wrong password", creds: both, user: "admin", password: "nope", status: 401},
+		{name: "wrong user", creds: both, user: "root", password: "pw", status: 401},
+		{name: "anonymous", creds: both, status: 401},
+		{name: "token only", creds: AdminCredentials{Token: "tok"}, user: "admin", password: "pw", status: 401, wantChallenge: []string{`Bearer realm="admin"`}},
+		{name: "user without password is not configured", creds: AdminCredentials{User: "admin"}, user: "admin", password: "", status: 401},
+		{name: "unconfigured", creds: AdminCredentials{}, status: 401},
+		{name: "unconfigured private listener", creds: AdminCredentials{AllowAnonymous: true}, status: 200},
+		{name: "configured private listener", creds: AdminCredentials{Token: "tok", AllowAnonymous: true}, status: 401},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.creds.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest("GET", "/api/v1/admin/stats", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.wantChallenge != nil {
+				got := w.Header().Values("WWW-Authenticate")
+				if len(got) != len(tt.wantChallenge) {
+					t.Fatalf("challenges = %q, want %q", got, tt.wantChallenge)
+				}
+				for i := range got {
+					if got[i] != tt.wantChallenge[i] {
+						t.Errorf("challenges = %q, want %q", got, tt.wantChallenge)
+					}
+				}
+			}
+		})
+	}
+}
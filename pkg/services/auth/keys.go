@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const keyPrefix = "gc_"
+
+var ErrKeyNotFound = errors.New("api key not found")
+
+// Key is an API key as it is stored, only the SHA-256 of the secret is
+// kept.
+type Key struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// KeyStore holds the API keys allowed to create and delete tunnels. Keys
+// created or revoked through the admin API are written back to the file
+// they were loaded from.
+type KeyStore struct {
+	// Required rejects requests without a key, otherwise anonymous
+	// requests are let through and only presented keys are checked.
+	Required bool
+
+	m    sync.RWMutex
+	path string
+	keys []*Key
+}
+
+// NewKeyStore loads keys from path, which may be empty to keep keys in
+// memory only. A missing file is created on the first write.
+func NewKeyStore(path string, required bool) (*KeyStore, error) {
+	s := &KeyStore{Required: required, path: path}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &s.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Create generates a new key and returns its secret, which is not stored
+// and can't be recovered later.
+func (s *KeyStore) Create(name string) (string, Key, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return "", Key{}, err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", Key{}, err
+	}
+	secret = keyPrefix + secret
+
+	key := &Key{ID: id, Name: name, Hash: hash(secret), CreatedAt: time.Now().UTC()}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.keys = append(s.keys, key)
+
+	return secret, *key, s.save()
+}
+
+func (s *KeyStore) Revoke(id string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for i, k := range s.keys {
+		if k.ID == id {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			return s.save()
+		}
+	}
+
+	return ErrKeyNotFound
+}
+
+func (s *KeyStore) List() []Key {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	keys := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys
+}
+
+// Authenticate returns the key a secret belongs to, or nil.
+func (s *KeyStore) Authenticate(secret string) *Key {
+	h := hash(secret)
+
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(h)) == 1 {
+			key := *k
+			return &key
+		}
+	}
+
+	return nil
+}
+
+// save writes the keys back to the file, it must be called with m held.
+func (s *KeyStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
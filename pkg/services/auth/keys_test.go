@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	s, err := NewKeyStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, key, err := s.Create("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, keyPrefix) {
+		t.Errorf("secret %q lacks the %q prefix", secret, keyPrefix)
+	}
+	if key.Hash == secret || strings.Contains(key.Hash, secret) {
+		t.Error("the secret is stored in clear")
+	}
+
+	// keys survive a restart
+	s, err = NewKeyStore(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		want   string
+	}{
+		{name: "valid", secret: secret, want: key.ID},
+		{name: "wrong", secret: keyPrefix + "0000", want: ""},
+		{name: "empty", secret: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.Authenticate(tt.secret)
+			if got == nil && tt.want != "" || got != nil && got.ID != tt.want {
+				t.Errorf("Authenticate() = %v, want key %q", got, tt.want)
+			}
+		})
+	}
+
+	err = s.Revoke(key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Authenticate(secret) != nil {
+		t.Error("revoked key still authenticates")
+	}
+	if err = s.Revoke(key.ID); err != ErrKeyNotFound {
+		t.Errorf("revoking twice: err = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestKeyMiddleware(t *testing.T) {
+	s, _ := NewKeyStore("", false)
+	secret, key, err := s.Create("ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		required      bool
+		authorization string
+		status        int
+		wantKey       string
+	}{
+		{name: "anonymous", status: 200},
+		{name: "anonymous when required", required: true, status: 401},
+		{name: "valid key", authorization: "Bearer " + secret, status: 200, wantKey: key.ID},
+		{name: "lowercase scheme", authorization: "bearer " + secret, status: 200, wantKey: key.ID},
+		{name: "invalid key", authorization: "Bearer gc_nope", status: 401},
+		{name: "basic auth is anonymous", authorization: "Basic eDp5", status: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.Required = tt.required
+
+			var gotKey string
+			h := s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if k := KeyFromContext(r.Context()); k != nil {
+					gotKey = k.ID
+				}
+			}))
+
+			r := httptest.NewRequest("POST", "/api/v1/tunnel", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if gotKey != tt.wantKey {
+				t.Errorf("key = %q, want %q", gotKey, tt.wantKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type contextKey struct{}
+
+// KeyFromContext returns the API key a request was authenticated with, nil
+// for anonymous requests.
+func KeyFromContext(ctx context.Context) *Key {
+	key, _ := ctx.Value(contextKey{}).(*Key)
+
+	return key
+}
+
+// Middleware checks the `Authorization: Bearer` API key of a request and
+// puts it into the request context.
+func (s *KeyStore) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := bearerToken(r)
+		if !ok {
+			if s.Required {
+				unauthorized(w)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := s.Authenticate(secret)
+		if key == nil {
+			unauthorized(w)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, key)))
+	})
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(h[7:]), true
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	w.WriteHeader(401)
+	w.Write([]byte("unauthorized"))
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-server/pkg/services/ratelimit"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"sync"
+)
+
+// maxVerified bounds the remembered basic auth logins of a tunnel.
+const maxVerified = 1024
+
+// maxPasswordLength is the most bcrypt hashes.
+const maxPasswordLength = 72
+
+// loginAttempts bounds the basic auth logins a visitor IP may have checked
+// with bcrypt, remembered logins don't count. It holds whether or not the
+// tunnel has a visitor rate limit.
+var loginAttempts = ratelimit.Limit{Rate: 1.0 / 6, Burst: 10}
+
+// VisitorCredentials are what a tunnel creator asks visitors for, basic
+// auth, a bearer token or both.
+type VisitorCredentials struct {
+	Basic  *BasicCredentials `json:"basic,omitempty"`
+	Bearer string            `json:"bearer,omitempty"`
+}
+
+type BasicCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (c VisitorCredentials) Validate() error {
+	if c.Basic == nil && c.Bearer == "" {
+		return errors.New("auth needs basic credentials or a bearer token")
+	}
+	if c.Basic != nil && (c.Basic.Username == "" || c.Basic.Password == "") {
+		return errors.New("basic auth needs a username and a password")
+	}
+	if c.Basic != nil && len(c.Basic.Password) > maxPasswordLength {
+		return fmt.Errorf("basic auth password must be at most %d bytes", maxPasswordLength)
+	}
+	if len(c.Bearer) > 0 && len(c.Bearer) < 16 {
+		return errors.New("bearer token must be at least 16 characters")
+	}
+
+	return nil
+}
+
+// Hash returns the credentials as they are stored, without the secrets.
+func (c VisitorCredentials) Hash() (*VisitorAuth, error) {
+	a := &VisitorAuth{}
+
+	if c.Basic != nil {
+		hash, err := bcrypt.GenerateFromPassword([]byte(c.Basic.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		a.Username = c.Basic.Username
+		a.PasswordHash = string(hash)
+	}
+
+	if c.Bearer != "" {
+		a.TokenHash = hash(c.Bearer)
+	}
+
+	return a, nil
+}
+
+// VisitorAuth are the stored visitor credentials of a tunnel, a bcrypt
+// hash of the password and the SHA-256 of the token.
+type VisitorAuth struct {
+	Username     string `json:"username,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	TokenHash    string `json:"token_hash,omitempty"`
+}
+
+// VisitorGuard checks visitors against the credentials of a tunnel. Basic
+// auth logins which passed bcrypt are remembered, so not every request of
+// a visitor pays for it, and the ones which did not are limited per
+// visitor IP.
+type VisitorGuard struct {
+	auth VisitorAuth
+
+	m        sync.Mutex
+	verified map[string]struct{}
+
+	attempts *ratelimit.Limiter
+}
+
+func NewVisitorGuard(a VisitorAuth) *VisitorGuard {
+	return &VisitorGuard{auth: a, verified: make(map[string]struct{}), attempts: ratelimit.NewLimiter()}
+}
+
+// Authorized reports whether r carries the credentials of the tunnel. The
+// result is not allowed when visitorIP ran out of login attempts, r was not
+// checked then.
+func (g *VisitorGuard) Authorized(r *http.Request, visitorIP string) (bool, ratelimit.Result) {
+	if token, ok := bearerToken(r); ok && g.auth.TokenHash != "" {
+		return equal(hash(token), g.auth.TokenHash), ratelimit.Result{Allowed: true}
+	}
+
+	if user, password, ok := r.BasicAuth(); ok && g.auth.PasswordHash != "" {
+		return g.verify(user, password, visitorIP)
+	}
+
+	return false, ratelimit.Result{Allowed: true}
+}
+
+func (g *VisitorGuard) verify(user, password, visitorIP string) (bool, ratelimit.Result) {
+	sum := sha256.Sum256([]byte(user + "\x00" + password))
+	login := hex.EncodeToString(sum[:])
+
+	g.m.Lock()
+	_, ok := g.verified[login]
+	g.m.Unlock()
+	if ok {
+		return true, ratelimit.Result{Allowed: true}
+	}
+
+	attempt := g.attempts.Allow(visitorIP, loginAttempts)
+	if !attempt.Allowed {
+		return false, attempt
+	}
+
+	// Both checks always run, so timing doesn't tell which failed.
+	userOk := equal(user, g.auth.Username)
+	passwordOk := bcrypt.CompareHashAndPassword([]byte(g.auth.PasswordHash), []byte(password)) == nil
+	if !userOk || !passwordOk {
+		return false, attempt
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+	if len(g.verified) >= maxVerified {
+		g.verified = make(map[string]struct{})
+	}
+	g.verified[login] = struct{}{}
+
+	return true, attempt
+}
+
+// Challenge answers r with 401 and a WWW-Authenticate challenge for each
+// scheme the tunnel accepts.
+func (g *VisitorGuard) Challenge(w http.ResponseWriter, r *http.Request, realm string) {
+	if g.auth.PasswordHash != "" {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, realm))
+	}
+	if g.auth.TokenHash != "" {
+		challenge := fmt.Sprintf(`Bearer realm=%q`, realm)
+		if _, ok := bearerToken(r); ok {
+			challenge += `, error="invalid_token"`
+		}
+		w.Header().Add("WWW-Authenticate", challenge)
+	}
+
+	w.WriteHeader(401)
+	w.Write([]byte("unauthorized"))
+}
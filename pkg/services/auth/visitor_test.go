@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testVisitorAuth hashes with the lowest bcrypt cost, so tests spending
+// login attempts stay fast.
+func testVisitorAuth(t *testing.T, user, password, token string) VisitorAuth {
+	t.Helper()
+
+	a := VisitorAuth{Username: user}
+	if password != "" {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.PasswordHash = string(h)
+	}
+	if token != "" {
+		a.TokenHash = hash(token)
+	}
+
+	return a
+}
+
+func TestVisitorCredentialsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		creds   VisitorCredentials
+		wantErr string
+	}{
+		{name: "nothing", creds: VisitorCredentials{}, wantErr: "needs basic credentials or a bearer token"},
+		{name: "basic", creds: VisitorCredentials{Basic: &BasicCredentials{Username: "u", Password: "p"}}},
+		{name: "basic without password", creds: VisitorCredentials{Basic: &BasicCredentials{Username: "u"}}, wantErr: "needs a username and a password"},
+		{name: "basic without username", creds: VisitorCredentials{Basic: &BasicCredentials{Password: "p"}}, wantErr: "needs a username and a password"},
+		{name: "longest password", creds: VisitorCredentials{Basic: &BasicCredentials{Username: "u", Password: strings.Repeat("p", 72)}}},
+		{name: "password over 72 bytes", creds: VisitorCredentials{Basic: &BasicCredentials{Username: "u", Password: strings.Repeat("p", 73)}}, wantErr: "at most 72 bytes"},
+		{name: "multibyte password over 72 bytes", creds: VisitorCredentials{Basic: &BasicCredentials{Username: "u", Password: strings.Repeat("é", 37)}}, wantErr: "at most 72 bytes"},
+		{name: "bearer", creds: VisitorCredentials{Bearer: "0123456789abcdef"}},
+		{name: "short bearer", creds: VisitorCredentials{Bearer: "0123456789"}, wantErr: "at least 16 characters"},
+		{name: "both", creds: VisitorCredentials{Basic: &BasicCredentials{Username: "u", Password: "p"}, Bearer: "0123456789abcdef"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.creds.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVisitorCredentialsHash(t *testing.T) {
+	c := VisitorCredentials{Basic: &BasicCredentials{Username: "u", Password: "secret"}, Bearer: "0123456789abcdef"}
+	a, err := c.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Username != "u" || strings.Contains(a.PasswordHash, "secret") || a.TokenHash == c.Bearer {
+		t.Errorf("secrets are stored in clear: %+v", a)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte("secret")) != nil {
+		t.Error("password hash doesn't match the password")
+	}
+}
+
+func TestVisitorGuardAuthorized(t *testing.T) {
+	const token = "0123456789abcdef"
+
+	tests := []struct {
+		name   string
+		auth   VisitorAuth
+		header string
+		user   string
+		pass   string
+		want   bool
+	}{
+		{name: "token", auth: testVisitorAuth(t, "", "", token), header: "Bearer " + token, want: true},
+		{name: "wrong token", auth: testVisitorAuth(t, "", "", token), header: "Bearer fedcba9876543210"},
+		{name: "basic", auth: testVisitorAuth(t, "u", "p", ""), user: "u", pass: "p", want: true},
+		{name: "wrong password", auth: testVisitorAuth(t, "u", "p", ""), user: "u", pass: "x"},
+		{name: "wrong user", auth: testVisitorAuth(t, "u", "p", ""), user: "x", pass: "p"},
+		{name: "basic on a token tunnel", auth: testVisitorAuth(t, "", "", token), user: "u", pass: token},
+		{name: "token on a basic tunnel", auth: testVisitorAuth(t, "u", "p", ""), header: "Bearer " + token},
+		{name: "either on both", auth: testVisitorAuth(t, "u", "p", token), user: "u", pass: "p", want: true},
+		{name: "anonymous", auth: testVisitorAuth(t, "u", "p", token)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewVisitorGuard(tt.auth)
+
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+
+			ok, res := g.Authorized(r, "192.0.2.1")
+			if ok != tt.want {
+				t.Errorf("Authorized() = %v, want %v", ok, tt.want)
+			}
+			if !res.Allowed {
+				t.Error("a single attempt was limited")
+			}
+		})
+	}
+}
+
+func TestVisitorGuardAttempts(t *testing.T) {
+	g := NewVisitorGuard(testVisitorAuth(t, "u", "p", ""))
+
+	login := func(ip, password string) (bool, bool) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth("u", password)
+		ok, res := g.Authorized(r, ip)
+		return ok, res.Allowed
+	}
+
+	// the first login is checked and costs an attempt, later ones are
+	// remembered
+	login("192.0.2.1", "p")
+
+	for i := 1; i < loginAttempts.Burst; i++ {
+		if ok, allowed := login("192.0.2.1", "wrong"); ok || !allowed {
+			t.Fatalf("attempt %d: ok %v, allowed %v", i+1, ok, allowed)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		ip          string
+		password    string
+		want        bool
+		wantAllowed bool
+	}{
+		{name: "attempts exhausted", ip: "192.0.2.1", password: "wrong", want: false, wantAllowed: false},
+		{name: "right password not checked", ip: "192.0.2.1", password: "right", want: false, wantAllowed: false},
+		{name: "remembered login", ip: "192.0.2.1", password: "p", want: true, wantAllowed: true},
+		{name: "other visitor", ip: "192.0.2.2", password: "wrong", want: false, wantAllowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, allowed := login(tt.ip, tt.password)
+			if ok != tt.want || allowed != tt.wantAllowed {
+				t.Errorf("ok %v, allowed %v, want %v, %v", ok, allowed, tt.want, tt.wantAllowed)
+			}
+		})
+	}
+}
+
+func TestVisitorGuardChallenge(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   VisitorAuth
+		header string
+		want   []string
+	}{
+		{name: "basic", auth: VisitorAuth{PasswordHash: "x"}, want: []string{`Basic realm="app", charset="UTF-8"`}},
+		{name: "bearer", auth: VisitorAuth{TokenHash: "x"}, want: []string{`Bearer realm="app"`}},
+		{name: "invalid token", auth: VisitorAuth{TokenHash: "x"}, header: "Bearer nope", want: []string{`Bearer realm="app", error="invalid_token"`}},
+		{name: "both", auth: VisitorAuth{PasswordHash: "x", TokenHash: "x"}, want: []string{`Basic realm="app", charset="UTF-8"`, `Bearer realm="app"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			NewVisitorGuard(tt.auth).Challenge(w, r, "app")
+
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d", w.Code)
+			}
+			got := w.Header().Values("WWW-Authenticate")
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("challenges = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
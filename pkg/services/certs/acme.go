@@ -0,0 +1,497 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"golang.org/x/crypto/acme"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+type AcmeConfig struct {
+	// DirectoryURL of the CA, e.g. Let's Encrypt or a local Pebble instance.
+	DirectoryURL string
+	Email        string
+	CacheDir     string
+
+	// Domains are hostnames validated with HTTP-01.
+	Domains []string
+
+	// WildcardDomain gets a certificate for itself and *.WildcardDomain,
+	// validated with DNS-01 through DNSHook.
+	WildcardDomain string
+	// DNSHook is executed as `hook present|cleanup <record name> <value>`
+	// and has to create or remove the TXT record.
+	DNSHook string
+
+	RenewBefore   time.Duration
+	CheckInterval time.Duration
+}
+
+// CertStatus is the renewal state of one managed certificate.
+type CertStatus struct {
+	Names       []string   `json:"names"`
+	Challenge   string     `json:"challenge"`
+	NotAfter    *time.Time `json:"not_after,omitempty"`
+	LastRenewal *time.Time `json:"last_renewal,omitempty"`
+	LastCheck   *time.Time `json:"last_check,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// AcmeManager obtains, caches on disk and renews certificates for the
+// HTTPS listener, putting them into a Store.
+type AcmeManager struct {
+	logger zerolog.Logger
+	conf   AcmeConfig
+	store  *Store
+	client *acme.Client
+
+	m        sync.Mutex
+	tokens   map[string]string
+	statuses map[string]*CertStatus
+
+	// wake starts a renewal check before CheckInterval passed.
+	wake chan struct{}
+}
+
+func NewAcmeManager(logger zerolog.Logger, conf AcmeConfig, store *Store) (*AcmeManager, error) {
+	err := os.MkdirAll(conf.CacheDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := loadOrCreateKey(filepath.Join(conf.CacheDir, "account.key"))
+	if err != nil {
+		return nil, fmt.Errorf("acme account key: %w", err)
+	}
+
+	m := &AcmeManager{
+		logger:   logger,
+		conf:     conf,
+		store:    store,
+		client:   &acme.Client{Key: key, DirectoryURL: conf.DirectoryURL},
+		tokens:   make(map[string]string),
+		statuses: make(map[string]*CertStatus),
+		wake:     make(chan struct{}, 1),
+	}
+
+	if conf.WildcardDomain != "" {
+		if conf.DNSHook == "" {
+			return nil, errors.New("acme: a DNS hook is required for the wildcard certificate")
+		}
+		m.statuses[conf.WildcardDomain] = &CertStatus{
+			Names:     []string{conf.WildcardDomain, "*." + conf.WildcardDomain},
+			Challenge: "dns-01",
+		}
+	}
+	for _, domain := range conf.Domains {
+		m.addDomain(domain)
+	}
+
+	return m, nil
+}
+
+func (m *AcmeManager) addDomain(domain string) bool {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if _, ok := m.statuses[domain]; ok {
+		return false
+	}
+
+	m.statuses[domain] = &CertStatus{Names: []string{domain}, Challenge: "http-01"}
+	return true
+}
+
+// AddDomain manages a certificate for domain from now on, validated with
+// HTTP-01. A cached certificate is used right away, otherwise one is
+// obtained without waiting for the next check.
+func (m *AcmeManager) AddDomain(domain string) {
+	if !m.addDomain(domain) {
+		return
+	}
+
+	m.loadCached(domain)
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// RemoveDomain stops renewing the certificate of a domain added with
+// AddDomain.
+func (m *AcmeManager) RemoveDomain(domain string) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	for _, d := range m.conf.Domains {
+		if d == domain {
+			return
+		}
+	}
+
+	delete(m.statuses, domain)
+}
+
+// Run loads cached certificates and keeps renewing them until ctx is done.
+func (m *AcmeManager) Run(ctx context.Context) {
+	for _, key := range m.keys() {
+		m.loadCached(key)
+	}
+
+	for {
+		m.renewAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.conf.CheckInterval):
+		case <-m.wake:
+		}
+	}
+}
+
+func (m *AcmeManager) keys() []string {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	keys := make([]string, 0, len(m.statuses))
+	for k := range m.statuses {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Statuses reports the renewal state of every managed certificate.
+func (m *AcmeManager) Statuses() []CertStatus {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	statuses := make([]CertStatus, 0, len(m.statuses))
+	for _, s := range m.statuses {
+		statuses = append(statuses, *s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Names[0] < statuses[j].Names[0]
+	})
+
+	return statuses
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes everything else to next.
+func (m *AcmeManager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		m.m.Lock()
+		keyAuth, ok := m.tokens[strings.TrimPrefix(r.URL.Path, acmeChallengePath)]
+		m.m.Unlock()
+
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+func (m *AcmeManager) renewAll(ctx context.Context) {
+	for _, key := range m.keys() {
+		m.m.Lock()
+		status := m.statuses[key]
+		names := status.Names
+		challenge := status.Challenge
+		due := status.NotAfter == nil || time.Until(*status.NotAfter) < m.conf.RenewBefore
+		now := time.Now()
+		status.LastCheck = &now
+		m.m.Unlock()
+
+		if !due {
+			continue
+		}
+
+		m.logger.Info().Strs("names", names).Msg("obtaining certificate")
+
+		cert, err := m.obtain(ctx, key, names, challenge)
+
+		m.m.Lock()
+		if err != nil {
+			status.LastError = err.Error()
+			m.logger.Error().Err(err).Strs("names", names).Msg("failed to obtain certificate")
+		} else {
+			now := time.Now()
+			status.LastError = ""
+			status.LastRenewal = &now
+			status.NotAfter = &cert.Leaf.NotAfter
+		}
+		m.m.Unlock()
+	}
+}
+
+func (m *AcmeManager) loadCached(key string) {
+	certFile, keyFile := m.cachePaths(key)
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			m.logger.Warn().Err(err).Str("domain", key).Msg("ignoring cached certificate")
+		}
+		return
+	}
+
+	err = m.store.Add(&cert)
+	if err != nil {
+		m.logger.Warn().Err(err).Str("domain", key).Msg("ignoring cached certificate")
+		return
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	if status, ok := m.statuses[key]; ok {
+		status.NotAfter = &cert.Leaf.NotAfter
+	}
+}
+
+func (m *AcmeManager) cachePaths(key string) (string, string) {
+	name := strings.ReplaceAll(key, "*", "_")
+
+	return filepath.Join(m.conf.CacheDir, name+".crt"), filepath.Join(m.conf.CacheDir, name+".key")
+}
+
+func (m *AcmeManager) register(ctx context.Context) error {
+	account := &acme.Account{}
+	if m.conf.Email != "" {
+		account.Contact = []string{"mailto:" + m.conf.Email}
+	}
+
+	_, err := m.client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+
+	return nil
+}
+
+func (m *AcmeManager) obtain(ctx context.Context, key string, names []string, challenge string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+
+	err := m.register(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("register account: %w", err)
+	}
+
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, fmt.Errorf("create order: %w", err)
+	}
+
+	for _, url := range order.AuthzURLs {
+		err = m.authorize(ctx, url, challenge)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, fmt.Errorf("wait order: %w", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, certKey)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		// Some CAs, Pebble among them, answer the finalize request without
+		// a Location header, poll the order we already know instead.
+		valid, waitErr := m.client.WaitOrder(ctx, order.URI)
+		if waitErr != nil || valid.CertURL == "" {
+			return nil, fmt.Errorf("finalize order: %w", err)
+		}
+
+		chain, err = m.client.FetchCert(ctx, valid.CertURL, true)
+		if err != nil {
+			return nil, fmt.Errorf("fetch certificate: %w", err)
+		}
+	}
+
+	cert, err := m.saveCert(key, chain, certKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, m.store.Add(cert)
+}
+
+func (m *AcmeManager) authorize(ctx context.Context, url, challengeType string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("get authorization: %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == challengeType {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("%s challenge is not offered for %s", challengeType, authz.Identifier.Value)
+	}
+
+	switch challengeType {
+	case "http-01":
+		keyAuth, err := m.client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+
+		m.m.Lock()
+		m.tokens[chal.Token] = keyAuth
+		m.m.Unlock()
+
+		defer func() {
+			m.m.Lock()
+			delete(m.tokens, chal.Token)
+			m.m.Unlock()
+		}()
+	case "dns-01":
+		value, err := m.client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+
+		record := "_acme-challenge." + strings.TrimPrefix(authz.Identifier.Value, "*.")
+		err = m.runDNSHook(ctx, "present", record, value)
+		if err != nil {
+			return fmt.Errorf("dns hook: %w", err)
+		}
+
+		defer func() {
+			err := m.runDNSHook(context.Background(), "cleanup", record, value)
+			if err != nil {
+				m.logger.Warn().Err(err).Str("record", record).Msg("dns hook cleanup failed")
+			}
+		}()
+	}
+
+	_, err = m.client.Accept(ctx, chal)
+	if err != nil {
+		return fmt.Errorf("accept challenge: %w", err)
+	}
+
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	if err != nil {
+		return fmt.Errorf("authorize %s: %w", authz.Identifier.Value, err)
+	}
+
+	return nil
+}
+
+func (m *AcmeManager) runDNSHook(ctx context.Context, action, record, value string) error {
+	out, err := exec.CommandContext(ctx, m.conf.DNSHook, action, record, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+func (m *AcmeManager) saveCert(key string, chain [][]byte, certKey *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	certFile, keyFile := m.cachePaths(key)
+	err = os.WriteFile(keyFile, keyPEM, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(certFile, certPEM, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data", path)
+		}
+
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
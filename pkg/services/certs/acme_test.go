@@ -0,0 +1,157 @@
+package certs
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T, conf AcmeConfig) *AcmeManager {
+	t.Helper()
+
+	conf.CacheDir = filepath.Join(t.TempDir(), "acme")
+	m, err := NewAcmeManager(zerolog.Nop(), conf, NewStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestAcmeHTTPHandler(t *testing.T) {
+	m := newTestManager(t, AcmeConfig{})
+	m.tokens["known"] = "known.thumbprint"
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		want   string
+	}{
+		{name: "known token", path: acmeChallengePath + "known", status: 200, want: "known.thumbprint"},
+		{name: "unknown token", path: acmeChallengePath + "unknown", status: http.StatusTeapot},
+		{name: "other path", path: "/known", status: http.StatusTeapot},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			m.HTTPHandler(next).ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if w.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestAcmeDomains(t *testing.T) {
+	m := newTestManager(t, AcmeConfig{Domains: []string{"static.test"}})
+
+	tests := []struct {
+		name   string
+		add    string
+		remove string
+		want   []string
+	}{
+		{name: "configured", want: []string{"static.test"}},
+		{name: "add", add: "custom.test", want: []string{"custom.test", "static.test"}},
+		{name: "add twice", add: "custom.test", want: []string{"custom.test", "static.test"}},
+		{name: "remove added", remove: "custom.test", want: []string{"static.test"}},
+		{name: "configured is kept", remove: "static.test", want: []string{"static.test"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.add != "" {
+				m.AddDomain(tt.add)
+			}
+			if tt.remove != "" {
+				m.RemoveDomain(tt.remove)
+			}
+
+			got := m.keys()
+			if len(got) != len(tt.want) {
+				t.Fatalf("domains = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("domains = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// TestAcmePebble obtains certificates from a local Pebble instance. It runs
+// only when PEBBLE_DIRECTORY is set, e.g.
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+//	SSL_CERT_FILE=test/certs/pebble.minica.pem \
+//	PEBBLE_DIRECTORY=https://localhost:14000/dir go test ./pkg/services/certs/
+func TestAcmePebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY is not set")
+	}
+
+	hook := filepath.Join(t.TempDir(), "hook.sh")
+	err := os.WriteFile(hook, []byte("#!/bin/sh\nexit 0\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		conf       AcmeConfig
+		serverName string
+	}{
+		{name: "http-01", conf: AcmeConfig{Domains: []string{"tunnel.test"}}, serverName: "tunnel.test"},
+		{name: "dns-01 wildcard", conf: AcmeConfig{WildcardDomain: "wild.test", DNSHook: hook}, serverName: "any.wild.test"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.DirectoryURL = directory
+			tt.conf.RenewBefore = time.Hour
+			m := newTestManager(t, tt.conf)
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			m.renewAll(ctx)
+
+			for _, s := range m.Statuses() {
+				if s.LastError != "" || s.NotAfter == nil {
+					t.Fatalf("%v: not_after %v, error %q", s.Names, s.NotAfter, s.LastError)
+				}
+			}
+			if m.store.Lookup(tt.serverName) == nil {
+				t.Fatalf("no certificate for %s", tt.serverName)
+			}
+
+			// a second manager on the same cache starts with the certificate
+			cached, err := NewAcmeManager(zerolog.Nop(), m.conf, NewStore())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range cached.keys() {
+				cached.loadCached(key)
+			}
+			if cached.store.Lookup(tt.serverName) == nil {
+				t.Errorf("cached certificate for %s was not loaded", tt.serverName)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Store keeps the certificates served by the HTTPS listener and picks one
+// by the SNI name a visitor asks for.
+type Store struct {
+	m        sync.RWMutex
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+}
+
+func NewStore() *Store {
+	return &Store{byName: make(map[string]*tls.Certificate)}
+}
+
+// LoadStore reads PEM encoded certificate and key pairs, certFiles[i] goes
+// with keyFiles[i].
+func LoadStore(certFiles, keyFiles []string) (*Store, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("got %d certificates but %d keys", len(certFiles), len(keyFiles))
+	}
+
+	s := NewStore()
+	for i := range certFiles {
+		cert, err := tls.LoadX509KeyPair(certFiles[i], keyFiles[i])
+		if err != nil {
+			return nil, fmt.Errorf("load certificate %s: %w", certFiles[i], err)
+		}
+
+		err = s.Add(&cert)
+		if err != nil {
+			return nil, fmt.Errorf("add certificate %s: %w", certFiles[i], err)
+		}
+	}
+
+	return s, nil
+}
+
+// Add indexes a certificate by every name it is valid for, wildcard names
+// like *.example.com included. The first certificate added is served to
+// visitors which send no or an unknown SNI name.
+func (s *Store) Add(cert *tls.Certificate) error {
+	if cert.Leaf == nil {
+		if len(cert.Certificate) == 0 {
+			return errors.New("empty certificate chain")
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		cert.Leaf = leaf
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	names := certNames(cert.Leaf)
+	for _, name := range names {
+		s.byName[strings.ToLower(name)] = cert
+	}
+
+	// A renewed certificate replaces the fallback it was issued for.
+	if s.fallback == nil || sameNames(certNames(s.fallback.Leaf), names) {
+		s.fallback = cert
+	}
+
+	return nil
+}
+
+// Lookup returns the certificate for a server name, preferring an exact
+// match over a wildcard one. It returns nil if no certificate matches.
+func (s *Store) Lookup(serverName string) *tls.Certificate {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert, ok := s.byName[name]; ok {
+		return cert
+	}
+
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+
+	return nil
+}
+
+// Empty reports whether the store has no certificates at all.
+func (s *Store) Empty() bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.fallback == nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.Lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if s.fallback == nil {
+		return nil, errors.New("no certificates configured")
+	}
+
+	return s.fallback, nil
+}
+
+func certNames(leaf *x509.Certificate) []string {
+	if len(leaf.DNSNames) == 0 && leaf.Subject.CommonName != "" {
+		return []string{leaf.Subject.CommonName}
+	}
+
+	return leaf.DNSNames
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
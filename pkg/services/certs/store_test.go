@@ -0,0 +1,147 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// selfSigned issues a certificate for names, valid for a day.
+func selfSigned(t *testing.T, names ...string) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestStoreLookup(t *testing.T) {
+	s := NewStore()
+	wildcard := selfSigned(t, "localhost", "*.localhost")
+	exact := selfSigned(t, "api.localhost")
+	for _, cert := range []*tls.Certificate{wildcard, exact} {
+		if err := s.Add(cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		serverName string
+		want       *tls.Certificate
+	}{
+		{serverName: "localhost", want: wildcard},
+		{serverName: "tunnel.localhost", want: wildcard},
+		{serverName: "TUNNEL.localhost.", want: wildcard},
+		{serverName: "api.localhost", want: exact},
+		{serverName: "a.b.localhost", want: nil},
+		{serverName: "example.com", want: nil},
+		{serverName: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			if got := s.Lookup(tt.serverName); got != tt.want {
+				t.Errorf("Lookup(%q) picked the wrong certificate", tt.serverName)
+			}
+		})
+	}
+}
+
+func TestStoreFallback(t *testing.T) {
+	s := NewStore()
+	if _, err := s.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Error("empty store returned a certificate")
+	}
+
+	first := selfSigned(t, "localhost", "*.localhost")
+	other := selfSigned(t, "example.com")
+	renewed := selfSigned(t, "localhost", "*.localhost")
+
+	tests := []struct {
+		name string
+		add  *tls.Certificate
+		want *tls.Certificate
+	}{
+		{name: "first certificate", add: first, want: first},
+		{name: "other names keep the fallback", add: other, want: first},
+		{name: "renewal replaces the fallback", add: renewed, want: renewed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Add(tt.add); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.test"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Error("GetCertificate() picked the wrong fallback")
+			}
+		})
+	}
+}
+
+func TestLoadStore(t *testing.T) {
+	dir := t.TempDir()
+	cert := selfSigned(t, "localhost")
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	tests := []struct {
+		name    string
+		certs   []string
+		keys    []string
+		wantErr bool
+	}{
+		{name: "pair", certs: []string{certFile}, keys: []string{keyFile}},
+		{name: "missing key", certs: []string{certFile}, keys: nil, wantErr: true},
+		{name: "swapped files", certs: []string{keyFile}, keys: []string{certFile}, wantErr: true},
+		{name: "missing file", certs: []string{filepath.Join(dir, "nope.pem")}, keys: []string{keyFile}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := LoadStore(tt.certs, tt.keys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil && s.Lookup("localhost") == nil {
+				t.Error("loaded certificate is not served for localhost")
+			}
+		})
+	}
+}
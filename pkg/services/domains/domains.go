@@ -0,0 +1,330 @@
+package domains
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-server/pkg/services/registry"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChallengePrefix is prepended to a domain for the name of its TXT record.
+const ChallengePrefix = "_greencobra-challenge."
+
+var (
+	ErrNotFound    = errors.New("domain not found")
+	ErrTaken       = errors.New("domain is mapped to another tunnel")
+	ErrNotVerified = errors.New("verification TXT record not found")
+	ErrLookup      = errors.New("failed to look up TXT record")
+	ErrNoOwner     = errors.New("custom domains need a tunnel created with an API key")
+)
+
+// Resolver looks up TXT records, net.Resolver is one.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// NewResolver returns the system resolver, or one asking the DNS server at
+// addr when given.
+func NewResolver(addr string) Resolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// Registry maps custom hostnames to tunnels. Domains only route visitors
+// once a TXT record proved the tunnel owner controls them.
+type Registry struct {
+	store    registry.Store
+	resolver Resolver
+
+	m       sync.RWMutex
+	domains map[string]registry.DomainRecord
+
+	onVerified func(host string)
+	onRemoved  func(host string)
+}
+
+func NewRegistry(store registry.Store, resolver Resolver) (*Registry, error) {
+	records, err := store.ListDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Registry{store: store, resolver: resolver, domains: make(map[string]registry.DomainRecord)}
+	for _, d := range records {
+		r.domains[d.Host] = d
+	}
+
+	return r, nil
+}
+
+// Notify calls verified for every verified domain, now and whenever one
+// gets verified, and removed when a verified domain is removed.
+func (r *Registry) Notify(verified, removed func(host string)) {
+	r.m.Lock()
+	r.onVerified, r.onRemoved = verified, removed
+	hosts := r.verifiedHosts()
+	r.m.Unlock()
+
+	for _, host := range hosts {
+		verified(host)
+	}
+}
+
+func (r *Registry) verifiedHosts() []string {
+	hosts := make([]string, 0, len(r.domains))
+	for host, d := range r.domains {
+		if d.VerifiedAt != nil {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
+
+// Lookup finds the tunnel a verified domain is mapped to. host may carry a
+// port, like a Host header. Domains without an owner are never routed.
+func (r *Registry) Lookup(host string) (tunnelID, owner string, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	d, ok := r.domains[host]
+	if !ok || d.VerifiedAt == nil || d.Owner == "" {
+		return "", "", false
+	}
+
+	return d.TunnelID, d.Owner, true
+}
+
+func (r *Registry) Get(host string) (registry.DomainRecord, bool) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	d, ok := r.domains[host]
+	return d, ok
+}
+
+// List returns the domains of a tunnel, sorted by host.
+func (r *Registry) List(tunnelID string) []registry.DomainRecord {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	list := make([]registry.DomainRecord, 0)
+	for _, d := range r.domains {
+		if d.TunnelID == tunnelID {
+			list = append(list, d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+
+	return list
+}
+
+// ListOwned returns the domains added with an API key, whether or not their
+// tunnels are running, sorted by host.
+func (r *Registry) ListOwned(owner string) []registry.DomainRecord {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	list := make([]registry.DomainRecord, 0)
+	for _, d := range r.domains {
+		if owner != "" && d.Owner == owner {
+			list = append(list, d)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+
+	return list
+}
+
+// Add maps host to a tunnel, pending verification. Adding a domain again
+// for the same tunnel and owner returns the existing mapping. Unverified
+// mappings can be claimed by anyone, so nobody can hold on to a domain
+// they don't control. The owner is the API key managing the domain, it
+// outlives the tunnel, so anonymous tunnels can't have domains.
+func (r *Registry) Add(host, tunnelID, owner string) (registry.DomainRecord, error) {
+	if owner == "" {
+		return registry.DomainRecord{}, ErrNoOwner
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if d, ok := r.domains[host]; ok {
+		if d.TunnelID == tunnelID && d.Owner == owner {
+			return d, nil
+		}
+		if d.VerifiedAt != nil {
+			return registry.DomainRecord{}, ErrTaken
+		}
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return registry.DomainRecord{}, err
+	}
+
+	d := registry.DomainRecord{
+		Host:      host,
+		TunnelID:  tunnelID,
+		Owner:     owner,
+		Token:     token,
+		CreatedAt: time.Now(),
+	}
+
+	err = r.store.SaveDomain(d)
+	if err != nil {
+		return registry.DomainRecord{}, err
+	}
+	r.domains[host] = d
+
+	return d, nil
+}
+
+// Verify looks for the token of a domain in its TXT record and marks the
+// domain verified when it's there.
+func (r *Registry) Verify(ctx context.Context, host string) (registry.DomainRecord, error) {
+	d, ok := r.Get(host)
+	if !ok {
+		return d, ErrNotFound
+	}
+	if d.VerifiedAt != nil {
+		return d, nil
+	}
+
+	records, err := r.resolver.LookupTXT(ctx, ChallengePrefix+host)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return d, ErrNotVerified
+	}
+	if err != nil {
+		return d, fmt.Errorf("%w: %v", ErrLookup, err)
+	}
+
+	found := false
+	for _, txt := range records {
+		if strings.TrimSpace(txt) == d.Token {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return d, ErrNotVerified
+	}
+
+	r.m.Lock()
+	current, ok := r.domains[host]
+	if !ok || current.Token != d.Token {
+		// removed or claimed again while we were looking
+		r.m.Unlock()
+		return d, ErrNotFound
+	}
+
+	now := time.Now()
+	d.VerifiedAt = &now
+	err = r.store.SaveDomain(d)
+	if err != nil {
+		r.m.Unlock()
+		return current, err
+	}
+	r.domains[host] = d
+	onVerified := r.onVerified
+	r.m.Unlock()
+
+	if onVerified != nil {
+		onVerified(host)
+	}
+
+	return d, nil
+}
+
+func (r *Registry) Remove(host string) error {
+	r.m.Lock()
+	d, ok := r.domains[host]
+	if !ok {
+		r.m.Unlock()
+		return ErrNotFound
+	}
+
+	err := r.store.DeleteDomain(host)
+	if err != nil {
+		r.m.Unlock()
+		return err
+	}
+	delete(r.domains, host)
+	onRemoved := r.onRemoved
+	r.m.Unlock()
+
+	if d.VerifiedAt != nil && onRemoved != nil {
+		onRemoved(host)
+	}
+
+	return nil
+}
+
+// Normalize checks that host is a fully qualified domain name and returns
+// it lowercased, without a trailing dot.
+func Normalize(host string) (string, error) {
+	host = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+
+	if len(host) == 0 || len(host) > 253 || net.ParseIP(host) != nil {
+		return "", fmt.Errorf("invalid domain: %q", host)
+	}
+
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return "", fmt.Errorf("domain must have at least two labels: %q", host)
+	}
+
+	for _, label := range labels {
+		if !validLabel(label) {
+			return "", fmt.Errorf("invalid domain: %q", host)
+		}
+	}
+
+	return host, nil
+}
+
+func validLabel(label string) bool {
+	if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
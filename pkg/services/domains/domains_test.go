@@ -0,0 +1,388 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-server/pkg/services/registry"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeResolver answers TXT lookups with lookup.
+type fakeResolver struct {
+	lookup func(name string) ([]string, error)
+}
+
+func (f *fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	return f.lookup(name)
+}
+
+func newTestRegistry(t *testing.T) (*Registry, *fakeResolver) {
+	t.Helper()
+
+	resolver := &fakeResolver{}
+	r, err := NewRegistry(registry.NopStore{}, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r, resolver
+}
+
+func hosts(list []registry.DomainRecord) []string {
+	names := make([]string, 0, len(list))
+	for _, d := range list {
+		names = append(names, d.Host)
+	}
+
+	return names
+}
+
+func TestVerify(t *testing.T) {
+	notFound := &net.DNSError{Err: "no such host", Name: "x", IsNotFound: true}
+
+	tests := []struct {
+		name string
+		// lookup answers for the domain with its token, r is the registry
+		// being verified against
+		lookup       func(r *Registry, name, token string) ([]string, error)
+		wantErr      error
+		wantVerified bool
+	}{
+		{
+			name: "token found",
+			lookup: func(_ *Registry, _, token string) ([]string, error) {
+				return []string{"v=spf1 -all", " " + token + " "}, nil
+			},
+			wantVerified: true,
+		},
+		{
+			name:    "other records only",
+			lookup:  func(_ *Registry, _, _ string) ([]string, error) { return []string{"v=spf1 -all"}, nil },
+			wantErr: ErrNotVerified,
+		},
+		{
+			name:    "no record",
+			lookup:  func(_ *Registry, _, _ string) ([]string, error) { return nil, notFound },
+			wantErr: ErrNotVerified,
+		},
+		{
+			name:    "wrapped not found",
+			lookup:  func(_ *Registry, _, _ string) ([]string, error) { return nil, fmt.Errorf("lookup: %w", notFound) },
+			wantErr: ErrNotVerified,
+		},
+		{
+			name: "lookup failed",
+			lookup: func(_ *Registry, _, _ string) ([]string, error) {
+				return nil, &net.DNSError{Err: "server misbehaving", IsTemporary: true}
+			},
+			wantErr: ErrLookup,
+		},
+		{
+			name:    "resolver error",
+			lookup:  func(_ *Registry, _, _ string) ([]string, error) { return nil, context.DeadlineExceeded },
+			wantErr: ErrLookup,
+		},
+		{
+			name: "claimed again while looking",
+			lookup: func(r *Registry, _, token string) ([]string, error) {
+				if _, err := r.Add("app.example.com", "other", "key-2"); err != nil {
+					return nil, err
+				}
+				return []string{token}, nil
+			},
+			wantErr: ErrNotFound,
+		},
+		{
+			name: "removed while looking",
+			lookup: func(r *Registry, _, token string) ([]string, error) {
+				if err := r.Remove("app.example.com"); err != nil {
+					return nil, err
+				}
+				return []string{token}, nil
+			},
+			wantErr: ErrNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, resolver := newTestRegistry(t)
+			d, err := r.Add("app.example.com", "app", "key-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var looked string
+			resolver.lookup = func(name string) ([]string, error) {
+				looked = name
+				return tt.lookup(r, name, d.Token)
+			}
+
+			var notified []string
+			r.Notify(func(host string) { notified = append(notified, host) }, func(string) {})
+
+			_, err = r.Verify(context.Background(), "app.example.com")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if looked != "_greencobra-challenge.app.example.com" {
+				t.Errorf("looked up %q", looked)
+			}
+
+			_, _, routed := r.Lookup("app.example.com")
+			if routed != tt.wantVerified {
+				t.Errorf("routed = %v, want %v", routed, tt.wantVerified)
+			}
+			if tt.wantVerified != (len(notified) == 1) {
+				t.Errorf("notified %v", notified)
+			}
+		})
+	}
+}
+
+func TestVerifyOnce(t *testing.T) {
+	r, resolver := newTestRegistry(t)
+
+	_, err := r.Verify(context.Background(), "app.example.com")
+	if err != ErrNotFound {
+		t.Errorf("unknown domain: err = %v, want %v", err, ErrNotFound)
+	}
+
+	d, _ := r.Add("app.example.com", "app", "key-1")
+	lookups := 0
+	resolver.lookup = func(string) ([]string, error) {
+		lookups++
+		return []string{d.Token}, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = r.Verify(context.Background(), "app.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("looked up %d times, a verified domain needs no lookup", lookups)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	r, resolver := newTestRegistry(t)
+
+	verified, _ := r.Add("verified.example.com", "app", "key-1")
+	resolver.lookup = func(string) ([]string, error) { return []string{verified.Token}, nil }
+	_, err := r.Verify(context.Background(), "verified.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := r.Add("pending.example.com", "app", "key-1")
+
+	tests := []struct {
+		name      string
+		host      string
+		tunnelID  string
+		owner     string
+		wantErr   error
+		wantToken string
+	}{
+		{name: "no owner", host: "new.example.com", tunnelID: "app", wantErr: ErrNoOwner},
+		{name: "added again", host: "pending.example.com", tunnelID: "app", owner: "key-1", wantToken: pending.Token},
+		{name: "verified again", host: "verified.example.com", tunnelID: "app", owner: "key-1", wantToken: verified.Token},
+		{name: "verified for another tunnel", host: "verified.example.com", tunnelID: "other", owner: "key-1", wantErr: ErrTaken},
+		{name: "verified for another owner", host: "verified.example.com", tunnelID: "app", owner: "key-2", wantErr: ErrTaken},
+		{name: "pending claimed", host: "pending.example.com", tunnelID: "other", owner: "key-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := r.Add(tt.host, tt.tunnelID, tt.owner)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if tt.wantToken != "" && d.Token != tt.wantToken {
+				t.Errorf("token = %q, want the existing %q", d.Token, tt.wantToken)
+			}
+			if tt.wantToken == "" && (d.Token == pending.Token || d.Token == verified.Token) {
+				t.Error("a new claim reused a token")
+			}
+			if got, _ := r.Get(tt.host); got.TunnelID != tt.tunnelID || got.Owner != tt.owner {
+				t.Errorf("mapped to %s of %s", got.TunnelID, got.Owner)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	r, resolver := newTestRegistry(t)
+	d, _ := r.Add("app.example.com", "app", "key-1")
+	r.Add("pending.example.com", "app", "key-1")
+	resolver.lookup = func(string) ([]string, error) { return []string{d.Token}, nil }
+	r.Verify(context.Background(), "app.example.com")
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "app.example.com", want: true},
+		{host: "app.example.com:8443", want: true},
+		{host: "APP.Example.com.", want: true},
+		{host: "pending.example.com", want: false},
+		{host: "other.example.com", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			tunnelID, owner, ok := r.Lookup(tt.host)
+			if ok != tt.want {
+				t.Fatalf("ok = %v, want %v", ok, tt.want)
+			}
+			if ok && (tunnelID != "app" || owner != "key-1") {
+				t.Errorf("Lookup() = %s, %s", tunnelID, owner)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	r, _ := newTestRegistry(t)
+	r.Add("b.example.com", "app", "key-1")
+	r.Add("a.example.com", "app", "key-1")
+	r.Add("c.example.com", "other", "key-1")
+	r.Add("d.example.com", "app", "key-2")
+
+	tests := []struct {
+		name string
+		got  []registry.DomainRecord
+		want []string
+	}{
+		{name: "tunnel", got: r.List("app"), want: []string{"a.example.com", "b.example.com", "d.example.com"}},
+		{name: "unknown tunnel", got: r.List("nope"), want: []string{}},
+		{name: "owner", got: r.ListOwned("key-1"), want: []string{"a.example.com", "b.example.com", "c.example.com"}},
+		{name: "other owner", got: r.ListOwned("key-2"), want: []string{"d.example.com"}},
+		{name: "no owner", got: r.ListOwned(""), want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hosts(tt.got); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	r, resolver := newTestRegistry(t)
+	d, _ := r.Add("app.example.com", "app", "key-1")
+	r.Add("pending.example.com", "app", "key-1")
+	resolver.lookup = func(string) ([]string, error) { return []string{d.Token}, nil }
+	r.Verify(context.Background(), "app.example.com")
+
+	var removed []string
+	r.Notify(func(string) {}, func(host string) { removed = append(removed, host) })
+
+	tests := []struct {
+		host    string
+		wantErr error
+	}{
+		{host: "app.example.com"},
+		{host: "pending.example.com"},
+		{host: "app.example.com", wantErr: ErrNotFound},
+	}
+
+	for _, tt := range tests {
+		if err := r.Remove(tt.host); err != tt.wantErr {
+			t.Errorf("Remove(%s) = %v, want %v", tt.host, err, tt.wantErr)
+		}
+	}
+
+	// only verified domains were ever routed
+	if !reflect.DeepEqual(removed, []string{"app.example.com"}) {
+		t.Errorf("removed = %v", removed)
+	}
+}
+
+func TestRegistryRestore(t *testing.T) {
+	store, err := registry.NewBoltStore(filepath.Join(t.TempDir(), "tunnels.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	resolver := &fakeResolver{}
+	r, _ := NewRegistry(store, resolver)
+	d, _ := r.Add("app.example.com", "app", "key-1")
+	r.Add("pending.example.com", "app", "key-1")
+	resolver.lookup = func(string) ([]string, error) { return []string{d.Token}, nil }
+	r.Verify(context.Background(), "app.example.com")
+
+	r, err = NewRegistry(store, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var verified []string
+	r.Notify(func(host string) { verified = append(verified, host) }, func(string) {})
+	if !reflect.DeepEqual(verified, []string{"app.example.com"}) {
+		t.Errorf("verified after restart = %v", verified)
+	}
+	if _, ok := r.Get("pending.example.com"); !ok {
+		t.Error("pending domain was lost")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		host    string
+		want    string
+		wantErr string
+	}{
+		{host: "app.example.com", want: "app.example.com"},
+		{host: " App.Example.COM. ", want: "app.example.com"},
+		{host: "xn--bcher-kva.example", want: "xn--bcher-kva.example"},
+		{host: "a-b.c1.io", want: "a-b.c1.io"},
+		{host: "", wantErr: "invalid domain"},
+		{host: ".", wantErr: "invalid domain"},
+		{host: "localhost", wantErr: "at least two labels"},
+		{host: "192.0.2.1", wantErr: "invalid domain"},
+		{host: "::1", wantErr: "invalid domain"},
+		{host: "app..example.com", wantErr: "invalid domain"},
+		{host: ".example.com", wantErr: "invalid domain"},
+		{host: "-app.example.com", wantErr: "invalid domain"},
+		{host: "app-.example.com", wantErr: "invalid domain"},
+		{host: "app_1.example.com", wantErr: "invalid domain"},
+		{host: "*.example.com", wantErr: "invalid domain"},
+		{host: "app.example.com:443", wantErr: "invalid domain"},
+		{host: "bücher.example", wantErr: "invalid domain"},
+		{host: strings.Repeat("a", 63) + ".com", want: strings.Repeat("a", 63) + ".com"},
+		{host: strings.Repeat("a", 64) + ".com", wantErr: "invalid domain"},
+		{host: strings.Repeat("a.", 126) + "io", wantErr: "invalid domain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			got, err := Normalize(tt.host)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Normalize() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,48 +1,104 @@
 package forward_connection
 
 import (
+	"bufio"
+	"go-server/pkg/services/metrics"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 	time "time"
 )
 
 type ForwardConnection interface {
+	io.ReadWriter
+
 	Acquire()
 	Release()
 	Close() error
-	Write(data []byte) error
-	Read() (error, []byte)
 	Alive() bool
 	InUse() bool
+
+	// Reader is the buffered reader responses are parsed from. It lives as
+	// long as the connection, so bytes buffered past the end of one response
+	// are not lost for the next one.
+	Reader() *bufio.Reader
+
+	// SetIdleTimeout changes how long the connection may stay silent,
+	// zero disables the deadline for long-lived upgraded sessions.
+	SetIdleTimeout(d time.Duration)
+}
+
+// Shaper paces the traffic of forward connections. Upload is called before
+// visitor bytes are written to the client, Download after bytes were read
+// from the client.
+type Shaper interface {
+	Upload(n int)
+	Download(n int)
 }
 
 type tcpForwardConnection struct {
-	conn  net.Conn
+	conn net.Conn
+	br   *bufio.Reader
+
+	m     sync.Mutex
 	inUse bool
 	alive bool
+
+	// idleTimeout bounds how long the connection may stay silent while a
+	// visitor request is being proxied. It is refreshed on every read and
+	// write, so slow but active backends are never cut off.
+	idleTimeout time.Duration
+
+	traffic *byteCounters
+	shaper  Shaper
+}
+
+// byteCounters sums up the traffic of all connections of a pool.
+type byteCounters struct {
+	sent     uint64
+	received uint64
+}
+
+func newTcpForwardConnection(conn net.Conn, idleTimeout time.Duration, traffic *byteCounters, shaper Shaper) *tcpForwardConnection {
+	c := &tcpForwardConnection{conn: conn, inUse: false, alive: true, idleTimeout: idleTimeout, traffic: traffic, shaper: shaper}
+	c.br = bufio.NewReader(connReader{c})
+
+	return c
 }
 
 func (c *tcpForwardConnection) Alive() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
 	return c.alive
 }
 
 func (c *tcpForwardConnection) InUse() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
 	return c.inUse
 }
 
 func (c *tcpForwardConnection) Acquire() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
 	c.inUse = true
 }
 
 func (c *tcpForwardConnection) Release() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
 	c.inUse = false
 }
 
 func (c *tcpForwardConnection) Close() error {
-	if !c.alive {
+	if !c.markClosed() {
 		return nil
 	}
-	c.markClosed()
 
 	err := c.conn.SetDeadline(time.Now())
 	if err != nil {
@@ -52,35 +108,69 @@ func (c *tcpForwardConnection) Close() error {
 	return nil
 }
 
+func (c *tcpForwardConnection) Reader() *bufio.Reader {
+	return c.br
+}
+
+func (c *tcpForwardConnection) SetIdleTimeout(d time.Duration) {
+	c.idleTimeout = d
+	c.updateDeadlines()
+}
+
 func (c *tcpForwardConnection) updateDeadlines() {
-	delay := 100 * time.Millisecond
+	if c.idleTimeout == 0 {
+		c.conn.SetDeadline(time.Time{})
+		return
+	}
 
-	c.conn.SetReadDeadline(time.Now().Add(delay))
-	c.conn.SetWriteDeadline(time.Now().Add(delay))
+	c.conn.SetDeadline(time.Now().Add(c.idleTimeout))
 }
 
-func (c *tcpForwardConnection) Write(data []byte) error {
+func (c *tcpForwardConnection) Write(data []byte) (int, error) {
+	// wait before refreshing the deadline, throttling is not idleness
+	if c.shaper != nil {
+		c.shaper.Upload(len(data))
+	}
 	c.updateDeadlines()
 
-	_, err := c.conn.Write(data)
-	if err != nil {
-		return err
-	}
+	n, err := c.conn.Write(data)
+	metrics.SentBytes.Add(float64(n))
+	atomic.AddUint64(&c.traffic.sent, uint64(n))
 
-	return nil
+	return n, err
 }
 
-func (c *tcpForwardConnection) markClosed() {
+// markClosed flips the connection to closed and reports whether it was
+// alive before, so the socket is only closed once.
+func (c *tcpForwardConnection) markClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	wasAlive := c.alive
 	c.alive = false
+
+	return wasAlive
 }
 
-func (c *tcpForwardConnection) Read() (error, []byte) {
-	c.updateDeadlines()
+func (c *tcpForwardConnection) Read(data []byte) (int, error) {
+	return c.br.Read(data)
+}
 
-	data, err := io.ReadAll(c.conn)
-	if err != nil {
-		return err, data
+// connReader reads straight from the socket, refreshing the deadline first.
+type connReader struct {
+	c *tcpForwardConnection
+}
+
+func (r connReader) Read(data []byte) (int, error) {
+	r.c.updateDeadlines()
+
+	n, err := r.c.conn.Read(data)
+	metrics.ReceivedBytes.Add(float64(n))
+	atomic.AddUint64(&r.c.traffic.received, uint64(n))
+
+	if r.c.shaper != nil {
+		r.c.shaper.Download(n)
 	}
 
-	return nil, data
+	return n, err
 }
@@ -1,25 +1,42 @@
 package forward_connection
 
 import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var tracer = otel.Tracer("go-server/pkg/services/forward_connection")
+
 type ForwardConnectionsPool struct {
 	m     sync.RWMutex
 	conns []ForwardConnection
+
+	gcInterval  time.Duration
+	idleTimeout time.Duration
+
+	traffic byteCounters
+	shaper  Shaper
 }
 
-func NewForwardConnectionsPool() *ForwardConnectionsPool {
+// NewForwardConnectionsPool creates a pool whose connections are paced by
+// shaper, which may be nil.
+func NewForwardConnectionsPool(gcInterval, idleTimeout time.Duration, shaper Shaper) *ForwardConnectionsPool {
 	p := &ForwardConnectionsPool{
-		conns: make([]ForwardConnection, 0, 10),
-		m:     sync.RWMutex{},
+		conns:       make([]ForwardConnection, 0, 10),
+		m:           sync.RWMutex{},
+		gcInterval:  gcInterval,
+		idleTimeout: idleTimeout,
+		shaper:      shaper,
 	}
 
 	go func() {
 		for {
-			<-time.After(3 * time.Second)
+			<-time.After(p.getGCInterval())
 			p.gcClosedConnections()
 		}
 	}()
@@ -27,6 +44,23 @@ func NewForwardConnectionsPool() *ForwardConnectionsPool {
 	return p
 }
 
+// SetTimings changes the GC interval, the idle timeout applies to forward
+// connections opened from now on.
+func (f *ForwardConnectionsPool) SetTimings(gcInterval, idleTimeout time.Duration) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.gcInterval = gcInterval
+	f.idleTimeout = idleTimeout
+}
+
+func (f *ForwardConnectionsPool) getGCInterval() time.Duration {
+	f.m.RLock()
+	defer f.m.RUnlock()
+
+	return f.gcInterval
+}
+
 func (f *ForwardConnectionsPool) Close() {
 	f.m.Lock()
 	defer f.m.Unlock()
@@ -37,16 +71,12 @@ func (f *ForwardConnectionsPool) Close() {
 }
 
 func (f *ForwardConnectionsPool) gcClosedConnections() {
-	f.m.RLock()
-	defer f.m.RUnlock()
+	f.m.Lock()
+	defer f.m.Unlock()
 
 	conns := make([]ForwardConnection, 0, 10)
 	for _, v := range f.conns {
-		if v.InUse() {
-			continue
-		}
-
-		if v.Alive() {
+		if v.Alive() || v.InUse() {
 			conns = append(conns, v)
 		}
 	}
@@ -58,26 +88,75 @@ func (f *ForwardConnectionsPool) Append(c net.Conn) error {
 	f.m.Lock()
 	defer f.m.Unlock()
 
-	f.conns = append(f.conns, &tcpForwardConnection{conn: c, inUse: false, alive: true})
+	f.conns = append(f.conns, newTcpForwardConnection(c, f.idleTimeout, &f.traffic, f.shaper))
 	return nil
 }
 
-func (f *ForwardConnectionsPool) Get() ForwardConnection {
+func (f *ForwardConnectionsPool) Get(ctx context.Context) ForwardConnection {
+	_, span := tracer.Start(ctx, "ForwardConnectionsPool.Get")
+	defer span.End()
+
 	f.m.Lock()
 	defer f.m.Unlock()
 
+	span.SetAttributes(attribute.Int("pool.size", len(f.conns)))
+
 	for _, v := range f.conns {
 		if v.InUse() || !v.Alive() {
 			continue
 		}
 
 		v.Acquire()
+		span.SetAttributes(attribute.Bool("pool.hit", true))
 		return v
 	}
 
+	span.SetAttributes(attribute.Bool("pool.hit", false))
 	return nil
 }
 
+// Counts returns the number of live connections waiting for a visitor and
+// the number of connections serving one.
+func (f *ForwardConnectionsPool) Counts() (idle, inUse int) {
+	f.m.RLock()
+	defer f.m.RUnlock()
+
+	for _, v := range f.conns {
+		switch {
+		case v.InUse():
+			inUse++
+		case v.Alive():
+			idle++
+		}
+	}
+
+	return idle, inUse
+}
+
+// Traffic returns the bytes written to and read from all connections the
+// pool ever had.
+func (f *ForwardConnectionsPool) Traffic() (sent, received uint64) {
+	return atomic.LoadUint64(&f.traffic.sent), atomic.LoadUint64(&f.traffic.received)
+}
+
+// InUse counts the connections currently serving a visitor.
+func (f *ForwardConnectionsPool) InUse() int {
+	f.m.RLock()
+	defer f.m.RUnlock()
+
+	n := 0
+	for _, v := range f.conns {
+		if v.InUse() {
+			n++
+		}
+	}
+
+	return n
+}
+
 func (f *ForwardConnectionsPool) Size() int {
+	f.m.RLock()
+	defer f.m.RUnlock()
+
 	return len(f.conns)
 }
@@ -0,0 +1,125 @@
+package inspector
+
+import (
+	"strconv"
+	"sync"
+)
+
+// subscriberBuffer is how many entries a slow stream may lag behind before
+// it misses some.
+const subscriberBuffer = 16
+
+// Buffer keeps the most recent entries of a tunnel and streams new ones to
+// subscribers.
+type Buffer struct {
+	m       sync.RWMutex
+	entries []*Entry
+	next    int
+	full    bool
+	seq     uint64
+
+	subscribers map[chan Entry]struct{}
+	closed      bool
+}
+
+func NewBuffer(size int) *Buffer {
+	if size < 1 {
+		size = 1
+	}
+
+	return &Buffer{entries: make([]*Entry, size), subscribers: make(map[chan Entry]struct{})}
+}
+
+func (b *Buffer) add(e *Entry) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.entries[b.next] = e
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- *e:
+		default:
+			// the stream is too slow, it misses this entry
+		}
+	}
+}
+
+func (b *Buffer) nextID() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.seq++
+	return strconv.FormatUint(b.seq, 10)
+}
+
+// List returns the entries from oldest to newest.
+func (b *Buffer) List() []Entry {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	list := make([]Entry, 0, len(b.entries))
+	if b.full {
+		for _, e := range b.entries[b.next:] {
+			list = append(list, *e)
+		}
+	}
+	for _, e := range b.entries[:b.next] {
+		list = append(list, *e)
+	}
+
+	return list
+}
+
+func (b *Buffer) Get(id string) (Entry, bool) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	for _, e := range b.entries {
+		if e != nil && e.ID == id {
+			return *e, true
+		}
+	}
+
+	return Entry{}, false
+}
+
+// Subscribe streams entries added from now on. The channel is closed when
+// the buffer is closed, cancel must be called when the reader goes away.
+func (b *Buffer) Subscribe() (<-chan Entry, func()) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	ch := make(chan Entry, subscriberBuffer)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		b.m.Lock()
+		defer b.m.Unlock()
+
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close ends all streams.
+func (b *Buffer) Close() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
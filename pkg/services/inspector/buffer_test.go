@@ -0,0 +1,83 @@
+package inspector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func ids(entries []Entry) []string {
+	list := make([]string, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e.ID)
+	}
+
+	return list
+}
+
+func TestBufferList(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		added int
+		want  []string
+	}{
+		{name: "empty", size: 3, added: 0, want: []string{}},
+		{name: "partly filled", size: 3, added: 2, want: []string{"1", "2"}},
+		{name: "exactly full", size: 3, added: 3, want: []string{"1", "2", "3"}},
+		{name: "wrapped", size: 3, added: 5, want: []string{"3", "4", "5"}},
+		{name: "size below one", size: 0, added: 2, want: []string{"2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBuffer(tt.size)
+			for i := 0; i < tt.added; i++ {
+				b.add(&Entry{ID: b.nextID()})
+			}
+
+			if got := ids(b.List()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("List() = %v, want %v", got, tt.want)
+			}
+			for _, id := range tt.want {
+				if _, ok := b.Get(id); !ok {
+					t.Errorf("Get(%s) found nothing", id)
+				}
+			}
+			if _, ok := b.Get("0"); ok {
+				t.Error("Get() found an entry never added")
+			}
+		})
+	}
+}
+
+func TestBufferSubscribe(t *testing.T) {
+	b := NewBuffer(2)
+	b.add(&Entry{ID: "old"})
+
+	stream, cancel := b.Subscribe()
+	slow, _ := b.Subscribe()
+	for i := 0; i < subscriberBuffer+4; i++ {
+		b.add(&Entry{ID: "new"})
+		<-stream
+	}
+
+	// entries before subscribing are not streamed, a full stream drops
+	if n := len(slow); n != subscriberBuffer {
+		t.Errorf("slow stream holds %d entries, want %d", n, subscriberBuffer)
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-stream; ok {
+		t.Error("cancelled stream is still open")
+	}
+
+	b.Close()
+	for range slow {
+	}
+
+	late, _ := b.Subscribe()
+	if _, ok := <-late; ok {
+		t.Error("stream of a closed buffer is open")
+	}
+}
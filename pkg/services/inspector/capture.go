@@ -0,0 +1,191 @@
+package inspector
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Settings control what is kept of captured requests.
+type Settings struct {
+	// BodyLimit is how many bytes of each body are kept.
+	BodyLimit int
+	// Redact are the headers whose values are never stored.
+	Redact []string
+}
+
+// Capture records one request while it is proxied. Bodies are recorded as
+// they stream through, so capturing never buffers a whole body.
+type Capture struct {
+	buffer   *Buffer
+	settings Settings
+	start    time.Time
+
+	// acquired, written and headers are the moments the phases of the
+	// exchange ended, zero if they never did.
+	acquired time.Time
+	written  time.Time
+	headers  time.Time
+
+	entry    *Entry
+	reqBody  *bodyRecorder
+	respBody *bodyRecorder
+}
+
+// Start begins capturing r. The request body is replaced by a recording
+// one, bodyless requests are left alone so they stay retryable.
+func (b *Buffer) Start(r *http.Request, visitorIP string, settings Settings) *Capture {
+	c := &Capture{
+		buffer:   b,
+		settings: settings,
+		start:    time.Now(),
+		entry: &Entry{
+			ID:        b.nextID(),
+			VisitorIP: visitorIP,
+			Request: Request{
+				Method:  r.Method,
+				Scheme:  scheme(r),
+				URL:     r.URL.RequestURI(),
+				Host:    r.Host,
+				Proto:   r.Proto,
+				Headers: redact(r.Header, settings.Redact),
+			},
+		},
+	}
+	c.entry.Time = c.start
+
+	if r.Body != nil && r.Body != http.NoBody {
+		c.reqBody = &bodyRecorder{ReadCloser: r.Body, limit: settings.BodyLimit}
+		r.Body = c.reqBody
+	}
+
+	return c
+}
+
+// ReplayOf marks the request as a replay of the entry with the given id.
+func (c *Capture) ReplayOf(id string) {
+	c.entry.ReplayOf = id
+}
+
+// ConnectionAcquired starts the exchange over, a retried request only
+// reports the phases of its last attempt.
+func (c *Capture) ConnectionAcquired() {
+	c.acquired = time.Now()
+	c.written = time.Time{}
+	c.headers = time.Time{}
+}
+
+func (c *Capture) RequestWritten() {
+	c.written = time.Now()
+}
+
+func (c *Capture) ResponseHeaders() {
+	c.headers = time.Now()
+}
+
+// Response records the answer of the client. The body of a 101 response is
+// the upgraded connection, it is not recorded.
+func (c *Capture) Response(resp *http.Response) {
+	c.entry.Response = &Response{
+		Status:  resp.StatusCode,
+		Proto:   resp.Proto,
+		Headers: redact(resp.Header, c.settings.Redact),
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		c.respBody = &bodyRecorder{ReadCloser: resp.Body, limit: c.settings.BodyLimit}
+		resp.Body = c.respBody
+	}
+}
+
+// Finish stores the entry once the visitor got its answer.
+func (c *Capture) Finish(status int, err error) {
+	end := time.Now()
+
+	c.entry.Status = status
+	c.entry.Duration = millis(end.Sub(c.start))
+	c.entry.Timings = c.timings(end)
+	if err != nil {
+		c.entry.Error = err.Error()
+	}
+
+	if c.reqBody != nil {
+		c.entry.Request.Body = c.reqBody.body()
+	}
+	if c.respBody != nil {
+		c.entry.Response.Body = c.respBody.body()
+	}
+
+	c.buffer.add(c.entry)
+}
+
+// timings splits the exchange at the phases it went through. Phases which
+// never ended take no time, the time left is counted to the last one.
+func (c *Capture) timings(end time.Time) *Timings {
+	if c.acquired.IsZero() {
+		return nil
+	}
+
+	phase := func(from, to time.Time) float64 {
+		if to.IsZero() || from.IsZero() {
+			return 0
+		}
+		return millis(to.Sub(from))
+	}
+
+	t := &Timings{
+		Blocked: phase(c.start, c.acquired),
+		Send:    phase(c.acquired, c.written),
+		Wait:    phase(c.written, c.headers),
+		Receive: phase(c.headers, end),
+	}
+
+	switch {
+	case c.written.IsZero():
+		t.Send = phase(c.acquired, end)
+	case c.headers.IsZero():
+		t.Wait = phase(c.written, end)
+	}
+
+	return t
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// bodyRecorder keeps the first bytes read through it and counts the rest.
+type bodyRecorder struct {
+	io.ReadCloser
+
+	limit int
+	buf   bytes.Buffer
+	size  int64
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+
+	if keep := b.limit - b.buf.Len(); keep > 0 {
+		if keep > n {
+			keep = n
+		}
+		b.buf.Write(p[:keep])
+	}
+
+	return n, err
+}
+
+func (b *bodyRecorder) body() Body {
+	return newBody(b.buf.Bytes(), b.size, b.size > int64(b.buf.Len()))
+}
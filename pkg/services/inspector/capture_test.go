@@ -0,0 +1,173 @@
+package inspector
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	settings := Settings{BodyLimit: 8, Redact: []string{"authorization", "Set-Cookie"}}
+
+	tests := []struct {
+		name      string
+		reqBody   string
+		respBody  string
+		status    int
+		err       error
+		wantReq   Body
+		wantResp  Body
+		wantError string
+	}{
+		{
+			name:     "short bodies",
+			reqBody:  "ping",
+			respBody: "pong",
+			status:   200,
+			wantReq:  Body{Size: 4, Text: "ping"},
+			wantResp: Body{Size: 4, Text: "pong"},
+		},
+		{
+			name:     "truncated",
+			reqBody:  "0123456789",
+			respBody: "abcdefghijklmnop",
+			status:   200,
+			wantReq:  Body{Size: 10, Truncated: true, Text: "01234567"},
+			wantResp: Body{Size: 16, Truncated: true, Text: "abcdefgh"},
+		},
+		{
+			name:     "binary",
+			respBody: "\xff\xfe\x00",
+			status:   200,
+			wantResp: Body{Size: 3, Base64: "//4A"},
+		},
+		{
+			name:      "failed",
+			status:    502,
+			err:       errors.New("client went away"),
+			wantError: "client went away",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBuffer(10)
+
+			var body io.Reader
+			if tt.reqBody != "" {
+				body = strings.NewReader(tt.reqBody)
+			}
+			r := httptest.NewRequest("POST", "http://app.localhost/path?q=1", body)
+			r.Header.Set("Authorization", "Bearer secret")
+			r.Header.Set("Accept", "*/*")
+
+			c := b.Start(r, "10.0.0.1", settings)
+			if tt.reqBody == "" && r.Body != http.NoBody {
+				t.Error("bodyless request got a recording body")
+			}
+			io.ReadAll(r.Body)
+
+			c.ConnectionAcquired()
+			c.RequestWritten()
+			if tt.err == nil {
+				resp := &http.Response{
+					StatusCode: tt.status,
+					Proto:      "HTTP/1.1",
+					Header:     http.Header{"Set-Cookie": {"session=1"}},
+					Body:       io.NopCloser(strings.NewReader(tt.respBody)),
+				}
+				c.ResponseHeaders()
+				c.Response(resp)
+				io.ReadAll(resp.Body)
+			}
+			c.Finish(tt.status, tt.err)
+
+			entries := b.List()
+			if len(entries) != 1 {
+				t.Fatalf("buffer holds %d entries, want 1", len(entries))
+			}
+			e := entries[0]
+
+			if e.VisitorIP != "10.0.0.1" || e.Request.URL != "/path?q=1" || e.Request.Host != "app.localhost" || e.Status != tt.status {
+				t.Errorf("entry = %+v", e)
+			}
+			if got := e.Request.Headers.Get("Authorization"); got != redacted {
+				t.Errorf("Authorization = %q, want it redacted", got)
+			}
+			if got := e.Request.Headers.Get("Accept"); got != "*/*" {
+				t.Errorf("Accept = %q, want it kept", got)
+			}
+			if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+				t.Errorf("the proxied request lost its Authorization header: %q", got)
+			}
+			if e.Error != tt.wantError {
+				t.Errorf("error = %q, want %q", e.Error, tt.wantError)
+			}
+			if e.Timings == nil {
+				t.Error("no timings")
+			}
+
+			checkBody(t, "request", e.Request.Body, tt.wantReq)
+			if tt.err != nil {
+				if e.Response != nil {
+					t.Error("failed request has a response")
+				}
+				return
+			}
+			if got := e.Response.Headers.Get("Set-Cookie"); got != redacted {
+				t.Errorf("Set-Cookie = %q, want it redacted", got)
+			}
+			checkBody(t, "response", e.Response.Body, tt.wantResp)
+		})
+	}
+}
+
+func checkBody(t *testing.T, name string, got, want Body) {
+	t.Helper()
+
+	if got.Size != want.Size || got.Truncated != want.Truncated || got.Text != want.Text || got.Base64 != want.Base64 {
+		t.Errorf("%s body = %+v, want %+v", name, got, want)
+	}
+}
+
+func TestCaptureTimings(t *testing.T) {
+	tests := []struct {
+		name     string
+		phases   int
+		wantNil  bool
+		wantLast string
+	}{
+		{name: "no connection", phases: 0, wantNil: true},
+		{name: "sending", phases: 1, wantLast: "send"},
+		{name: "waiting", phases: 2, wantLast: "wait"},
+		{name: "receiving", phases: 3, wantLast: "receive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewBuffer(1).Start(httptest.NewRequest("GET", "/", nil), "", Settings{})
+			for i, phase := range []func(){c.ConnectionAcquired, c.RequestWritten, c.ResponseHeaders} {
+				if i < tt.phases {
+					phase()
+				}
+			}
+
+			timings := c.timings(c.start.Add(1e9))
+			if tt.wantNil {
+				if timings != nil {
+					t.Errorf("timings = %+v, want none", timings)
+				}
+				return
+			}
+
+			// the phase still running when the exchange ended takes the rest
+			last := map[string]float64{"send": timings.Send, "wait": timings.Wait, "receive": timings.Receive}[tt.wantLast]
+			if last < 900 {
+				t.Errorf("%s = %vms, want the rest of the second, timings %+v", tt.wantLast, last, timings)
+			}
+		})
+	}
+}
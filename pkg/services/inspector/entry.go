@@ -0,0 +1,95 @@
+package inspector
+
+import (
+	"encoding/base64"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// Entry is a request proxied through a tunnel, as the visitor sent it and
+// as the client answered it.
+type Entry struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	VisitorIP string    `json:"visitor_ip"`
+
+	// Status is what the visitor got, also when the client never answered.
+	Status   int      `json:"status"`
+	Duration float64  `json:"duration_ms"`
+	Timings  *Timings `json:"timings,omitempty"`
+	Error    string   `json:"error,omitempty"`
+
+	// ReplayOf is the entry this request was replayed from.
+	ReplayOf string `json:"replay_of,omitempty"`
+
+	Request  Request   `json:"request"`
+	Response *Response `json:"response,omitempty"`
+}
+
+// Timings split Duration in milliseconds. Blocked is spent waiting for a
+// forward connection, Send writing the request to the client, Wait until
+// the response headers arrived and Receive until the visitor got the body.
+type Timings struct {
+	Blocked float64 `json:"blocked_ms"`
+	Send    float64 `json:"send_ms"`
+	Wait    float64 `json:"wait_ms"`
+	Receive float64 `json:"receive_ms"`
+}
+
+type Request struct {
+	Method  string      `json:"method"`
+	Scheme  string      `json:"scheme"`
+	URL     string      `json:"url"`
+	Host    string      `json:"host"`
+	Proto   string      `json:"proto"`
+	Headers http.Header `json:"headers"`
+	Body    Body        `json:"body"`
+}
+
+type Response struct {
+	Status  int         `json:"status"`
+	Proto   string      `json:"proto"`
+	Headers http.Header `json:"headers"`
+	Body    Body        `json:"body"`
+}
+
+// Body holds the first bytes of a message body. Text is set for UTF-8
+// bodies, Base64 for anything else.
+type Body struct {
+	Size      int64  `json:"size"`
+	Truncated bool   `json:"truncated"`
+	Text      string `json:"text,omitempty"`
+	Base64    string `json:"base64,omitempty"`
+
+	Data []byte `json:"-"`
+}
+
+func newBody(data []byte, size int64, truncated bool) Body {
+	b := Body{Size: size, Truncated: truncated, Data: data}
+	if utf8.Valid(data) {
+		b.Text = string(data)
+	} else {
+		b.Base64 = base64.StdEncoding.EncodeToString(data)
+	}
+
+	return b
+}
+
+const redacted = "[REDACTED]"
+
+// redact copies the headers, replacing the values of the given ones.
+func redact(h http.Header, names []string) http.Header {
+	out := h.Clone()
+	if out == nil {
+		out = http.Header{}
+	}
+
+	for _, name := range names {
+		if _, ok := out[http.CanonicalHeaderKey(name)]; ok {
+			out.Set(name, redacted)
+		}
+	}
+
+	return out
+}
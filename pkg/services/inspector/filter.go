@@ -0,0 +1,50 @@
+package inspector
+
+import (
+	"strings"
+	"time"
+)
+
+// Filter selects entries by time and path. Zero fields match everything.
+type Filter struct {
+	From time.Time
+	To   time.Time
+	// Paths are prefixes, an entry matches if its path has any of them.
+	Paths []string
+}
+
+func (f Filter) Match(e Entry) bool {
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && e.Time.After(f.To) {
+		return false
+	}
+	if len(f.Paths) == 0 {
+		return true
+	}
+
+	path := e.Request.URL
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	for _, prefix := range f.Paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply returns the entries matching f, in their order.
+func (f Filter) Apply(entries []Entry) []Entry {
+	matching := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		if f.Match(e) {
+			matching = append(matching, e)
+		}
+	}
+
+	return matching
+}
@@ -0,0 +1,269 @@
+package inspector
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// HAR is an HTTP Archive 1.2 document, see
+// http://www.softwareishard.com/blog/har-12-spec/.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+
+	ID        string `json:"_id"`
+	VisitorIP string `json:"_visitorIP"`
+	ReplayOf  string `json:"_replayOf,omitempty"`
+	Error     string `json:"_error,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []HARNameValue `json:"params"`
+	Text     string         `json:"text"`
+	Encoding string         `json:"_encoding,omitempty"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARTimings are in milliseconds, -1 for phases a tunnel doesn't have.
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// NewHAR converts entries to a HAR document. The given headers are
+// redacted on top of what was redacted while capturing.
+func NewHAR(entries []Entry, redactHeaders []string) HAR {
+	har := HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "greencobra", Version: "1.0"},
+		Entries: make([]HAREntry, 0, len(entries)),
+	}}
+
+	for _, e := range entries {
+		har.Log.Entries = append(har.Log.Entries, harEntry(e, redactHeaders))
+	}
+
+	return har
+}
+
+func harEntry(e Entry, redactHeaders []string) HAREntry {
+	reqHeaders := redact(e.Request.Headers, redactHeaders)
+
+	u := url.URL{Scheme: e.Request.Scheme, Host: e.Request.Host}
+	if ref, err := url.Parse(e.Request.URL); err == nil {
+		u.Path, u.RawPath, u.RawQuery = ref.Path, ref.RawPath, ref.RawQuery
+	}
+
+	entry := HAREntry{
+		StartedDateTime: e.Time.Format(time.RFC3339Nano),
+		Time:            e.Duration,
+		Request: HARRequest{
+			Method:      e.Request.Method,
+			URL:         u.String(),
+			HTTPVersion: e.Request.Proto,
+			Cookies:     harCookies(reqHeaders, "Cookie"),
+			Headers:     harHeaders(reqHeaders),
+			QueryString: harQuery(u.Query()),
+			PostData:    harPostData(reqHeaders, e.Request.Body),
+			HeadersSize: -1,
+			BodySize:    e.Request.Body.Size,
+		},
+		Response: HARResponse{
+			Status:      e.Status,
+			StatusText:  http.StatusText(e.Status),
+			HTTPVersion: e.Request.Proto,
+			Cookies:     []HARCookie{},
+			Headers:     []HARNameValue{},
+			HeadersSize: -1,
+		},
+		Timings: HARTimings{
+			Blocked: -1,
+			DNS:     -1,
+			Connect: -1,
+			SSL:     -1,
+		},
+		ID:        e.ID,
+		VisitorIP: e.VisitorIP,
+		ReplayOf:  e.ReplayOf,
+		Error:     e.Error,
+	}
+
+	if e.Timings != nil {
+		entry.Timings.Blocked = e.Timings.Blocked
+		entry.Timings.Send = e.Timings.Send
+		entry.Timings.Wait = e.Timings.Wait
+		entry.Timings.Receive = e.Timings.Receive
+	} else {
+		// no forward connection was ever acquired
+		entry.Timings.Blocked = e.Duration
+	}
+
+	if resp := e.Response; resp != nil {
+		respHeaders := redact(resp.Headers, redactHeaders)
+
+		entry.Response.Status = resp.Status
+		entry.Response.StatusText = http.StatusText(resp.Status)
+		entry.Response.HTTPVersion = resp.Proto
+		entry.Response.Cookies = harCookies(respHeaders, "Set-Cookie")
+		entry.Response.Headers = harHeaders(respHeaders)
+		entry.Response.Content = harContent(respHeaders, resp.Body)
+		entry.Response.RedirectURL = respHeaders.Get("Location")
+		entry.Response.BodySize = resp.Body.Size
+	}
+
+	return entry
+}
+
+func harHeaders(h http.Header) []HARNameValue {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]HARNameValue, 0, len(h))
+	for _, name := range names {
+		for _, v := range h[name] {
+			list = append(list, HARNameValue{Name: name, Value: v})
+		}
+	}
+
+	return list
+}
+
+func harQuery(q url.Values) []HARNameValue {
+	return harHeaders(http.Header(q))
+}
+
+// harCookies parses the cookies of the given header, which is left out if
+// it was redacted.
+func harCookies(h http.Header, name string) []HARCookie {
+	cookies := []HARCookie{}
+	if h.Get(name) == redacted {
+		return cookies
+	}
+
+	switch name {
+	case "Cookie":
+		for _, c := range (&http.Request{Header: h}).Cookies() {
+			cookies = append(cookies, HARCookie{Name: c.Name, Value: c.Value})
+		}
+	case "Set-Cookie":
+		for _, c := range (&http.Response{Header: h}).Cookies() {
+			cookies = append(cookies, HARCookie{Name: c.Name, Value: c.Value})
+		}
+	}
+
+	return cookies
+}
+
+func harPostData(h http.Header, b Body) *HARPostData {
+	if b.Size == 0 {
+		return nil
+	}
+
+	d := &HARPostData{
+		MimeType: h.Get("Content-Type"),
+		Params:   []HARNameValue{},
+		Text:     b.Text,
+		Comment:  truncation(b),
+	}
+	if b.Base64 != "" {
+		d.Text, d.Encoding = b.Base64, "base64"
+	}
+
+	return d
+}
+
+func harContent(h http.Header, b Body) HARContent {
+	c := HARContent{
+		Size:     b.Size,
+		MimeType: h.Get("Content-Type"),
+		Text:     b.Text,
+		Comment:  truncation(b),
+	}
+	if b.Base64 != "" {
+		c.Text, c.Encoding = b.Base64, "base64"
+	}
+
+	return c
+}
+
+func truncation(b Body) string {
+	if !b.Truncated {
+		return ""
+	}
+
+	return fmt.Sprintf("truncated to %d of %d bytes", len(b.Data), b.Size)
+}
@@ -0,0 +1,213 @@
+package inspector
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewHAR(t *testing.T) {
+	started := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	complete := Entry{
+		ID:        "1",
+		Time:      started,
+		VisitorIP: "192.0.2.1",
+		Status:    201,
+		Duration:  12.5,
+		Timings:   &Timings{Blocked: 0.5, Send: 1, Wait: 10, Receive: 1},
+		Request: Request{
+			Method: "POST",
+			Scheme: "https",
+			URL:    "/orders?b=2&a=1",
+			Host:   "app.localhost",
+			Proto:  "HTTP/1.1",
+			Headers: http.Header{
+				"Content-Type":  {"application/json"},
+				"Cookie":        {"session=abc; theme=dark"},
+				"Authorization": {redacted},
+			},
+			Body: newBody([]byte(`{"id":1}`), 8, false),
+		},
+		Response: &Response{
+			Status: 201,
+			Proto:  "HTTP/2.0",
+			Headers: http.Header{
+				"Content-Type": {"application/octet-stream"},
+				"Location":     {"/orders/1"},
+				"Set-Cookie":   {"session=def; Path=/"},
+			},
+			Body: newBody([]byte{0xff, 0xfe}, 100, true),
+		},
+	}
+
+	tests := []struct {
+		name   string
+		entry  Entry
+		redact []string
+		check  func(t *testing.T, e HAREntry)
+	}{
+		{
+			name:  "request",
+			entry: complete,
+			check: func(t *testing.T, e HAREntry) {
+				if e.StartedDateTime != "2026-01-02T03:04:05Z" {
+					t.Errorf("startedDateTime = %q", e.StartedDateTime)
+				}
+				if e.Request.URL != "https://app.localhost/orders?b=2&a=1" {
+					t.Errorf("url = %q", e.Request.URL)
+				}
+				wantQuery := []HARNameValue{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}
+				if !reflect.DeepEqual(e.Request.QueryString, wantQuery) {
+					t.Errorf("queryString = %v, want %v", e.Request.QueryString, wantQuery)
+				}
+				wantCookies := []HARCookie{{Name: "session", Value: "abc"}, {Name: "theme", Value: "dark"}}
+				if !reflect.DeepEqual(e.Request.Cookies, wantCookies) {
+					t.Errorf("cookies = %v, want %v", e.Request.Cookies, wantCookies)
+				}
+				if e.Request.Headers[0].Name != "Authorization" || e.Request.Headers[0].Value != redacted {
+					t.Errorf("headers are not sorted or lost the redaction: %v", e.Request.Headers)
+				}
+				if d := e.Request.PostData; d == nil || d.Text != `{"id":1}` || d.MimeType != "application/json" || d.Comment != "" {
+					t.Errorf("postData = %+v", d)
+				}
+			},
+		},
+		{
+			name:  "response",
+			entry: complete,
+			check: func(t *testing.T, e HAREntry) {
+				r := e.Response
+				if r.Status != 201 || r.StatusText != "Created" || r.HTTPVersion != "HTTP/2.0" {
+					t.Errorf("status line = %d %q %q", r.Status, r.StatusText, r.HTTPVersion)
+				}
+				if r.RedirectURL != "/orders/1" {
+					t.Errorf("redirectURL = %q", r.RedirectURL)
+				}
+				if !reflect.DeepEqual(r.Cookies, []HARCookie{{Name: "session", Value: "def"}}) {
+					t.Errorf("cookies = %v", r.Cookies)
+				}
+				if r.Content.Encoding != "base64" || r.Content.Text != "//4=" {
+					t.Errorf("binary content = %q encoded %q", r.Content.Text, r.Content.Encoding)
+				}
+				if r.Content.Comment != "truncated to 2 of 100 bytes" || r.BodySize != 100 {
+					t.Errorf("truncated content = %q, body size %d", r.Content.Comment, r.BodySize)
+				}
+			},
+		},
+		{
+			name:  "timings",
+			entry: complete,
+			check: func(t *testing.T, e HAREntry) {
+				want := HARTimings{Blocked: 0.5, DNS: -1, Connect: -1, Send: 1, Wait: 10, Receive: 1, SSL: -1}
+				if e.Timings != want {
+					t.Errorf("timings = %+v, want %+v", e.Timings, want)
+				}
+			},
+		},
+		{
+			name:   "redacted on export",
+			entry:  complete,
+			redact: []string{"cookie", "Set-Cookie"},
+			check: func(t *testing.T, e HAREntry) {
+				if len(e.Request.Cookies) != 0 || len(e.Response.Cookies) != 0 {
+					t.Errorf("redacted cookies were parsed: %v, %v", e.Request.Cookies, e.Response.Cookies)
+				}
+				for _, h := range append(e.Request.Headers, e.Response.Headers...) {
+					if (h.Name == "Cookie" || h.Name == "Set-Cookie") && h.Value != redacted {
+						t.Errorf("%s = %q", h.Name, h.Value)
+					}
+				}
+			},
+		},
+		{
+			name:  "never answered",
+			entry: Entry{ID: "2", Status: 502, Duration: 3, Error: "no connection", Request: Request{Method: "GET", URL: "/", Proto: "HTTP/1.1"}},
+			check: func(t *testing.T, e HAREntry) {
+				if e.Response.Status != 502 || e.Response.StatusText != "Bad Gateway" || e.Error != "no connection" {
+					t.Errorf("response = %+v, error %q", e.Response, e.Error)
+				}
+				if e.Timings.Blocked != 3 || e.Timings.Send != 0 {
+					t.Errorf("timings = %+v, want all blocked", e.Timings)
+				}
+				if e.Request.PostData != nil {
+					t.Errorf("postData = %+v for an empty body", e.Request.PostData)
+				}
+			},
+		},
+		{
+			name:  "replay",
+			entry: Entry{ID: "3", ReplayOf: "1", Status: 200},
+			check: func(t *testing.T, e HAREntry) {
+				if e.ID != "3" || e.ReplayOf != "1" {
+					t.Errorf("_id = %q, _replayOf = %q", e.ID, e.ReplayOf)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			har := NewHAR([]Entry{tt.entry}, tt.redact)
+			if har.Log.Version != "1.2" || len(har.Log.Entries) != 1 {
+				t.Fatalf("log = %+v", har.Log)
+			}
+			tt.check(t, har.Log.Entries[0])
+		})
+	}
+}
+
+func TestNewHAREmpty(t *testing.T) {
+	data, err := json.Marshal(NewHAR(nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Log struct {
+			Entries []json.RawMessage `json:"entries"`
+		} `json:"log"`
+	}
+	json.Unmarshal(data, &doc)
+	if doc.Log.Entries == nil {
+		t.Errorf("entries is not an empty list: %s", data)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	at := func(minute int) time.Time {
+		return time.Date(2026, 1, 1, 0, minute, 0, 0, time.UTC)
+	}
+	entries := []Entry{
+		{ID: "1", Time: at(0), Request: Request{URL: "/api/orders"}},
+		{ID: "2", Time: at(10), Request: Request{URL: "/api/users?page=2"}},
+		{ID: "3", Time: at(20), Request: Request{URL: "/static/app.js"}},
+		{ID: "4", Time: at(30), Request: Request{URL: "/?path=/api"}},
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{name: "everything", filter: Filter{}, want: []string{"1", "2", "3", "4"}},
+		{name: "from", filter: Filter{From: at(10)}, want: []string{"2", "3", "4"}},
+		{name: "to", filter: Filter{To: at(10)}, want: []string{"1", "2"}},
+		{name: "window", filter: Filter{From: at(5), To: at(25)}, want: []string{"2", "3"}},
+		{name: "path prefix", filter: Filter{Paths: []string{"/api/"}}, want: []string{"1", "2"}},
+		{name: "any prefix", filter: Filter{Paths: []string{"/api/users", "/static"}}, want: []string{"2", "3"}},
+		{name: "query is not the path", filter: Filter{Paths: []string{"/api"}}, want: []string{"1", "2"}},
+		{name: "time and path", filter: Filter{From: at(5), Paths: []string{"/api"}}, want: []string{"2"}},
+		{name: "nothing", filter: Filter{Paths: []string{"/admin"}}, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ids(tt.filter.Apply(entries)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package inspector
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrTruncated = errors.New("captured body was truncated, send a body to replay the request")
+	ErrUpgrade   = errors.New("protocol upgrades can't be replayed")
+	ErrRedacted  = errors.New("redacted headers must be sent in headers or listed in remove_headers to replay the request")
+)
+
+// Edit changes a captured request before it is replayed. Empty fields keep
+// what was captured.
+type Edit struct {
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// Headers replace the captured values of the given headers.
+	Headers       http.Header `json:"headers,omitempty"`
+	RemoveHeaders []string    `json:"remove_headers,omitempty"`
+	// Body or BodyBase64 replace the captured body.
+	Body       *string `json:"body,omitempty"`
+	BodyBase64 *string `json:"body_base64,omitempty"`
+}
+
+// Replay builds the request the visitor sent, with edit applied. Redacted
+// header values were never stored, the caller has to send them again.
+func (e Entry) Replay(ctx context.Context, edit Edit) (*http.Request, error) {
+	method, url := e.Request.Method, e.Request.URL
+	if edit.Method != "" {
+		method = edit.Method
+	}
+	if edit.URL != "" {
+		url = edit.URL
+	}
+
+	body := e.Request.Body.Data
+	switch {
+	case edit.BodyBase64 != nil:
+		data, err := base64.StdEncoding.DecodeString(*edit.BodyBase64)
+		if err != nil {
+			return nil, err
+		}
+		body = data
+	case edit.Body != nil:
+		body = []byte(*edit.Body)
+	case e.Request.Body.Truncated:
+		return nil, ErrTruncated
+	}
+
+	var r io.Reader
+	if len(body) != 0 {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = e.Request.Host
+
+	req.Header = e.Request.Headers.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	for name, values := range edit.Headers {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	for _, name := range edit.RemoveHeaders {
+		req.Header.Del(name)
+	}
+
+	var missing []string
+	for name, values := range req.Header {
+		for _, v := range values {
+			if v == redacted {
+				missing = append(missing, name)
+				break
+			}
+		}
+	}
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%w: %s", ErrRedacted, strings.Join(missing, ", "))
+	}
+
+	if req.Header.Get("Upgrade") != "" {
+		return nil, ErrUpgrade
+	}
+
+	// the body is sent as a whole, whatever framing the visitor used
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+
+	return req, nil
+}
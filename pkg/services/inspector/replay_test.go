@@ -0,0 +1,150 @@
+package inspector
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	entry := Entry{
+		ID: "1",
+		Request: Request{
+			Method: "POST",
+			URL:    "/orders?id=1",
+			Host:   "app.localhost",
+			Headers: http.Header{
+				"Authorization":  {redacted},
+				"Content-Type":   {"application/json"},
+				"Content-Length": {"7"},
+			},
+			Body: newBody([]byte(`{"a":1}`), 7, false),
+		},
+	}
+	truncated := entry
+	truncated.Request.Body = newBody([]byte(`{"a"`), 7, true)
+	upgrade := entry
+	upgrade.Request.Headers = http.Header{"Upgrade": {"websocket"}}
+
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name       string
+		entry      Entry
+		edit       Edit
+		wantErr    error
+		wantMethod string
+		wantURL    string
+		wantBody   string
+		wantHeader http.Header
+	}{
+		{
+			name:    "redacted header left",
+			entry:   entry,
+			wantErr: ErrRedacted,
+		},
+		{
+			name:       "redacted header sent again",
+			entry:      entry,
+			edit:       Edit{Headers: http.Header{"authorization": {"Bearer again"}}},
+			wantMethod: "POST",
+			wantURL:    "/orders?id=1",
+			wantBody:   `{"a":1}`,
+			wantHeader: http.Header{"Authorization": {"Bearer again"}, "Content-Type": {"application/json"}},
+		},
+		{
+			name:       "redacted header removed",
+			entry:      entry,
+			edit:       Edit{RemoveHeaders: []string{"authorization"}},
+			wantMethod: "POST",
+			wantURL:    "/orders?id=1",
+			wantBody:   `{"a":1}`,
+			wantHeader: http.Header{"Content-Type": {"application/json"}},
+		},
+		{
+			name:       "edited",
+			entry:      entry,
+			edit:       Edit{Method: "PUT", URL: "/orders?id=2", Body: str(`{"a":2}`), RemoveHeaders: []string{"Authorization"}},
+			wantMethod: "PUT",
+			wantURL:    "/orders?id=2",
+			wantBody:   `{"a":2}`,
+		},
+		{
+			name:       "base64 body",
+			entry:      entry,
+			edit:       Edit{BodyBase64: str("AAE="), RemoveHeaders: []string{"Authorization"}},
+			wantMethod: "POST",
+			wantURL:    "/orders?id=1",
+			wantBody:   "\x00\x01",
+		},
+		{
+			name:    "truncated body",
+			entry:   truncated,
+			edit:    Edit{RemoveHeaders: []string{"Authorization"}},
+			wantErr: ErrTruncated,
+		},
+		{
+			name:       "truncated body replaced",
+			entry:      truncated,
+			edit:       Edit{Body: str(""), RemoveHeaders: []string{"Authorization"}},
+			wantMethod: "POST",
+			wantURL:    "/orders?id=1",
+			wantBody:   "",
+		},
+		{
+			name:    "upgrade",
+			entry:   upgrade,
+			wantErr: ErrUpgrade,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := tt.entry.Replay(context.Background(), tt.edit)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if req.Method != tt.wantMethod || req.URL.String() != tt.wantURL || req.Host != "app.localhost" {
+				t.Errorf("request = %s %s on %s, want %s %s", req.Method, req.URL, req.Host, tt.wantMethod, tt.wantURL)
+			}
+			if req.Header.Get("Content-Length") != "" {
+				t.Error("captured Content-Length was kept")
+			}
+			for name := range tt.wantHeader {
+				if req.Header.Get(name) != tt.wantHeader.Get(name) {
+					t.Errorf("%s = %q, want %q", name, req.Header.Get(name), tt.wantHeader.Get(name))
+				}
+			}
+
+			var body []byte
+			if req.Body != nil {
+				body, _ = io.ReadAll(req.Body)
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+
+	if entry.Request.Headers.Get("Authorization") != redacted {
+		t.Error("replaying changed the captured entry")
+	}
+}
+
+func TestReplayRedactedNames(t *testing.T) {
+	e := Entry{Request: Request{Method: "GET", URL: "/", Headers: http.Header{"Cookie": {redacted}, "Authorization": {redacted}}}}
+
+	_, err := e.Replay(context.Background(), Edit{})
+	if err == nil || err.Error() != ErrRedacted.Error()+": Authorization, Cookie" {
+		t.Errorf("err = %v, want the missing headers named in order", err)
+	}
+}
@@ -0,0 +1,92 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// List is a set of IPv4 and IPv6 networks.
+type List []*net.IPNet
+
+// ParseList reads CIDRs, a bare address stands for itself alone.
+func ParseList(cidrs []string) (List, error) {
+	list := make(List, 0, len(cidrs))
+	for _, s := range cidrs {
+		s = strings.TrimSpace(s)
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %q", s)
+			}
+
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %q", s)
+		}
+		list = append(list, n)
+	}
+
+	return list, nil
+}
+
+// Contains reports whether ip is in any network of the list. IPv4-mapped
+// IPv6 addresses match IPv4 networks.
+func (l List) Contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Rules decide which visitors may reach a tunnel. Deny wins over allow, an
+// empty allow list lets everyone in who isn't denied.
+type Rules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Filter is the parsed form of Rules.
+type Filter struct {
+	allow List
+	deny  List
+}
+
+func (r Rules) Compile() (*Filter, error) {
+	allow, err := ParseList(r.Allow)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := ParseList(r.Deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{allow: allow, deny: deny}, nil
+}
+
+// Permits reports whether the rules let ip in. A nil filter permits
+// everyone.
+func (f *Filter) Permits(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if f.deny.Contains(ip) {
+		return false
+	}
+
+	return len(f.allow) == 0 || f.allow.Contains(ip)
+}
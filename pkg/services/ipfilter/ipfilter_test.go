@@ -0,0 +1,134 @@
+package ipfilter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidrs   []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", cidrs: nil, want: []string{}},
+		{name: "networks", cidrs: []string{"10.0.0.0/8", "2001:db8::/32"}, want: []string{"10.0.0.0/8", "2001:db8::/32"}},
+		{name: "host bits dropped", cidrs: []string{"192.0.2.7/24"}, want: []string{"192.0.2.0/24"}},
+		{name: "bare addresses", cidrs: []string{" 192.0.2.1 ", "2001:db8::1"}, want: []string{"192.0.2.1/32", "2001:db8::1/128"}},
+		{name: "invalid address", cidrs: []string{"192.0.2"}, wantErr: true},
+		{name: "invalid network", cidrs: []string{"192.0.2.0/33"}, wantErr: true},
+		{name: "hostname", cidrs: []string{"example.com"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := ParseList(tt.cidrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if len(list) != len(tt.want) {
+				t.Fatalf("list = %v, want %v", list, tt.want)
+			}
+			for i, n := range list {
+				if n.String() != tt.want[i] {
+					t.Errorf("list[%d] = %s, want %s", i, n, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestListContains(t *testing.T) {
+	list, err := ParseList([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "10.1.2.3", want: true},
+		{ip: "11.0.0.1", want: false},
+		{ip: "192.0.2.1", want: true},
+		{ip: "192.0.2.2", want: false},
+		{ip: "::ffff:10.0.0.1", want: true},
+		{ip: "2001:db8::1", want: true},
+		{ip: "2001:db9::1", want: false},
+		{ip: "not an ip", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := list.Contains(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Contains(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	if List(nil).Contains(net.ParseIP("10.0.0.1")) {
+		t.Error("an empty list contains an address")
+	}
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   Rules
+		wantErr bool
+		permits map[string]bool
+	}{
+		{
+			name:    "no rules",
+			rules:   Rules{},
+			permits: map[string]bool{"192.0.2.1": true, "2001:db8::1": true},
+		},
+		{
+			name:    "allow only",
+			rules:   Rules{Allow: []string{"192.0.2.0/24"}},
+			permits: map[string]bool{"192.0.2.1": true, "198.51.100.1": false, "::ffff:192.0.2.9": true},
+		},
+		{
+			name:    "deny only",
+			rules:   Rules{Deny: []string{"192.0.2.0/24"}},
+			permits: map[string]bool{"192.0.2.1": false, "198.51.100.1": true},
+		},
+		{
+			name:    "deny wins",
+			rules:   Rules{Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.66"}},
+			permits: map[string]bool{"192.0.2.1": true, "192.0.2.66": false, "198.51.100.1": false},
+		},
+		{
+			name:    "unparsable visitor",
+			rules:   Rules{Allow: []string{"192.0.2.0/24"}},
+			permits: map[string]bool{"": false},
+		},
+		{name: "invalid allow", rules: Rules{Allow: []string{"nope"}}, wantErr: true},
+		{name: "invalid deny", rules: Rules{Deny: []string{"10.0.0.0/99"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := tt.rules.Compile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+
+			for ip, want := range tt.permits {
+				if got := f.Permits(net.ParseIP(ip)); got != want {
+					t.Errorf("Permits(%q) = %v, want %v", ip, got, want)
+				}
+			}
+		})
+	}
+
+	var f *Filter
+	if !f.Permits(net.ParseIP("192.0.2.1")) {
+		t.Error("a nil filter turns visitors away")
+	}
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+)
+
+const Namespace = "greencobra"
+
+// Registry holds all server metrics. Gauges read from live state, such as
+// running tunnels, are registered as collectors by their owners.
+var Registry = prometheus.NewRegistry()
+
+var (
+	TunnelsOpened = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "tunnels_opened_total",
+		Help:      "Tunnels opened, including restored ones.",
+	}, []string{"kind"})
+
+	TunnelsClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "tunnels_closed_total",
+		Help:      "Tunnels closed.",
+	}, []string{"kind"})
+
+	VisitorRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "visitor_requests_total",
+		Help:      "HTTP requests of tunnel visitors by response status code.",
+	}, []string{"code"})
+
+	ProxyDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "proxy_duration_seconds",
+		Help:      "Time from receiving a visitor request to the response headers of the tunnel client.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	ReceivedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "forward_received_bytes_total",
+		Help:      "Bytes read from forward connections of tunnel clients.",
+	})
+
+	SentBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "forward_sent_bytes_total",
+		Help:      "Bytes written to forward connections of tunnel clients.",
+	})
+
+	PoolExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "pool_exhausted_total",
+		Help:      "Visitors which got no free forward connection after all retries.",
+	})
+
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "rate_limited_total",
+		Help:      "Visitors turned away by the tunnel or the visitor IP rate limit.",
+	}, []string{"scope"})
+
+	VisitorsDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "visitors_denied_total",
+		Help:      "Visitors turned away by the server-wide or the tunnel IP filter.",
+	}, []string{"scope"})
+
+	PortAllocationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "port_allocation_failures_total",
+		Help:      "Tunnels which could not be created because no port was free.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		TunnelsOpened,
+		TunnelsClosed,
+		VisitorRequests,
+		ProxyDuration,
+		ReceivedBytes,
+		SentBytes,
+		PoolExhausted,
+		RateLimited,
+		VisitorsDenied,
+		PortAllocationFailures,
+	)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
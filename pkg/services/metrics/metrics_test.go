@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryLint(t *testing.T) {
+	problems, err := testutil.GatherAndLint(Registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("%s: %s", p.Metric, p.Text)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	VisitorRequests.WithLabelValues("200").Inc()
+	RateLimited.WithLabelValues("tunnel").Inc()
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+
+	tests := []string{
+		`greencobra_visitor_requests_total{code="200"}`,
+		`greencobra_rate_limited_total{scope="tunnel"}`,
+		"greencobra_proxy_duration_seconds_bucket",
+		"greencobra_port_allocation_failures_total",
+		"go_goroutines",
+	}
+
+	for _, want := range tests {
+		t.Run(want, func(t *testing.T) {
+			if !strings.Contains(string(body), want) {
+				t.Errorf("exposition lacks %s", want)
+			}
+		})
+	}
+}
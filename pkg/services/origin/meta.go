@@ -24,17 +24,39 @@ func (m Meta) Host() string {
 
 	return parts[0]
 }
+
+// Port returns the port from the Host, falling back to the default port of
+// the scheme when the visitor omitted it, e.g. on 443 behind TLS.
 func (m Meta) Port() string {
 	// Host format is: host.com:443
 	parts := strings.Split(m.url.Host, ":")
+	if len(parts) > 1 {
+		return parts[1]
+	}
 
-	return parts[1]
+	if m.Scheme() == "https" {
+		return "443"
+	}
+
+	return "80"
+}
+
+// DefaultPort reports whether the port is implied by the scheme and can be
+// left out of URLs.
+func (m Meta) DefaultPort() bool {
+	port := m.Port()
+
+	return (m.Scheme() == "https" && port == "443") || (m.Scheme() == "http" && port == "80")
 }
 
 func (m Meta) Scheme() string {
 	return m.url.Scheme
 }
 
+func (m Meta) URL() *url.URL {
+	return m.url
+}
+
 func (m Meta) IP() net.IP {
 	return m.ip
 }
@@ -1,24 +1,37 @@
 package services
 
 import (
+	"errors"
+	"fmt"
 	"math/rand"
 	"net"
 	"strconv"
 	"time"
 )
 
-func GenerateOpenedPortNumber(min, max int) int {
+// portAttempts bounds the random picks, so a full range fails instead of
+// spinning forever.
+const portAttempts = 100
+
+var ErrNoFreePort = errors.New("no free port in range")
+
+func GenerateOpenedPortNumber(min, max int) (int, error) {
 	randPort := func() int {
 		return min + rand.Intn(max-min)
 	}
 
-	port := randPort()
-	for IsPortTaken(port) {
-		port = randPort()
+	for attempt := 0; attempt < portAttempts; attempt++ {
+		port := randPort()
+		if !IsPortTaken(port) {
+			return port, nil
+		}
 	}
-	return port
+
+	return 0, ErrNoFreePort
 }
 
+// IsPortTaken reports whether port is in use over tcp or udp, UDP tunnels
+// bind their public port for udp only.
 func IsPortTaken(port int) bool {
 	timeout := time.Second
 	conn, _ := net.DialTimeout("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)), timeout)
@@ -27,5 +40,11 @@ func IsPortTaken(port int) bool {
 		return true
 	}
 
+	packetConn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return true
+	}
+	packetConn.Close()
+
 	return false
 }
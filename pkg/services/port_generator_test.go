@@ -0,0 +1,74 @@
+package services
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPortTaken(t *testing.T) {
+	tests := []struct {
+		name string
+		hold func(t *testing.T) int
+		want bool
+	}{
+		{
+			name: "free",
+			hold: func(t *testing.T) int {
+				ln, err := net.Listen("tcp", ":0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				ln.Close()
+				return ln.Addr().(*net.TCPAddr).Port
+			},
+			want: false,
+		},
+		{
+			name: "tcp",
+			hold: func(t *testing.T) int {
+				ln, err := net.Listen("tcp", ":0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { ln.Close() })
+				return ln.Addr().(*net.TCPAddr).Port
+			},
+			want: true,
+		},
+		{
+			name: "udp",
+			hold: func(t *testing.T) int {
+				conn, err := net.ListenPacket("udp", ":0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { conn.Close() })
+				return conn.LocalAddr().(*net.UDPAddr).Port
+			},
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := tt.hold(t)
+			if got := IsPortTaken(port); got != tt.want {
+				t.Errorf("IsPortTaken(%d) = %v, want %v", port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateOpenedPortNumberSkipsUdp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	_, err = GenerateOpenedPortNumber(port, port+1)
+	if err != ErrNoFreePort {
+		t.Errorf("err = %v, want %v for a range whose only port is bound over udp", err, ErrNoFreePort)
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"go-server/pkg/services/ipfilter"
+	"go-server/pkg/services/metrics"
+	"net"
+	"sync"
+)
+
+// tunnelFilter holds the IP filter of a tunnel with its parsed form.
+type tunnelFilter struct {
+	m      sync.RWMutex
+	rules  *ipfilter.Rules
+	filter *ipfilter.Filter
+}
+
+// Permit checks the visitor IP against the server-wide deny list and the
+// IP filter of the tunnel. Denials are counted in the traffic stats.
+func (s *TcpProxyInstance) Permit(visitorIP string) bool {
+	ip := net.ParseIP(visitorIP)
+
+	if s.conf.Load().DenyVisitors.Contains(ip) {
+		s.traffic.deny()
+		metrics.VisitorsDenied.WithLabelValues("server").Inc()
+		return false
+	}
+
+	s.ipFilter.m.RLock()
+	permitted := s.ipFilter.filter.Permits(ip)
+	s.ipFilter.m.RUnlock()
+
+	if !permitted {
+		s.traffic.deny()
+		metrics.VisitorsDenied.WithLabelValues("tunnel").Inc()
+		return false
+	}
+
+	return true
+}
+
+// IPFilter returns the IP filter of the tunnel, nil if it has none.
+func (s *TcpProxyInstance) IPFilter() *ipfilter.Rules {
+	s.ipFilter.m.RLock()
+	defer s.ipFilter.m.RUnlock()
+
+	return s.ipFilter.rules
+}
+
+// SetIPFilter replaces the IP filter of the tunnel, nil removes it.
+func (s *TcpProxyInstance) SetIPFilter(rules *ipfilter.Rules) error {
+	var filter *ipfilter.Filter
+	if rules != nil {
+		var err error
+		filter, err = rules.Compile()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.ipFilter.m.Lock()
+	defer s.ipFilter.m.Unlock()
+
+	s.ipFilter.rules = rules
+	s.ipFilter.filter = filter
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"go-server/pkg/services/ratelimit"
+)
+
+// ServerBandwidth holds the throttles shared by all tunnels of a manager to
+// enforce the server-wide caps.
+type ServerBandwidth struct {
+	Upload   ratelimit.Throttle
+	Download ratelimit.Throttle
+}
+
+// BandwidthStats shows the caps a tunnel runs with and how long its traffic
+// was held back by them, including the server-wide caps.
+type BandwidthStats struct {
+	Upload         ratelimit.Limit
+	Download       ratelimit.Limit
+	UploadWaited   float64
+	DownloadWaited float64
+}
+
+// Upload implements forward_connection.Shaper.
+func (s *TcpProxyInstance) Upload(n int) {
+	upload, _ := s.bandwidth()
+
+	s.upload.Wait(n, upload)
+	s.server.Upload.Wait(n, s.conf.Load().ServerUpload)
+}
+
+// Download implements forward_connection.Shaper.
+func (s *TcpProxyInstance) Download(n int) {
+	_, download := s.bandwidth()
+
+	s.download.Wait(n, download)
+	s.server.Download.Wait(n, s.conf.Load().ServerDownload)
+}
+
+// bandwidth returns the caps chosen at creation or the server defaults,
+// cut down to the maximums in case those were lowered by a reload.
+func (s *TcpProxyInstance) bandwidth() (upload, download ratelimit.Limit) {
+	conf := s.conf.Load()
+	upload, download = conf.TunnelUpload, conf.TunnelDownload
+
+	if b := s.opts.Bandwidth; b != nil {
+		if b.Upload != nil {
+			upload = *b.Upload
+		}
+		if b.Download != nil {
+			download = *b.Download
+		}
+	}
+
+	if !upload.Within(conf.MaxTunnelUpload) {
+		upload = conf.MaxTunnelUpload
+	}
+	if !download.Within(conf.MaxTunnelDownload) {
+		download = conf.MaxTunnelDownload
+	}
+
+	return upload, download
+}
+
+func (s *TcpProxyInstance) BandwidthStats() BandwidthStats {
+	upload, download := s.bandwidth()
+
+	return BandwidthStats{
+		Upload:         upload,
+		Download:       download,
+		UploadWaited:   s.upload.Waited().Seconds(),
+		DownloadWaited: s.download.Waited().Seconds(),
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"go-server/pkg/services/origin"
+	"go-server/pkg/services/ratelimit"
+	"net/url"
+	"testing"
+)
+
+func TestTunnelBandwidth(t *testing.T) {
+	slow := ratelimit.Limit{Rate: 1000}
+	fast := ratelimit.Limit{Rate: 5000}
+	max := ratelimit.Limit{Rate: 2000}
+
+	tests := []struct {
+		name         string
+		defaults     ratelimit.Limit
+		max          ratelimit.Limit
+		opts         *Bandwidth
+		wantUpload   ratelimit.Limit
+		wantDownload ratelimit.Limit
+	}{
+		{name: "unlimited"},
+		{name: "server defaults", defaults: slow, wantUpload: slow, wantDownload: slow},
+		{name: "chosen at creation", defaults: slow, opts: &Bandwidth{Upload: &fast}, wantUpload: fast, wantDownload: slow},
+		{name: "cut to a lowered maximum", defaults: slow, max: max, opts: &Bandwidth{Upload: &fast, Download: &slow}, wantUpload: max, wantDownload: slow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, Options{Bandwidth: tt.opts})
+			c := *s.conf.Load()
+			c.TunnelUpload, c.TunnelDownload = tt.defaults, tt.defaults
+			c.MaxTunnelUpload, c.MaxTunnelDownload = tt.max, tt.max
+			s.conf.Store(&c)
+
+			upload, download := s.bandwidth()
+			if upload != tt.wantUpload || download != tt.wantDownload {
+				t.Errorf("bandwidth() = %+v, %+v, want %+v, %+v", upload, download, tt.wantUpload, tt.wantDownload)
+			}
+		})
+	}
+}
+
+func TestBandwidthValidate(t *testing.T) {
+	max := ratelimit.Limit{Rate: 2000, Burst: 4000}
+	within := ratelimit.Limit{Rate: 1000}
+	over := ratelimit.Limit{Rate: 3000}
+	bigBurst := ratelimit.Limit{Rate: 1000, Burst: 8000}
+	negative := ratelimit.Limit{Rate: -1}
+
+	tests := []struct {
+		name    string
+		b       Bandwidth
+		wantErr bool
+	}{
+		{name: "nothing chosen", b: Bandwidth{}},
+		{name: "within", b: Bandwidth{Upload: &within, Download: &within}},
+		{name: "rate over", b: Bandwidth{Upload: &over}, wantErr: true},
+		{name: "burst over", b: Bandwidth{Download: &bigBurst}, wantErr: true},
+		{name: "negative", b: Bandwidth{Upload: &negative}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.b.Validate(max, max)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerBandwidthShared(t *testing.T) {
+	m, _ := newTestManager(t)
+	u, _ := url.Parse("http://test.localhost:3001")
+
+	a, err := m.New("a", origin.NewMeta(u, nil), Options{Kind: KindHTTP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.New("b", origin.NewMeta(u, nil), Options{Kind: KindHTTP})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.server != m.bandwidth || b.server != m.bandwidth {
+		t.Error("tunnels don't share the manager's server-wide throttles")
+	}
+	if a.upload == b.upload || a.download == b.download {
+		t.Error("tunnels share their own throttles")
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"syscall"
+)
+
+// forwardBody wraps a response body read from a forward connection and hands
+// the connection back exactly once, when the body is closed. onClose learns
+// whether the body was read to the end, only then the connection is in a
+// state where it can serve another request.
+type forwardBody struct {
+	io.ReadCloser
+
+	eof     bool
+	once    sync.Once
+	onClose func(eof bool)
+}
+
+func (b *forwardBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+
+	return n, err
+}
+
+// Close gives the connection back before closing the body, otherwise the
+// underlying body would drain whatever is left of the response.
+func (b *forwardBody) Close() error {
+	b.once.Do(func() { b.onClose(b.eof) })
+
+	return b.ReadCloser.Close()
+}
+
+// upgradedBody exposes a forward connection after a protocol switch. Reads
+// go through the buffered reader used to parse the response, so no bytes
+// sent right after the 101 headers are lost.
+type upgradedBody struct {
+	io.Reader
+	io.Writer
+
+	once    sync.Once
+	onClose func()
+}
+
+func (b *upgradedBody) Close() error {
+	b.once.Do(b.onClose)
+
+	return nil
+}
+
+// isStaleConnection reports whether err means the client closed an idle
+// forward connection before the request was answered.
+func isStaleConnection(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// isReplayable reports whether r may be sent again after a stale forward
+// connection, the same rule net/http applies: requests without a body which
+// are safe, or which carry an idempotency key.
+func isReplayable(r *http.Request) bool {
+	if r.Body != nil && r.Body != http.NoBody {
+		return false
+	}
+
+	switch r.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return r.Header.Get("Idempotency-Key") != "" || r.Header.Get("X-Idempotency-Key") != ""
+}
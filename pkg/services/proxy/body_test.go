@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestIsReplayable(t *testing.T) {
+	tests := []struct {
+		method string
+		body   io.Reader
+		key    string
+		want   bool
+	}{
+		{method: "GET", want: true},
+		{method: "HEAD", want: true},
+		{method: "OPTIONS", want: true},
+		{method: "TRACE", want: true},
+		{method: "PUT", want: false},
+		{method: "PUT", key: "Idempotency-Key", want: true},
+		{method: "POST", key: "X-Idempotency-Key", want: true},
+		{method: "PUT", body: strings.NewReader("x"), key: "Idempotency-Key", want: false},
+		{method: "GET", body: strings.NewReader("x"), want: false},
+		{method: "POST", want: false},
+		{method: "PATCH", want: false},
+		{method: "DELETE", want: false},
+	}
+
+	for _, tt := range tests {
+		name := tt.method
+		if tt.body != nil {
+			name += " with body"
+		}
+		if tt.key != "" {
+			name += " with " + tt.key
+		}
+
+		t.Run(name, func(t *testing.T) {
+			r, _ := http.NewRequest(tt.method, "http://test.localhost/", tt.body)
+			if tt.key != "" {
+				r.Header.Set(tt.key, "abc")
+			}
+			if got := isReplayable(r); got != tt.want {
+				t.Errorf("isReplayable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsStaleConnection(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: io.EOF, want: true},
+		{err: fmt.Errorf("read: %w", io.ErrUnexpectedEOF), want: true},
+		{err: fmt.Errorf("write: %w", syscall.EPIPE), want: true},
+		{err: syscall.ECONNRESET, want: true},
+		{err: errors.New("malformed HTTP response"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := isStaleConnection(tt.err); got != tt.want {
+				t.Errorf("isStaleConnection() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,16 +1,93 @@
 package proxy
 
+import (
+	"go-server/pkg/services/inspector"
+	"go-server/pkg/services/ipfilter"
+	"go-server/pkg/services/ratelimit"
+	"sync/atomic"
+	"time"
+)
+
 type Config struct {
 	MinPort           int
 	MaxPort           int
 	BaseDomain        string
 	MaxConnsPerClient int
 
+	// TLSPort is the public port of the TLS listener, used in the URLs of
+	// passthrough tunnels.
+	TLSPort int
+
 	InactiveHoursTimeout          int
 	NoActiveSocketsMinutesTimeout int
 	NoActiveSocketsChecks         int
+
+	// InactivityCheckInterval is how often tunnels are checked against
+	// InactiveHoursTimeout.
+	InactivityCheckInterval time.Duration
+	PoolGCInterval          time.Duration
+
+	// ForwardIdleTimeout bounds how long a forward connection may stay
+	// silent while serving a visitor.
+	ForwardIdleTimeout time.Duration
+
+	// UdpSessionIdleTimeout is how long a UDP visitor keeps its session
+	// after its last datagram. Each session holds a forward connection of
+	// the tunnel meanwhile, so MaxConnsPerClient bounds the visitors served
+	// at once.
+	UdpSessionIdleTimeout time.Duration
+
+	// AcquireRetries and AcquireRetryDelay control how long a visitor waits
+	// for a free forward connection.
+	AcquireRetries    int
+	AcquireRetryDelay time.Duration
+
+	// TunnelRateLimit and VisitorRateLimit apply to tunnels which don't
+	// override them, see RateLimits.
+	TunnelRateLimit  ratelimit.Limit
+	VisitorRateLimit ratelimit.Limit
+
+	// TunnelUpload and TunnelDownload cap tunnels which don't choose their
+	// own bandwidth, which may be at most MaxTunnelUpload/Download.
+	// ServerUpload and ServerDownload cap all tunnels together.
+	TunnelUpload      ratelimit.Limit
+	TunnelDownload    ratelimit.Limit
+	MaxTunnelUpload   ratelimit.Limit
+	MaxTunnelDownload ratelimit.Limit
+	ServerUpload      ratelimit.Limit
+	ServerDownload    ratelimit.Limit
+
+	// InspectBufferSize is how many requests inspected tunnels keep.
+	InspectBufferSize int
+	Inspect           inspector.Settings
+
+	// DenyVisitors are turned away from every tunnel.
+	DenyVisitors ipfilter.List
+	// TrustedProxies may tell the visitor IP with X-Forwarded-For.
+	TrustedProxies ipfilter.List
 }
 
 func (pc *Config) MaxClients() int {
 	return pc.MaxPort - pc.MinPort
 }
+
+// SharedConfig is the live Config shared by the manager and its tunnels.
+// Readers get an immutable snapshot, a reload swaps it atomically.
+type SharedConfig struct {
+	v atomic.Value
+}
+
+func NewSharedConfig(c *Config) *SharedConfig {
+	s := &SharedConfig{}
+	s.v.Store(c)
+
+	return s
+}
+
+func (s *SharedConfig) Load() *Config {
+	return s.v.Load().(*Config)
+}
+
+func (s *SharedConfig) Store(c *Config) {
+	s.v.Store(c)
+}
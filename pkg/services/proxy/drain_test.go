@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"go-server/pkg/services/origin"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name     string
+		inFlight bool
+		release  time.Duration
+		timeout  time.Duration
+		min, max time.Duration
+	}{
+		{name: "idle", timeout: 5 * time.Second, max: time.Second},
+		{name: "waits for the visitor", inFlight: true, release: 300 * time.Millisecond, timeout: 5 * time.Second, min: 300 * time.Millisecond, max: 2 * time.Second},
+		{name: "gives up at the timeout", inFlight: true, release: 10 * time.Second, timeout: 300 * time.Millisecond, min: 300 * time.Millisecond, max: 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, Options{})
+
+			release := make(chan struct{})
+			connectClient(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-release:
+				case <-time.After(tt.release):
+				}
+			}), 2)
+			defer close(release)
+
+			if tt.inFlight {
+				go func() {
+					r, _ := http.NewRequest("GET", "http://test.localhost/", nil)
+					err, resp := s.Proxy(r)
+					if err == nil {
+						resp.Body.Close()
+					}
+				}()
+
+				for s.connPool.InUse() == 0 {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			closed := make(chan struct{}, 1)
+			s.SubscribeOnClose(closed)
+
+			start := time.Now()
+			go s.Drain(tt.timeout)
+
+			for !s.Draining() {
+				time.Sleep(time.Millisecond)
+			}
+			r, _ := http.NewRequest("GET", "http://test.localhost/", nil)
+			if err, _ := s.Proxy(r); !errors.Is(err, ErrDraining) {
+				t.Errorf("new visitor during drain: err = %v, want %v", err, ErrDraining)
+			}
+
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("tunnel was not closed")
+			}
+			if took := time.Since(start); took < tt.min || took > tt.max {
+				t.Errorf("drain took %v, want between %v and %v", took, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	m, store := newTestManager(t)
+
+	u, _ := url.Parse("http://test.localhost:3001")
+	_, err := m.New("test", origin.NewMeta(u, nil), Options{Kind: KindHTTP})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	m.Shutdown(ctx)
+
+	if !m.ShuttingDown() {
+		t.Error("manager does not report shutting down")
+	}
+	if _, err := m.New("late", origin.NewMeta(u, nil), Options{Kind: KindHTTP}); err != ErrShuttingDown {
+		t.Errorf("New during shutdown: got %v, want %v", err, ErrShuttingDown)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Get("test") != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.Get("test") != nil {
+		t.Fatal("tunnel still running after shutdown")
+	}
+
+	// the record stays, so the tunnel is restored on the next start
+	records, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].ID != "test" {
+		t.Errorf("registry = %+v, want the drained tunnel kept", records)
+	}
+}
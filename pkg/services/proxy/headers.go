@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopHeaders only describe one connection and must not cross the tunnel,
+// otherwise e.g. a visitor's "Connection: close" would tear down a pooled
+// forward connection, or the client's "Keep-Alive" reach the visitor.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// UpgradeType returns the protocol a request asks to switch to, e.g.
+// "websocket" or "h2c", or an empty string for plain requests.
+func UpgradeType(h http.Header) string {
+	if !hasToken(h, "Connection", "upgrade") {
+		return ""
+	}
+
+	return h.Get("Upgrade")
+}
+
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// outgoingRequest prepares a copy of the visitor request to be written to a
+// forward connection. Upgrade requests keep their Connection and Upgrade
+// headers so the client can switch protocols, and HTTP2-Settings which an
+// h2c upgrade can't do without.
+func outgoingRequest(r *http.Request) *http.Request {
+	out := r.Clone(r.Context())
+	out.Body = r.Body
+	out.Close = false
+
+	upgrade := UpgradeType(r.Header)
+	settings := r.Header.Values("HTTP2-Settings")
+	removeHopHeaders(out.Header)
+
+	if upgrade != "" {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", upgrade)
+
+		if len(settings) > 0 && hasToken(r.Header, "Connection", "HTTP2-Settings") {
+			out.Header["Http2-Settings"] = settings
+			out.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+		}
+	}
+
+	return out
+}
+
+// removeHopHeaders deletes the hop-by-hop headers of h, the fixed ones and
+// the ones its Connection header names.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// reusable reports whether a forward connection can serve another request
+// once the response body was read to the end. Responses delimited by the
+// connection closing have ambiguous framing and are never reused, neither
+// are 1xx responses, the final response would still be unread.
+func reusable(resp *http.Response) bool {
+	if resp.Close || resp.StatusCode/100 == 1 {
+		return false
+	}
+
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return true
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent, resp.StatusCode == http.StatusNotModified:
+		return true
+	case resp.ContentLength >= 0:
+		return true
+	}
+
+	for _, te := range resp.TransferEncoding {
+		if strings.EqualFold(te, "chunked") {
+			return true
+		}
+	}
+
+	return false
+}
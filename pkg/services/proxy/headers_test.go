@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUpgradeType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{name: "plain", header: http.Header{}, want: ""},
+		{name: "websocket", header: http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, want: "websocket"},
+		{name: "token list", header: http.Header{"Connection": {"keep-alive, upgrade"}, "Upgrade": {"h2c"}}, want: "h2c"},
+		{name: "upgrade without connection token", header: http.Header{"Connection": {"keep-alive"}, "Upgrade": {"websocket"}}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UpgradeType(tt.header); got != tt.want {
+				t.Errorf("UpgradeType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutgoingRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  http.Header
+		want    http.Header
+		dropped []string
+	}{
+		{
+			name:    "hop headers",
+			header:  http.Header{"Connection": {"close"}, "Keep-Alive": {"timeout=5"}, "Proxy-Authorization": {"Basic eDp5"}, "Accept": {"*/*"}},
+			want:    http.Header{"Accept": {"*/*"}},
+			dropped: []string{"Connection", "Keep-Alive", "Proxy-Authorization"},
+		},
+		{
+			name:    "connection tokens",
+			header:  http.Header{"Connection": {"X-Trace"}, "X-Trace": {"1"}, "X-Other": {"2"}},
+			want:    http.Header{"X-Other": {"2"}},
+			dropped: []string{"X-Trace"},
+		},
+		{
+			name:   "upgrade kept",
+			header: http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Key": {"abc"}},
+			want:   http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}, "Sec-Websocket-Key": {"abc"}},
+		},
+		{
+			name:   "h2c upgrade",
+			header: http.Header{"Connection": {"Upgrade, HTTP2-Settings"}, "Upgrade": {"h2c"}, "Http2-Settings": {"AAMAAABkAAQAAP__"}},
+			want:   http.Header{"Connection": {"Upgrade, HTTP2-Settings"}, "Upgrade": {"h2c"}, "Http2-Settings": {"AAMAAABkAAQAAP__"}},
+		},
+		{
+			name:    "settings without upgrade",
+			header:  http.Header{"Connection": {"HTTP2-Settings"}, "Http2-Settings": {"AAMAAABkAAQAAP__"}},
+			want:    http.Header{},
+			dropped: []string{"Connection", "Http2-Settings"},
+		},
+		{
+			name:    "settings not listed in connection",
+			header:  http.Header{"Connection": {"Upgrade"}, "Upgrade": {"h2c"}, "Http2-Settings": {"AAMAAABkAAQAAP__"}},
+			want:    http.Header{"Connection": {"Upgrade"}, "Upgrade": {"h2c"}},
+			dropped: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://test.localhost/", nil)
+			r.Header = tt.header
+			r.Close = true
+
+			out := outgoingRequest(r)
+			if out.Close {
+				t.Error("Close was kept, the forward connection would be torn down")
+			}
+			for name, values := range tt.want {
+				if got := out.Header.Values(name); len(got) != len(values) || got[0] != values[0] {
+					t.Errorf("%s = %q, want %q", name, got, values)
+				}
+			}
+			for _, name := range tt.dropped {
+				if v := out.Header.Get(name); v != "" {
+					t.Errorf("%s = %q, want it dropped", name, v)
+				}
+			}
+		})
+	}
+}
+
+func TestReusable(t *testing.T) {
+	get, _ := http.NewRequest("GET", "http://test.localhost/", nil)
+	head, _ := http.NewRequest("HEAD", "http://test.localhost/", nil)
+
+	tests := []struct {
+		name string
+		resp *http.Response
+		want bool
+	}{
+		{name: "content length", resp: &http.Response{Request: get, StatusCode: 200, ContentLength: 5}, want: true},
+		{name: "chunked", resp: &http.Response{Request: get, StatusCode: 200, ContentLength: -1, TransferEncoding: []string{"chunked"}}, want: true},
+		{name: "no content", resp: &http.Response{Request: get, StatusCode: 204, ContentLength: -1}, want: true},
+		{name: "not modified", resp: &http.Response{Request: get, StatusCode: 304, ContentLength: -1}, want: true},
+		{name: "head", resp: &http.Response{Request: head, StatusCode: 200, ContentLength: -1}, want: true},
+		{name: "until close", resp: &http.Response{Request: get, StatusCode: 200, ContentLength: -1}, want: false},
+		{name: "connection close", resp: &http.Response{Request: get, StatusCode: 200, ContentLength: 5, Close: true}, want: false},
+		{name: "continue", resp: &http.Response{Request: get, StatusCode: 100, ContentLength: -1}, want: false},
+		{name: "early hints to head", resp: &http.Response{Request: head, StatusCode: 103, ContentLength: -1}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reusable(tt.resp); got != tt.want {
+				t.Errorf("reusable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,21 +1,57 @@
 package proxy
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/rs/zerolog"
+	"go-server/pkg/services/auth"
 	"go-server/pkg/services/forward_connection"
+	"go-server/pkg/services/inspector"
+	"go-server/pkg/services/ipfilter"
+	"go-server/pkg/services/metrics"
 	"go-server/pkg/services/origin"
+	"go-server/pkg/services/ratelimit"
+	"go-server/pkg/services/registry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var tracer = otel.Tracer("go-server/pkg/services/proxy")
+
+// ErrDraining is returned for visitors of a tunnel which is shutting down.
+var ErrDraining = errors.New("tunnel is draining")
+
+// maxInformational bounds the 1xx responses skipped before the final one,
+// the same bound net/http uses.
+const maxInformational = 5
+
 type TcpProxyInstance struct {
-	Port int
-	ID   string
+	Port  int
+	ID    string
+	Kind  Kind
+	Owner string
+
+	// PublicPort is the port visitors connect to for tunnels which are not
+	// routed through the API listener, zero otherwise.
+	PublicPort int
+
+	CreatedAt time.Time
 
-	conf *Config
+	conf *SharedConfig
+	opts Options
 
 	logger   zerolog.Logger
 	connPool *forward_connection.ForwardConnectionsPool
@@ -24,37 +60,99 @@ type TcpProxyInstance struct {
 
 	requestClose chan struct{}
 	lastActive   time.Time
+	draining     int32
+
+	traffic trafficCounters
+	limiter *ratelimit.Limiter
+
+	upload   *ratelimit.Throttle
+	download *ratelimit.Throttle
+	server   *ServerBandwidth
+
+	// inspector is nil unless the tunnel was created with Inspect.
+	inspector *inspector.Buffer
+	// guard is nil unless visitors must authenticate.
+	guard *auth.VisitorGuard
+
+	// ipFilter replaces opts.IPFilter, it changes at runtime.
+	ipFilter *tunnelFilter
 
-	listener net.Listener
+	listener       net.Listener
+	publicListener net.Listener
 
+	packetConn  net.PacketConn
+	udpSessions *udpSessions
+	udpStats    UdpStats
+
+	// notifyMut guards notifyOnClose and closed, a tunnel may close before
+	// the manager subscribes.
+	notifyMut     sync.Mutex
 	notifyOnClose []chan struct{}
+	closed        bool
 }
 
-func NewTcpProxyInstance(logger zerolog.Logger, port int, c *Config, id string, origin *origin.Meta) *TcpProxyInstance {
+// NewTcpProxyInstance binds the ports of a tunnel and starts serving it,
+// it fails if one of the ports can't be bound.
+func NewTcpProxyInstance(logger zerolog.Logger, port, publicPort int, c *SharedConfig, id string, origin *origin.Meta, opts Options, createdAt time.Time, server *ServerBandwidth) (*TcpProxyInstance, error) {
 
 	tp := &TcpProxyInstance{
 		Port:          port,
 		ID:            id,
+		Kind:          opts.Kind,
+		Owner:         opts.Owner,
+		CreatedAt:     createdAt,
+		opts:          opts,
+		PublicPort:    publicPort,
 		conf:          c,
 		logger:        logger,
 		origin:        origin,
-		connPool:      forward_connection.NewForwardConnectionsPool(),
 		lastActive:    time.Now(),
 		requestClose:  make(chan struct{}, 1),
+		udpSessions:   newUdpSessions(),
+		limiter:       ratelimit.NewLimiter(),
+		upload:        &ratelimit.Throttle{},
+		download:      &ratelimit.Throttle{},
+		server:        server,
+		ipFilter:      &tunnelFilter{},
 		notifyOnClose: make([]chan struct{}, 0),
 	}
-
-	go func() {
-		err := tp.listen()
+	if opts.Auth != nil {
+		tp.guard = auth.NewVisitorGuard(*opts.Auth)
+	}
+	if opts.IPFilter != nil {
+		err := tp.SetIPFilter(opts.IPFilter)
 		if err != nil {
-			tp.logger.Err(err).Msg("failed to listen")
+			// the rules were checked at creation, don't fail open on a
+			// registry record which went bad since
+			tp.logger.Err(err).Str("tunnel-id", id).Msg("invalid ip filter, denying all visitors")
+			tp.SetIPFilter(&ipfilter.Rules{Deny: []string{"0.0.0.0/0", "::/0"}})
 		}
-	}()
+	}
+	if opts.Inspect && opts.Kind == KindHTTP {
+		tp.inspector = inspector.NewBuffer(c.Load().InspectBufferSize)
+	}
+	// The ports are bound before anything starts, a tunnel which can't bind
+	// one of them releases the others and is never started.
+	err := tp.bind()
+	if err != nil {
+		tp.closeListeners()
+		return nil, err
+	}
+	tp.connPool = forward_connection.NewForwardConnectionsPool(c.Load().PoolGCInterval, c.Load().ForwardIdleTimeout, tp)
+
+	go tp.acceptClients()
+
+	switch tp.Kind {
+	case KindTCP:
+		go tp.acceptPublic()
+	case KindUDP:
+		go tp.relayUDP()
+	}
 
 	go func() {
 		for {
-			<-time.After(30 * time.Minute)
-			timeoutDelay := time.Now().Add(time.Duration(-1*tp.conf.InactiveHoursTimeout) * time.Hour)
+			<-time.After(tp.conf.Load().InactivityCheckInterval)
+			timeoutDelay := time.Now().Add(time.Duration(-1*tp.conf.Load().InactiveHoursTimeout) * time.Hour)
 			if tp.lastActive.Before(timeoutDelay) {
 				tp.RequestClose()
 				return
@@ -65,13 +163,13 @@ func NewTcpProxyInstance(logger zerolog.Logger, port int, c *Config, id string,
 	go func() {
 		attempt := 0
 		for {
-			<-time.After(time.Duration(tp.conf.NoActiveSocketsMinutesTimeout) * time.Minute)
+			<-time.After(time.Duration(tp.conf.Load().NoActiveSocketsMinutesTimeout) * time.Minute)
 
 			if tp.connPool.Size() == 0 {
 				attempt++
 			}
 
-			if attempt >= tp.conf.NoActiveSocketsChecks {
+			if attempt >= tp.conf.Load().NoActiveSocketsChecks {
 				tp.RequestClose()
 				return
 			}
@@ -83,110 +181,378 @@ func NewTcpProxyInstance(logger zerolog.Logger, port int, c *Config, id string,
 		tp.close()
 	}()
 
-	return tp
+	return tp, nil
+}
+
+// bind listens on the client port and on the public port of the tunnel
+// kind.
+func (s *TcpProxyInstance) bind() error {
+	err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	switch s.Kind {
+	case KindTCP:
+		return s.listenPublic()
+	case KindUDP:
+		return s.listenUDP()
+	}
+	return nil
 }
 
 func (s *TcpProxyInstance) RequestClose() {
-	s.requestClose <- struct{}{}
+	select {
+	case s.requestClose <- struct{}{}:
+	default:
+		// close was already requested
+	}
+}
+
+// Drain stops handing forward connections to new visitors and closes the
+// tunnel once the connections in use are released, or when timeout passes.
+func (s *TcpProxyInstance) Drain(timeout time.Duration) {
+	atomic.StoreInt32(&s.draining, 1)
+	s.logger.Info().Str("tunnel-id", s.ID).Dur("timeout", timeout).Msg("draining tunnel")
+
+	deadline := time.Now().Add(timeout)
+	for s.connPool.InUse() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	s.RequestClose()
+}
+
+func (s *TcpProxyInstance) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
 }
 
 func (s *TcpProxyInstance) close() {
 	s.sendOnClose()
+	s.closeListeners()
 
-	err := s.listener.Close()
-	if err != nil {
-		s.logger.Err(err).Int("port", s.Port).Msg("failed to close listener")
+	if s.packetConn != nil {
+		s.udpSessions.closeAll()
+	}
+
+	if s.inspector != nil {
+		s.inspector.Close()
 	}
 
 	s.connPool.Close()
 }
 
-func (s TcpProxyInstance) sendOnClose() {
-	for _, v := range s.notifyOnClose {
+// closeListeners releases the ports bound by the tunnel.
+func (s *TcpProxyInstance) closeListeners() {
+	if s.listener != nil {
+		err := s.listener.Close()
+		if err != nil {
+			s.logger.Err(err).Int("port", s.Port).Msg("failed to close listener")
+		}
+	}
+
+	if s.publicListener != nil {
+		err := s.publicListener.Close()
+		if err != nil {
+			s.logger.Err(err).Int("port", s.PublicPort).Msg("failed to close public listener")
+		}
+	}
+
+	if s.packetConn != nil {
+		err := s.packetConn.Close()
+		if err != nil {
+			s.logger.Err(err).Int("port", s.PublicPort).Msg("failed to close public udp socket")
+		}
+	}
+}
+
+// Guard returns the visitor credentials check of the tunnel, nil if anyone
+// may visit it.
+func (s *TcpProxyInstance) Guard() *auth.VisitorGuard {
+	return s.guard
+}
+
+// Inspector returns the captured requests, nil if the tunnel doesn't keep
+// them.
+func (s *TcpProxyInstance) Inspector() *inspector.Buffer {
+	return s.inspector
+}
+
+// Inspect starts capturing r if the tunnel keeps its requests, the capture
+// is nil otherwise. The returned request must be proxied instead of r, it
+// reports the timings of the exchange.
+func (s *TcpProxyInstance) Inspect(r *http.Request, visitorIP string) (*http.Request, *inspector.Capture) {
+	if s.inspector == nil {
+		return r, nil
+	}
+
+	capture := s.inspector.Start(r, visitorIP, s.conf.Load().Inspect)
+	r = r.WithContext(WithPhases(r.Context(), &Phases{
+		ConnectionAcquired: capture.ConnectionAcquired,
+		RequestWritten:     capture.RequestWritten,
+		ResponseHeaders:    capture.ResponseHeaders,
+	}))
+
+	return r, capture
+}
+
+func (s *TcpProxyInstance) sendOnClose() {
+	s.notifyMut.Lock()
+	s.closed = true
+	notify := s.notifyOnClose
+	s.notifyMut.Unlock()
+
+	for _, v := range notify {
 		v <- struct{}{}
 	}
 }
 
+// SubscribeOnClose sends to notify once the tunnel closed, right away if it
+// already did.
 func (s *TcpProxyInstance) SubscribeOnClose(notify chan struct{}) {
+	s.notifyMut.Lock()
+	defer s.notifyMut.Unlock()
+
+	if s.closed {
+		notify <- struct{}{}
+		return
+	}
+
 	s.notifyOnClose = append(s.notifyOnClose, notify)
 }
 
 func (s *TcpProxyInstance) MaxConns() int {
-	return s.conf.MaxConnsPerClient
+	return s.conf.Load().MaxConnsPerClient
 }
 
 func (s *TcpProxyInstance) ClientUrl() string {
 	domain := s.origin.Host()
-	if s.conf.BaseDomain != "" {
-		domain = s.conf.BaseDomain
+	if d := s.conf.Load().BaseDomain; d != "" {
+		domain = d
 	}
 
-	port := s.origin.Port()
+	if s.Kind == KindTLS {
+		tlsPort := s.conf.Load().TLSPort
+		if tlsPort == 443 {
+			return fmt.Sprintf("https://%s.%s", s.ID, domain)
+		}
+
+		return fmt.Sprintf("https://%s.%s:%d", s.ID, domain, tlsPort)
+	}
+
+	if s.origin.DefaultPort() {
+		return fmt.Sprintf("%s://%s.%s", s.origin.Scheme(), s.ID, domain)
+	}
 
-	return fmt.Sprintf("%s://%s.%s:%s", s.origin.Scheme(), s.ID, domain, port)
+	return fmt.Sprintf("%s://%s.%s:%s", s.origin.Scheme(), s.ID, domain, s.origin.Port())
+}
+
+// PublicAddr is the host:port visitors of a raw TCP tunnel connect to.
+func (s *TcpProxyInstance) PublicAddr() string {
+	if s.PublicPort == 0 {
+		return ""
+	}
+
+	domain := s.origin.Host()
+	if d := s.conf.Load().BaseDomain; d != "" {
+		domain = d
+	}
+
+	return net.JoinHostPort(domain, strconv.Itoa(s.PublicPort))
 }
 
 func (s *TcpProxyInstance) ProxyEndpointUrl() string {
 	domain := s.origin.Host()
-	if s.conf.BaseDomain != "" {
-		domain = s.conf.BaseDomain
+	if d := s.conf.Load().BaseDomain; d != "" {
+		domain = d
 	}
 
-	return fmt.Sprintf("%s://%s.%s:%d", s.origin.Scheme(), s.ID, domain, s.Port)
+	// Forward connections are plain TCP, even when visitors come over TLS.
+	return fmt.Sprintf("http://%s.%s:%d", s.ID, domain, s.Port)
 }
 
-func (s *TcpProxyInstance) Proxy(data []byte) (error, []byte) {
+// Proxy streams the visitor request to one of the pooled forward connections
+// and returns the response as soon as its headers are parsed. The body is
+// read lazily from the forward connection, which goes back to the pool for
+// the next request once the caller read the body and closed it. Hop-by-hop
+// headers of the client are removed from the response. A 101 Switching
+// Protocols response keeps them and carries the forward connection as an
+// io.ReadWriteCloser body instead.
+func (s *TcpProxyInstance) Proxy(r *http.Request) (error, *http.Response) {
 	s.updateActive()
+	s.traffic.visit()
+
+	start := time.Now()
+	defer func() {
+		metrics.ProxyDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	ctx, span := tracer.Start(r.Context(), "TcpProxyInstance.Proxy", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.SetAttributes(attribute.String("tunnel.id", s.ID))
+
+	out := outgoingRequest(r.WithContext(ctx))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(out.Header))
+	retryable := isReplayable(out)
+	phases := phasesFrom(ctx)
 
-	c := s.connPool.Get()
+	// Every pooled connection may turn out stale once, e.g. after the client
+	// restarted, so retries are capped by the pool size.
+	for retries := 0; ; retries++ {
+		c, err := s.acquire(ctx)
+		if err != nil {
+			s.traffic.failed()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err, nil
+		}
+		call(phases.ConnectionAcquired)
+
+		err, resp := s.roundTrip(c, out)
+		if err == nil {
+			s.traffic.response(resp.StatusCode)
+			span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+			return nil, resp
+		}
+
+		// A pooled connection may have been closed by the client while it
+		// was idle, idempotent requests are safe to send again.
+		if !retryable || !isStaleConnection(err) || retries >= s.conf.Load().MaxConnsPerClient {
+			s.traffic.failed()
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err, nil
+		}
+		s.logger.Debug().Err(err).Msg("forward connection failed, retrying request")
+	}
+}
+
+func (s *TcpProxyInstance) acquire(ctx context.Context) (forward_connection.ForwardConnection, error) {
+	if s.Draining() {
+		return nil, ErrDraining
+	}
+
+	ctx, span := tracer.Start(ctx, "TcpProxyInstance.acquire")
+	defer span.End()
+
+	c := s.connPool.Get(ctx)
 	attempt := 0
 	for c == nil {
-		if attempt >= 5 {
-			return errors.New("failed to get proxy connection, retries exceeded"), nil
+		conf := s.conf.Load()
+		if attempt >= conf.AcquireRetries {
+			metrics.PoolExhausted.Inc()
+			err := errors.New("failed to get proxy connection, retries exceeded")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
 		}
 
-		time.Sleep(200 * time.Millisecond)
+		time.Sleep(conf.AcquireRetryDelay)
 
-		c = s.connPool.Get()
+		c = s.connPool.Get(ctx)
 		attempt++
 	}
+	span.SetAttributes(attribute.Int("acquire.retries", attempt))
 
-	defer func() {
-		c.Release()
+	return c, nil
+}
+
+func (s *TcpProxyInstance) roundTrip(c forward_connection.ForwardConnection, r *http.Request) (error, *http.Response) {
+	discard := func() {
 		c.Close()
-	}()
+		c.Release()
+	}
+
+	span := trace.SpanFromContext(r.Context())
+	phases := phasesFrom(r.Context())
 
-	err := c.Write(data)
+	bw := bufio.NewWriter(c)
+	err := r.Write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
 	if err != nil {
+		discard()
 		return err, nil
 	}
+	span.AddEvent("request written")
+	call(phases.RequestWritten)
 
-	err, resp := c.Read()
+	resp, err := readResponse(c.Reader(), r)
 	if err != nil {
-		return err, resp
+		discard()
+		return err, nil
 	}
+	span.AddEvent("response headers read")
+	call(phases.ResponseHeaders)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// Like net/http, the body of a 101 response is the upgraded
+		// connection itself, both readable and writable.
+		c.SetIdleTimeout(0)
+		resp.Body = &upgradedBody{Reader: c.Reader(), Writer: c, onClose: discard}
+		return nil, resp
+	}
+
+	keepAlive := reusable(resp)
+	removeHopHeaders(resp.Header)
+	resp.Body = &forwardBody{ReadCloser: resp.Body, onClose: func(eof bool) {
+		if !eof || !keepAlive {
+			discard()
+			return
+		}
+
+		c.Release()
+	}}
 
 	return nil, resp
 }
 
+// readResponse reads the final response to r, skipping informational ones
+// like 100 Continue or 103 Early Hints as net/http's Transport does. Only a
+// 101 ends the exchange early, the connection is switched then.
+func readResponse(br *bufio.Reader, r *http.Request) (*http.Response, error) {
+	for informational := 0; ; informational++ {
+		resp, err := http.ReadResponse(br, r)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode/100 != 1 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		if informational >= maxInformational {
+			return nil, errors.New("too many 1xx informational responses")
+		}
+	}
+}
+
 func (s *TcpProxyInstance) updateActive() {
 	s.lastActive = time.Now()
 }
 
+// listen binds the port clients open forward connections to. Like
+// listenPublic it runs before any goroutine of the instance starts.
 func (s *TcpProxyInstance) listen() error {
 	var err error
 	s.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
 	if err != nil {
-		s.logger.Fatal().Int("port", s.Port).Err(err).Msg("Unable to create listener.")
+		s.logger.Error().Int("port", s.Port).Err(err).Msg("Unable to create listener.")
 		return err
 	}
-	defer s.listener.Close()
 	s.logger.Info().Str("bind", s.listener.Addr().String()).Str("protocol", "tcp").Msg("Listening...")
 
+	return nil
+}
+
+// acceptClients pools the forward connections opened by the client until
+// the listener is closed.
+func (s *TcpProxyInstance) acceptClients() {
+	defer s.listener.Close()
+
 	for {
 		conn, err := s.listener.Accept()
 		if conn == nil {
-			return nil
+			return
 		}
 
 		s.updateActive()
@@ -202,7 +568,7 @@ func (s *TcpProxyInstance) listen() error {
 			continue
 		}
 
-		if s.connPool.Size() >= s.conf.MaxConnsPerClient {
+		if s.connPool.Size() >= s.conf.Load().MaxConnsPerClient {
 			// reject connection after 10 are opened
 			s.logger.Debug().Err(err).Msg("Closing connection as there are too many opened connections for client")
 			err := conn.Close()
@@ -224,14 +590,48 @@ func (s *TcpProxyInstance) listen() error {
 	}
 }
 
-func (s TcpProxyInstance) GetAddr() string {
+func (s *TcpProxyInstance) GetAddr() string {
 	return s.listener.Addr().String()
 }
 
-func (s TcpProxyInstance) Connections() int {
+func (s *TcpProxyInstance) GetPublicAddr() string {
+	switch {
+	case s.publicListener != nil:
+		return s.publicListener.Addr().String()
+	case s.packetConn != nil:
+		return s.packetConn.LocalAddr().String()
+	}
+
+	return ""
+}
+
+func (s *TcpProxyInstance) Connections() int {
 	return s.connPool.Size()
 }
 
-func (s TcpProxyInstance) GetCreatorIP() net.IP {
+func (s *TcpProxyInstance) GetCreatorIP() net.IP {
 	return s.origin.IP()
 }
+
+func (s *TcpProxyInstance) record() registry.Record {
+	o := s.opts
+	o.IPFilter = s.IPFilter()
+	opts, _ := json.Marshal(o)
+
+	r := registry.Record{
+		ID:         s.ID,
+		Kind:       string(s.Kind),
+		Port:       s.Port,
+		PublicPort: s.PublicPort,
+		OriginURL:  s.origin.URL().String(),
+		Owner:      s.Owner,
+		Options:    opts,
+		CreatedAt:  s.CreatedAt,
+		UpdatedAt:  time.Now(),
+	}
+	if ip := s.origin.IP(); ip != nil {
+		r.OriginIP = ip.String()
+	}
+
+	return r
+}
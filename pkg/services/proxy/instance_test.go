@@ -0,0 +1,607 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/rs/zerolog"
+	"go-server/pkg/services/origin"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testConfig() *Config {
+	return &Config{
+		MinPort:                       31000,
+		MaxPort:                       31100,
+		BaseDomain:                    "localhost",
+		MaxConnsPerClient:             4,
+		InactiveHoursTimeout:          24,
+		NoActiveSocketsMinutesTimeout: 10,
+		NoActiveSocketsChecks:         3,
+		InactivityCheckInterval:       time.Hour,
+		PoolGCInterval:                time.Minute,
+		ForwardIdleTimeout:            time.Minute,
+		UdpSessionIdleTimeout:         time.Minute,
+		AcquireRetries:                20,
+		AcquireRetryDelay:             10 * time.Millisecond,
+		InspectBufferSize:             10,
+	}
+}
+
+// newTestInstance starts a tunnel on random ports, it is closed when the
+// test ends.
+func newTestInstance(t *testing.T, opts Options) *TcpProxyInstance {
+	t.Helper()
+
+	if opts.Kind == "" {
+		opts.Kind = KindHTTP
+	}
+
+	u, err := url.Parse("http://test.localhost:3001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewTcpProxyInstance(zerolog.Nop(), 0, 0, NewSharedConfig(testConfig()), "test", origin.NewMeta(u, nil), opts, time.Now(), &ServerBandwidth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.RequestClose)
+
+	return s
+}
+
+// testClient plays the tunnel client, it serves the forward connections of
+// a tunnel with an HTTP handler.
+type testClient struct {
+	m      sync.Mutex
+	conns  []net.Conn
+	opened int
+}
+
+// connectClient opens n forward connections to s, served by h.
+func connectClient(t *testing.T, s *TcpProxyInstance, h http.Handler, n int) *testClient {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testClient{}
+	srv := &http.Server{Handler: h, ConnState: func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			c.m.Lock()
+			c.conns = append(c.conns, conn)
+			c.opened++
+			c.m.Unlock()
+		}
+	}}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.connPool.Append(conn)
+	}
+
+	return c
+}
+
+// closeIdle closes the client side of every forward connection, like a
+// client which restarted.
+func (c *testClient) closeIdle() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+}
+
+func (c *testClient) connections() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.opened
+}
+
+func proxyGet(t *testing.T, s *TcpProxyInstance, method, path string, body io.Reader) (*http.Response, string) {
+	t.Helper()
+
+	r, err := http.NewRequest(method, "http://test.localhost"+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err, resp := s.Proxy(r)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading body: %v", method, path, err)
+	}
+
+	return resp, string(data)
+}
+
+func TestProxyFraming(t *testing.T) {
+	s := newTestInstance(t, Options{})
+	connectClient(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/length":
+			w.Header().Set("Content-Length", "5")
+			w.Write([]byte("hello"))
+		case "/chunked":
+			w.Write([]byte("chunk-1,"))
+			w.(http.Flusher).Flush()
+			w.Write([]byte("chunk-2"))
+		case "/empty":
+			w.WriteHeader(204)
+		case "/echo":
+			io.Copy(w, r.Body)
+		}
+	}), 1)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   io.Reader
+		status int
+		want   string
+	}{
+		{name: "content length", method: "GET", path: "/length", status: 200, want: "hello"},
+		{name: "chunked", method: "GET", path: "/chunked", status: 200, want: "chunk-1,chunk-2"},
+		{name: "no content", method: "GET", path: "/empty", status: 204, want: ""},
+		{name: "head", method: "HEAD", path: "/length", status: 200, want: ""},
+		{name: "request body", method: "POST", path: "/echo", body: strings.NewReader("ping"), status: 200, want: "ping"},
+		{name: "chunked request body", method: "POST", path: "/echo", body: io.MultiReader(strings.NewReader("pi"), strings.NewReader("ng")), status: 200, want: "ping"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := proxyGet(t, s, tt.method, tt.path, tt.body)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if body != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyStreamsResponse(t *testing.T) {
+	s := newTestInstance(t, Options{})
+
+	release := make(chan struct{})
+	connectClient(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second\n"))
+	}), 1)
+	defer close(release)
+
+	r, _ := http.NewRequest("GET", "http://test.localhost/", nil)
+	err, resp := s.Proxy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the handler is still blocked, so the first line must arrive on its own
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "first\n" {
+		t.Errorf("line = %q, want %q", line, "first\n")
+	}
+}
+
+func TestProxyStreamsRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{name: "plain"},
+		// curl sends it for uploads over 1 KB, the client answers 100 first
+		{name: "expect continue", header: http.Header{"Expect": {"100-continue"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, Options{})
+
+			received := make(chan string, 1)
+			connectClient(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				br := bufio.NewReader(r.Body)
+				line, _ := br.ReadString('\n')
+				received <- line
+				n, _ := io.Copy(io.Discard, br)
+				fmt.Fprintf(w, "%s %d", r.URL.Path, int64(len(line))+n)
+			}), 1)
+
+			for _, path := range []string{"/upload", "/again"} {
+				pr, pw := io.Pipe()
+				r, _ := http.NewRequest("POST", "http://test.localhost"+path, pr)
+				for name, values := range tt.header {
+					r.Header[name] = values
+				}
+
+				type result struct {
+					body string
+					err  error
+				}
+				done := make(chan result, 1)
+				go func() {
+					err, resp := s.Proxy(r)
+					if err != nil {
+						done <- result{err: err}
+						return
+					}
+					defer resp.Body.Close()
+					body, err := io.ReadAll(resp.Body)
+					done <- result{body: fmt.Sprintf("%d %s", resp.StatusCode, body), err: err}
+				}()
+
+				pw.Write([]byte("first\n"))
+				select {
+				case line := <-received:
+					if line != "first\n" {
+						t.Errorf("line = %q, want %q", line, "first\n")
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("request body was not streamed to the client")
+				}
+
+				pw.Write([]byte(strings.Repeat("x", 2048)))
+				pw.Close()
+
+				res := <-done
+				if res.err != nil {
+					t.Fatal(res.err)
+				}
+				if want := "200 " + path + " 2054"; res.body != want {
+					t.Errorf("response = %q, want %q", res.body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyResponseHopHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     http.Header
+		dropped  []string
+	}{
+		{
+			name: "final response",
+			response: "HTTP/1.1 200 OK\r\nConnection: keep-alive, X-Hop\r\nKeep-Alive: timeout=5\r\nX-Hop: 1\r\n" +
+				"Proxy-Authenticate: Basic\r\nX-End: 2\r\nContent-Length: 2\r\n\r\nok",
+			want:    http.Header{"X-End": {"2"}},
+			dropped: []string{"Connection", "Keep-Alive", "X-Hop", "Proxy-Authenticate"},
+		},
+		{
+			name:     "chunked",
+			response: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nX-End: 2\r\n\r\n2\r\nok\r\n0\r\n\r\n",
+			want:     http.Header{"X-End": {"2"}},
+			dropped:  []string{"Transfer-Encoding"},
+		},
+		{
+			name:     "switching protocols",
+			response: "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n",
+			want:     http.Header{"Connection": {"Upgrade"}, "Upgrade": {"echo"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, Options{})
+			connectRaw(t, s, func(*http.Request) string { return tt.response })
+
+			r, _ := http.NewRequest("GET", "http://test.localhost/", nil)
+			err, resp := s.Proxy(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			for name, values := range tt.want {
+				if got := resp.Header.Values(name); len(got) != len(values) || got[0] != values[0] {
+					t.Errorf("%s = %q, want %q", name, got, values)
+				}
+			}
+			for _, name := range tt.dropped {
+				if v := resp.Header.Get(name); v != "" {
+					t.Errorf("%s = %q, want it dropped", name, v)
+				}
+			}
+		})
+	}
+}
+
+func TestProxySwitchingProtocols(t *testing.T) {
+	s := newTestInstance(t, Options{})
+	connectClient(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if UpgradeType(r.Header) != "echo" {
+			w.WriteHeader(400)
+			return
+		}
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+
+		line, _ := brw.ReadString('\n')
+		conn.Write([]byte(line))
+	}), 1)
+
+	r, _ := http.NewRequest("GET", "http://test.localhost/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "echo")
+
+	err, resp := s.Proxy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	rw, ok := resp.Body.(io.ReadWriter)
+	if !ok {
+		t.Fatal("body of a 101 response is not writable")
+	}
+
+	rw.Write([]byte("ping\n"))
+	line, err := bufio.NewReader(rw).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "ping\n" {
+		t.Errorf("echo = %q, want %q", line, "ping\n")
+	}
+}
+
+func TestProxyReusesConnections(t *testing.T) {
+	s := newTestInstance(t, Options{})
+	client := connectClient(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}), 1)
+
+	for _, path := range []string{"/a", "/b", "/c", "/d"} {
+		_, body := proxyGet(t, s, "GET", path, nil)
+		if body != path {
+			t.Errorf("body = %q, want %q", body, path)
+		}
+	}
+
+	if n := client.connections(); n != 1 {
+		t.Errorf("client saw %d connections, want 1", n)
+	}
+	if idle, inUse := s.connPool.Counts(); idle != 1 || inUse != 0 {
+		t.Errorf("pool has %d idle and %d used connections, want 1 and 0", idle, inUse)
+	}
+}
+
+func TestProxyRetriesStaleConnections(t *testing.T) {
+	tests := []struct {
+		method  string
+		key     string
+		wantErr bool
+	}{
+		{method: "GET"},
+		{method: "PUT", wantErr: true},
+		{method: "PUT", key: "abc"},
+		{method: "POST", wantErr: true},
+		{method: "DELETE", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		name := tt.method
+		if tt.key != "" {
+			name += " with idempotency key"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newTestInstance(t, Options{})
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			})
+
+			stale := connectClient(t, s, handler, 1)
+			proxyGet(t, s, "GET", "/", nil)
+			stale.closeIdle()
+			connectClient(t, s, handler, 1)
+
+			r, _ := http.NewRequest(tt.method, "http://test.localhost/", nil)
+			if tt.key != "" {
+				r.Header.Set("Idempotency-Key", tt.key)
+			}
+			err, resp := s.Proxy(r)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// connectRaw opens a forward connection to s whose client answers each
+// request with the raw bytes respond returns.
+func connectRaw(t *testing.T, s *TcpProxyInstance, respond func(r *http.Request) string) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	go func() {
+		br := bufio.NewReader(client)
+		for {
+			r, err := http.ReadRequest(br)
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, r.Body)
+			client.Write([]byte(respond(r)))
+		}
+	}()
+
+	s.connPool.Append(server)
+}
+
+func TestProxyInformationalResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		connect func(t *testing.T, s *TcpProxyInstance)
+		header  http.Header
+		wantErr bool
+	}{
+		{
+			name: "100 continue",
+			connect: func(t *testing.T, s *TcpProxyInstance) {
+				connectClient(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body, _ := io.ReadAll(r.Body)
+					w.Write([]byte(r.URL.Path + ":" + string(body)))
+				}), 1)
+			},
+			header: http.Header{"Expect": {"100-continue"}},
+		},
+		{
+			name: "early hints",
+			connect: func(t *testing.T, s *TcpProxyInstance) {
+				connectRaw(t, s, func(r *http.Request) string {
+					body := r.URL.Path + ":" + r.Header.Get("X-Body")
+					return "HTTP/1.1 103 Early Hints\r\nLink: </app.css>; rel=preload\r\n\r\n" +
+						"HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+				})
+			},
+		},
+		{
+			name: "too many informational responses",
+			connect: func(t *testing.T, s *TcpProxyInstance) {
+				connectRaw(t, s, func(r *http.Request) string {
+					return strings.Repeat("HTTP/1.1 100 Continue\r\n\r\n", 10) + "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+				})
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, Options{})
+			tt.connect(t, s)
+
+			// both requests go over the single pooled connection, the second
+			// must not get what is left of the first exchange
+			for _, path := range []string{"/a", "/b"} {
+				r, _ := http.NewRequest("POST", "http://test.localhost"+path, strings.NewReader("hello"))
+				r.Header.Set("X-Body", "hello")
+				for name, values := range tt.header {
+					r.Header[name] = values
+				}
+
+				err, resp := s.Proxy(r)
+				if tt.wantErr {
+					if err == nil {
+						resp.Body.Close()
+						t.Fatal("informational responses were skipped without bound")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", path, err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+
+				if resp.StatusCode != 200 || string(body) != path+":hello" {
+					t.Errorf("%s: got %d %q, want 200 %q", path, resp.StatusCode, body, path+":hello")
+				}
+			}
+
+			if idle, inUse := s.connPool.Counts(); idle != 1 || inUse != 0 {
+				t.Errorf("pool has %d idle and %d used connections, want 1 and 0", idle, inUse)
+			}
+		})
+	}
+}
+
+func TestProxyH2CUpgrade(t *testing.T) {
+	s := newTestInstance(t, Options{})
+	connectClient(t, s, h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}), &http2.Server{}), 1)
+
+	r, _ := http.NewRequest("GET", "http://test.localhost/h2", nil)
+	r.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	r.Header.Set("Upgrade", "h2c")
+	r.Header.Set("HTTP2-Settings", "AAMAAABkAAQAAP__")
+
+	err, resp := s.Proxy(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+
+	// the client answers the upgrade request on stream 1 once it got the
+	// connection preface
+	rw := resp.Body.(io.ReadWriter)
+	rw.Write([]byte(http2.ClientPreface))
+	fr := http2.NewFramer(rw, rw)
+	fr.WriteSettings()
+
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				fr.WriteSettingsAck()
+			}
+		case *http2.DataFrame:
+			if f.StreamID != 1 {
+				continue
+			}
+			if got := string(f.Data()); got != "/h2" {
+				t.Errorf("body = %q, want %q", got, "/h2")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"go-server/pkg/services/metrics"
+	"go-server/pkg/services/ratelimit"
+)
+
+// Allow takes a token from the buckets of the visitor IP and of the tunnel,
+// only when both have one, so a visitor turned away by the tunnel limit
+// keeps its tokens. The result is the stricter of both buckets. Denials are
+// counted in the traffic stats.
+func (s *TcpProxyInstance) Allow(visitorIP string) ratelimit.Result {
+	tunnel, visitor := s.rateLimits()
+
+	res, i := s.limiter.AllowAll(
+		ratelimit.Bucket{Key: "visitor:" + visitorIP, Limit: visitor},
+		ratelimit.Bucket{Key: "tunnel", Limit: tunnel},
+	)
+	if !res.Allowed {
+		scope := "visitor"
+		if i == 1 {
+			scope = "tunnel"
+		}
+
+		s.traffic.limited()
+		metrics.RateLimited.WithLabelValues(scope).Inc()
+	}
+
+	return res
+}
+
+func (s *TcpProxyInstance) rateLimits() (tunnel, visitor ratelimit.Limit) {
+	conf := s.conf.Load()
+	tunnel, visitor = conf.TunnelRateLimit, conf.VisitorRateLimit
+
+	if o := s.opts.RateLimit; o != nil {
+		if o.Tunnel != nil {
+			tunnel = *o.Tunnel
+		}
+		if o.Visitor != nil {
+			visitor = *o.Visitor
+		}
+	}
+
+	return tunnel, visitor
+}
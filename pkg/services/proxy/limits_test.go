@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"go-server/pkg/services/ratelimit"
+	"testing"
+)
+
+func TestInstanceAllow(t *testing.T) {
+	tight := ratelimit.Limit{Rate: 0.001, Burst: 1}
+	loose := ratelimit.Limit{Rate: 0.001, Burst: 100}
+
+	tests := []struct {
+		name      string
+		server    [2]ratelimit.Limit
+		opts      *RateLimits
+		visitors  []string
+		wantAllow []bool
+	}{
+		{
+			name:      "unlimited",
+			visitors:  []string{"10.0.0.1", "10.0.0.1"},
+			wantAllow: []bool{true, true},
+		},
+		{
+			name:      "per visitor",
+			server:    [2]ratelimit.Limit{loose, tight},
+			visitors:  []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"},
+			wantAllow: []bool{true, false, true},
+		},
+		{
+			name:      "per tunnel",
+			server:    [2]ratelimit.Limit{tight, loose},
+			visitors:  []string{"10.0.0.1", "10.0.0.2"},
+			wantAllow: []bool{true, false},
+		},
+		{
+			name:      "tunnel override",
+			server:    [2]ratelimit.Limit{tight, tight},
+			opts:      &RateLimits{Tunnel: &loose, Visitor: &loose},
+			visitors:  []string{"10.0.0.1", "10.0.0.1"},
+			wantAllow: []bool{true, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, Options{RateLimit: tt.opts})
+			c := *s.conf.Load()
+			c.TunnelRateLimit, c.VisitorRateLimit = tt.server[0], tt.server[1]
+			s.conf.Store(&c)
+
+			denied := uint64(0)
+			for i, ip := range tt.visitors {
+				res := s.Allow(ip)
+				if res.Allowed != tt.wantAllow[i] {
+					t.Errorf("visitor %d (%s): allowed = %v, want %v", i, ip, res.Allowed, tt.wantAllow[i])
+				}
+				if !res.Allowed {
+					denied++
+				}
+			}
+
+			if got := s.Traffic().RateLimited; got != denied {
+				t.Errorf("RateLimited = %d, want %d", got, denied)
+			}
+		})
+	}
+}
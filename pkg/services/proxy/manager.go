@@ -1,70 +1,284 @@
 package proxy
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/rs/zerolog"
 	"go-server/pkg/services"
+	"go-server/pkg/services/domains"
+	"go-server/pkg/services/ipfilter"
+	"go-server/pkg/services/metrics"
 	"go-server/pkg/services/origin"
+	"go-server/pkg/services/registry"
+	"net"
+	"net/url"
 	"sync"
+	"time"
 )
 
 type ConnectionStats struct {
 	ID          string
+	Kind        Kind
+	Owner       string
 	Addr        string
+	PublicAddr  string
 	Connections int
+	UDP         *UdpStats
+	Traffic     TrafficStats
+	Bandwidth   BandwidthStats
 }
 
+// ErrShuttingDown is returned by New once Shutdown was called.
+var ErrShuttingDown = errors.New("server is shutting down")
+
 type TcpProxyManager struct {
 	logger zerolog.Logger
 
-	conf *Config
+	conf    *SharedConfig
+	store   registry.Store
+	domains *domains.Registry
+
+	// bandwidth is shared by the instances for the server-wide caps.
+	bandwidth *ServerBandwidth
 
 	createMut  *sync.RWMutex
 	instances  map[string]*TcpProxyInstance
 	takenPorts map[int]string
+
+	// shuttingDown stops new tunnels and keeps the registry records of
+	// tunnels closed by Shutdown, so they come back after a restart.
+	shuttingDown bool
 }
 
-func NewTcpProxyManager(logger zerolog.Logger, proxyConf *Config) *TcpProxyManager {
+// NewTcpProxyManager creates the manager, domainRegistry may be nil to
+// route visitors by tunnel subdomain only.
+func NewTcpProxyManager(logger zerolog.Logger, proxyConf *Config, store registry.Store, domainRegistry *domains.Registry) *TcpProxyManager {
 	return &TcpProxyManager{
 		logger:     logger,
 		instances:  make(map[string]*TcpProxyInstance),
 		takenPorts: make(map[int]string),
-		conf:       proxyConf,
+		conf:       NewSharedConfig(proxyConf),
+		store:      store,
+		domains:    domainRegistry,
+		bandwidth:  &ServerBandwidth{},
 		createMut:  &sync.RWMutex{},
 	}
 }
 
-func (t *TcpProxyManager) New(tunnelId string, origin *origin.Meta) *TcpProxyInstance {
-	if len(t.instances) >= t.conf.MaxClients() {
-		return nil
+// New creates a tunnel on free ports and saves it to the registry, nothing
+// is kept when its ports can't be allocated or bound.
+func (t *TcpProxyManager) New(tunnelId string, origin *origin.Meta, opts Options) (*TcpProxyInstance, error) {
+	t.createMut.Lock()
+	defer t.createMut.Unlock()
+
+	if t.shuttingDown {
+		return nil, ErrShuttingDown
+	}
+
+	if len(t.takenPorts)+1+opts.Kind.publicPorts() > t.conf.Load().MaxClients() {
+		metrics.PortAllocationFailures.Inc()
+		return nil, services.ErrNoFreePort
+	}
+
+	port, err := t.allocatePort(tunnelId)
+	if err != nil {
+		t.logger.Error().Err(err).Str("tunnel-id", tunnelId).Msg("failed to allocate port")
+		metrics.PortAllocationFailures.Inc()
+		return nil, err
+	}
+
+	publicPort := 0
+	if opts.Kind.publicPorts() > 0 {
+		publicPort, err = t.allocatePort(tunnelId)
+		if err != nil {
+			t.logger.Error().Err(err).Str("tunnel-id", tunnelId).Msg("failed to allocate public port")
+			metrics.PortAllocationFailures.Inc()
+			delete(t.takenPorts, port)
+			return nil, err
+		}
+	}
+
+	instance, err := t.start(tunnelId, port, publicPort, origin, opts, time.Now())
+	if err != nil {
+		t.logger.Error().Err(err).Str("tunnel-id", tunnelId).Msg("failed to start tunnel")
+		return nil, err
+	}
+
+	err = t.store.Save(instance.record())
+	if err != nil {
+		t.logger.Error().Err(err).Str("tunnel-id", tunnelId).Msg("failed to save tunnel to registry")
+	}
+
+	return instance, nil
+}
+
+// Restore re-creates the tunnels found in the registry on the same ports,
+// so clients reconnecting after a restart keep their URLs.
+func (t *TcpProxyManager) Restore() error {
+	records, err := t.store.List()
+	if err != nil {
+		return err
 	}
 
 	t.createMut.Lock()
 	defer t.createMut.Unlock()
-	port := services.GenerateOpenedPortNumber(t.conf.MinPort, t.conf.MaxPort)
-	for {
-		_, ok := t.takenPorts[port]
-		if !ok {
-			break
+
+	for _, r := range records {
+		err := t.restore(r)
+		if err != nil {
+			t.logger.Error().Err(err).Str("tunnel-id", r.ID).Msg("failed to restore tunnel, dropping it")
+
+			err = t.store.Delete(r.ID)
+			if err != nil {
+				t.logger.Error().Err(err).Str("tunnel-id", r.ID).Msg("failed to delete tunnel from registry")
+			}
+			continue
+		}
+
+		t.logger.Info().Str("tunnel-id", r.ID).Int("port", r.Port).Msg("restored tunnel")
+	}
+
+	return nil
+}
+
+func (t *TcpProxyManager) restore(r registry.Record) error {
+	opts := Options{}
+	if len(r.Options) != 0 {
+		err := json.Unmarshal(r.Options, &opts)
+		if err != nil {
+			return err
+		}
+	}
+	opts.Kind = Kind(r.Kind)
+	opts.Owner = r.Owner
+
+	originURL, err := url.Parse(r.OriginURL)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := t.instances[r.ID]; ok {
+		return fmt.Errorf("tunnel %s already exists", r.ID)
+	}
+	for _, port := range []int{r.Port, r.PublicPort} {
+		if _, ok := t.takenPorts[port]; ok && port != 0 {
+			return fmt.Errorf("port %d is already taken", port)
 		}
+	}
+
+	t.takenPorts[r.Port] = r.ID
+	if r.PublicPort != 0 {
+		t.takenPorts[r.PublicPort] = r.ID
+	}
 
-		port = services.GenerateOpenedPortNumber(t.conf.MinPort, t.conf.MaxPort)
+	_, err = t.start(r.ID, r.Port, r.PublicPort, origin.NewMeta(originURL, net.ParseIP(r.OriginIP)), opts, r.CreatedAt)
+
+	return err
+}
+
+// start creates the instance on already taken ports and frees them once it
+// closes, or right away if it fails to bind them. It must be called with
+// createMut held.
+func (t *TcpProxyManager) start(tunnelId string, port, publicPort int, origin *origin.Meta, opts Options, createdAt time.Time) (*TcpProxyInstance, error) {
+	instance, err := NewTcpProxyInstance(t.logger, port, publicPort, t.conf, tunnelId, origin, opts, createdAt, t.bandwidth)
+	if err != nil {
+		delete(t.takenPorts, port)
+		if publicPort != 0 {
+			delete(t.takenPorts, publicPort)
+		}
+		return nil, err
 	}
-	t.takenPorts[port] = tunnelId
+	t.instances[tunnelId] = instance
+	metrics.TunnelsOpened.WithLabelValues(string(opts.Kind)).Inc()
 
-	t.instances[tunnelId] = NewTcpProxyInstance(t.logger, port, t.conf, tunnelId, origin)
 	go func() {
 		onClose := make(chan struct{}, 1)
 
-		t.instances[tunnelId].SubscribeOnClose(onClose)
+		instance.SubscribeOnClose(onClose)
 		<-onClose
 
+		metrics.TunnelsClosed.WithLabelValues(string(opts.Kind)).Inc()
+
 		t.logger.Info().Str("tunnel-id", tunnelId).Msg("clearing resources after close")
 
+		t.createMut.Lock()
+		defer t.createMut.Unlock()
+
 		delete(t.instances, tunnelId)
 		delete(t.takenPorts, port)
+		if publicPort != 0 {
+			delete(t.takenPorts, publicPort)
+		}
+
+		if t.shuttingDown {
+			return
+		}
+
+		err := t.store.Delete(tunnelId)
+		if err != nil {
+			t.logger.Error().Err(err).Str("tunnel-id", tunnelId).Msg("failed to delete tunnel from registry")
+		}
 	}()
 
-	return t.instances[tunnelId]
+	return instance, nil
+}
+
+// Shutdown stops creating tunnels and drains all running ones, giving
+// in-flight visitors until ctx is done.
+func (t *TcpProxyManager) Shutdown(ctx context.Context) {
+	t.createMut.Lock()
+	t.shuttingDown = true
+	instances := make([]*TcpProxyInstance, 0, len(t.instances))
+	for _, instance := range t.instances {
+		instances = append(instances, instance)
+	}
+	t.createMut.Unlock()
+
+	timeout := 30 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	wg := sync.WaitGroup{}
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance *TcpProxyInstance) {
+			defer wg.Done()
+			instance.Drain(timeout)
+		}(instance)
+	}
+	wg.Wait()
+}
+
+func (t *TcpProxyManager) ShuttingDown() bool {
+	t.createMut.RLock()
+	defer t.createMut.RUnlock()
+
+	return t.shuttingDown
+}
+
+// allocatePort picks a free port from the configured range and marks it as
+// taken by the tunnel. It must be called with createMut held.
+func (t *TcpProxyManager) allocatePort(tunnelId string) (int, error) {
+	conf := t.conf.Load()
+
+	for attempt := 0; attempt < 4*conf.MaxClients(); attempt++ {
+		port, err := services.GenerateOpenedPortNumber(conf.MinPort, conf.MaxPort)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, ok := t.takenPorts[port]; ok {
+			continue
+		}
+
+		t.takenPorts[port] = tunnelId
+		return port, nil
+	}
+
+	return 0, services.ErrNoFreePort
 }
 
 func (t *TcpProxyManager) Exists(host string) bool {
@@ -81,6 +295,77 @@ func (t *TcpProxyManager) Get(host string) *TcpProxyInstance {
 	return v
 }
 
+// HostTunnel finds the tunnel a Host header addresses, a verified custom
+// domain first, then the tunnel subdomain.
+func (t *TcpProxyManager) HostTunnel(host string) *TcpProxyInstance {
+	if instance := t.domainTunnel(host); instance != nil {
+		return instance
+	}
+
+	if !services.IsTunnelHost(host, t.BaseDomain()) {
+		return nil
+	}
+
+	return t.Get(services.GetTunnelNameFromHost(host))
+}
+
+// domainTunnel finds the tunnel of a verified custom domain. The tunnel
+// must still belong to whoever added the domain, a tunnel created again
+// under the same name by someone else doesn't get its visitors.
+func (t *TcpProxyManager) domainTunnel(host string) *TcpProxyInstance {
+	if t.domains == nil {
+		return nil
+	}
+
+	id, owner, ok := t.domains.Lookup(host)
+	if !ok {
+		return nil
+	}
+
+	instance := t.Get(id)
+	if instance == nil || owner == "" || instance.Owner != owner {
+		return nil
+	}
+
+	return instance
+}
+
+// Passthrough finds the TLS passthrough tunnel a SNI server name belongs
+// to, using the same name lookup as HTTP visitors.
+func (t *TcpProxyManager) Passthrough(serverName string) *TcpProxyInstance {
+	instance := t.domainTunnel(serverName)
+	if instance == nil {
+		instance = t.Get(services.GetTunnelNameFromHost(serverName))
+	}
+	if instance == nil || instance.Kind != KindTLS {
+		return nil
+	}
+
+	return instance
+}
+
+func (t *TcpProxyManager) BaseDomain() string {
+	return t.conf.Load().BaseDomain
+}
+
+func (t *TcpProxyManager) Config() *Config {
+	return t.conf.Load()
+}
+
+// Reload swaps the config of the manager and all running tunnels. Tunnels
+// keep their ports even if they fall outside of a new port range.
+func (t *TcpProxyManager) Reload(c *Config) {
+	t.createMut.RLock()
+	defer t.createMut.RUnlock()
+
+	t.conf.Store(c)
+	for _, instance := range t.instances {
+		instance.connPool.SetTimings(c.PoolGCInterval, c.ForwardIdleTimeout)
+	}
+
+	t.logger.Info().Msg("reloaded proxy config")
+}
+
 func (t TcpProxyManager) GetRunning() int {
 	t.createMut.RLock()
 	defer t.createMut.RUnlock()
@@ -94,12 +379,49 @@ func (t TcpProxyManager) GetConnectionsStats() []ConnectionStats {
 	details := make([]ConnectionStats, 0, len(t.instances))
 
 	for _, instance := range t.instances {
-		details = append(details, ConnectionStats{
-			ID:          instance.ID,
-			Connections: instance.Connections(),
-			Addr:        instance.GetAddr(),
-		})
+		details = append(details, instance.stats())
 	}
 
 	return details
 }
+
+// GetConnectionStats returns the stats of a single tunnel, false if it
+// doesn't exist.
+func (t *TcpProxyManager) GetConnectionStats(id string) (ConnectionStats, bool) {
+	instance := t.Get(id)
+	if instance == nil {
+		return ConnectionStats{}, false
+	}
+
+	return instance.stats(), true
+}
+
+// SetIPFilter changes the IP filter of a running tunnel and keeps it in the
+// registry.
+func (t *TcpProxyManager) SetIPFilter(instance *TcpProxyInstance, rules *ipfilter.Rules) error {
+	err := instance.SetIPFilter(rules)
+	if err != nil {
+		return err
+	}
+
+	err = t.store.Save(instance.record())
+	if err != nil {
+		t.logger.Error().Err(err).Str("tunnel-id", instance.ID).Msg("failed to save tunnel to registry")
+	}
+
+	return nil
+}
+
+func (s *TcpProxyInstance) stats() ConnectionStats {
+	return ConnectionStats{
+		ID:          s.ID,
+		Kind:        s.Kind,
+		Owner:       s.Owner,
+		Connections: s.Connections(),
+		Addr:        s.GetAddr(),
+		PublicAddr:  s.GetPublicAddr(),
+		UDP:         s.UdpStats(),
+		Traffic:     s.Traffic(),
+		Bandwidth:   s.BandwidthStats(),
+	}
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"go-server/pkg/services/origin"
+	"go-server/pkg/services/registry"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// freePort returns a port nothing listens on right now.
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// holdPort binds a port on network like another process would, until the
+// test ends.
+func holdPort(t *testing.T, network string) int {
+	t.Helper()
+
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// newTestManager runs a manager on a registry file, its tunnels are shut
+// down when the test ends.
+func newTestManager(t *testing.T) (*TcpProxyManager, registry.Store) {
+	t.Helper()
+
+	store, err := registry.NewBoltStore(filepath.Join(t.TempDir(), "registry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewTcpProxyManager(zerolog.Nop(), testConfig(), store, nil)
+	t.Cleanup(func() {
+		m.createMut.RLock()
+		for _, instance := range m.instances {
+			instance.RequestClose()
+		}
+		m.createMut.RUnlock()
+		store.Close()
+	})
+
+	return m, store
+}
+
+func TestRestore(t *testing.T) {
+	m, store := newTestManager(t)
+
+	created := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	webPort, dnsPort, dnsPublicPort := freePort(t), freePort(t), freePort(t)
+
+	records := []registry.Record{
+		{ID: "web", Kind: "http", Port: webPort, OriginURL: "http://web.localhost:3001", Owner: "k1", Options: []byte(`{"inspect":true}`), CreatedAt: created},
+		{ID: "dns", Kind: "udp", Port: dnsPort, PublicPort: dnsPublicPort, OriginURL: "http://dns.localhost:3001", CreatedAt: created},
+		// records are restored by ID, the one sorting later loses the port
+		{ID: "web-clash", Kind: "http", Port: webPort, OriginURL: "http://web-clash.localhost:3001", CreatedAt: created},
+		{ID: "broken", Kind: "http", Port: freePort(t), OriginURL: "http://[broken", CreatedAt: created},
+		{ID: "held", Kind: "tcp", Port: freePort(t), PublicPort: holdPort(t, "tcp"), OriginURL: "http://held.localhost:3001", CreatedAt: created},
+	}
+	for _, r := range records {
+		if err := store.Save(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := m.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id         string
+		restored   bool
+		port       int
+		publicPort int
+		owner      string
+		inspect    bool
+	}{
+		{id: "web", restored: true, port: webPort, owner: "k1", inspect: true},
+		{id: "dns", restored: true, port: dnsPort, publicPort: dnsPublicPort},
+		{id: "web-clash", restored: false},
+		{id: "broken", restored: false},
+		{id: "held", restored: false},
+	}
+
+	saved, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inStore := map[string]bool{}
+	for _, r := range saved {
+		inStore[r.ID] = true
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			instance := m.Get(tt.id)
+			if (instance != nil) != tt.restored {
+				t.Fatalf("restored = %v, want %v", instance != nil, tt.restored)
+			}
+			if inStore[tt.id] != tt.restored {
+				t.Errorf("in registry = %v, want %v", inStore[tt.id], tt.restored)
+			}
+			if !tt.restored {
+				for port, id := range m.takenPorts {
+					if id == tt.id {
+						t.Errorf("port %d still taken by the dropped tunnel", port)
+					}
+				}
+				return
+			}
+
+			if instance.Port != tt.port || instance.PublicPort != tt.publicPort {
+				t.Errorf("ports = %d/%d, want %d/%d", instance.Port, instance.PublicPort, tt.port, tt.publicPort)
+			}
+			if !instance.CreatedAt.Equal(created) {
+				t.Errorf("CreatedAt = %v, want the recorded %v", instance.CreatedAt, created)
+			}
+			if instance.Owner != tt.owner || instance.opts.Inspect != tt.inspect {
+				t.Errorf("owner %q inspect %v, want %q %v", instance.Owner, instance.opts.Inspect, tt.owner, tt.inspect)
+			}
+			if r := instance.record(); !r.CreatedAt.Equal(created) {
+				t.Errorf("record CreatedAt = %v, a restore must not reset it", r.CreatedAt)
+			}
+		})
+	}
+}
+
+func TestNewTcpProxyInstanceBindFailure(t *testing.T) {
+	u, _ := url.Parse("http://test.localhost:3001")
+
+	tests := []struct {
+		name       string
+		kind       Kind
+		port       int
+		publicPort int
+	}{
+		{name: "client port", kind: KindHTTP, port: holdPort(t, "tcp")},
+		{name: "public tcp port", kind: KindTCP, port: freePort(t), publicPort: holdPort(t, "tcp")},
+		{name: "public udp port", kind: KindUDP, port: freePort(t), publicPort: holdPort(t, "udp")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewTcpProxyInstance(zerolog.Nop(), tt.port, tt.publicPort, NewSharedConfig(testConfig()), "test", origin.NewMeta(u, nil), Options{Kind: tt.kind}, time.Now(), &ServerBandwidth{})
+			if err == nil {
+				s.RequestClose()
+				t.Fatal("tunnel created on a port already in use")
+			}
+			if s != nil {
+				t.Error("instance returned with the error")
+			}
+
+			// the client port bound before the failure is released
+			if tt.kind != KindHTTP {
+				ln, err := net.Listen("tcp", fmt.Sprintf(":%d", tt.port))
+				if err != nil {
+					t.Fatalf("client port not released: %v", err)
+				}
+				ln.Close()
+			}
+		})
+	}
+}
+
+func TestNewBindFailure(t *testing.T) {
+	m, store := newTestManager(t)
+	u, _ := url.Parse("http://test.localhost:3001")
+
+	// the range has room for a tcp tunnel but one of its ports is in use
+	port := holdPort(t, "tcp")
+	m.conf.Store(&Config{MinPort: port, MaxPort: port + 2, BaseDomain: "localhost", MaxConnsPerClient: 4, InactiveHoursTimeout: 24})
+
+	instance, err := m.New("held", origin.NewMeta(u, nil), Options{Kind: KindTCP})
+	if err == nil {
+		t.Fatal("tunnel created on a port already in use")
+	}
+	if instance != nil {
+		t.Error("instance returned with the error")
+	}
+	if m.Exists("held") {
+		t.Error("failed tunnel is registered")
+	}
+	if len(m.takenPorts) != 0 {
+		t.Errorf("ports still taken: %v", m.takenPorts)
+	}
+
+	records, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Errorf("failed tunnel saved to the registry: %+v", records)
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"go-server/pkg/services/metrics"
+)
+
+var (
+	tunnelsRunningDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "tunnels_running"),
+		"Tunnels currently running.",
+		[]string{"kind"}, nil,
+	)
+
+	forwardConnectionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metrics.Namespace, "", "forward_connections"),
+		"Forward connections of running tunnels, idle or in use by a visitor.",
+		[]string{"tunnel", "state"}, nil,
+	)
+)
+
+// Collector exports the running tunnels of a manager at scrape time.
+type Collector struct {
+	manager *TcpProxyManager
+}
+
+func NewCollector(manager *TcpProxyManager) *Collector {
+	return &Collector{manager: manager}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tunnelsRunningDesc
+	ch <- forwardConnectionsDesc
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.manager.createMut.RLock()
+	defer c.manager.createMut.RUnlock()
+
+	running := map[Kind]int{KindHTTP: 0, KindTCP: 0, KindUDP: 0, KindTLS: 0}
+	for id, instance := range c.manager.instances {
+		running[instance.Kind]++
+
+		idle, inUse := instance.connPool.Counts()
+		ch <- prometheus.MustNewConstMetric(forwardConnectionsDesc, prometheus.GaugeValue, float64(idle), id, "idle")
+		ch <- prometheus.MustNewConstMetric(forwardConnectionsDesc, prometheus.GaugeValue, float64(inUse), id, "in_use")
+	}
+
+	for kind, n := range running {
+		ch <- prometheus.MustNewConstMetric(tunnelsRunningDesc, prometheus.GaugeValue, float64(n), string(kind))
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go-server/pkg/services/metrics"
+	"go-server/pkg/services/origin"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCollector(t *testing.T) {
+	m, _ := newTestManager(t)
+	u, _ := url.Parse("http://test.localhost:3001")
+
+	opened := testutil.ToFloat64(metrics.TunnelsOpened.WithLabelValues("http"))
+
+	web, err := m.New("web", origin.NewMeta(u, nil), Options{Kind: KindHTTP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.New("raw", origin.NewMeta(u, nil), Options{Kind: KindTCP}); err != nil {
+		t.Fatal(err)
+	}
+	connectClient(t, web, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), 2)
+
+	if got := testutil.ToFloat64(metrics.TunnelsOpened.WithLabelValues("http")) - opened; got != 1 {
+		t.Errorf("tunnels_opened_total{kind=http} grew by %v, want 1", got)
+	}
+
+	tests := []struct {
+		name   string
+		metric string
+		want   string
+	}{
+		{
+			name:   "running",
+			metric: "greencobra_tunnels_running",
+			want: `
+# HELP greencobra_tunnels_running Tunnels currently running.
+# TYPE greencobra_tunnels_running gauge
+greencobra_tunnels_running{kind="http"} 1
+greencobra_tunnels_running{kind="tcp"} 1
+greencobra_tunnels_running{kind="tls"} 0
+greencobra_tunnels_running{kind="udp"} 0
+`,
+		},
+		{
+			name:   "forward connections",
+			metric: "greencobra_forward_connections",
+			want: `
+# HELP greencobra_forward_connections Forward connections of running tunnels, idle or in use by a visitor.
+# TYPE greencobra_forward_connections gauge
+greencobra_forward_connections{state="idle",tunnel="raw"} 0
+greencobra_forward_connections{state="idle",tunnel="web"} 2
+greencobra_forward_connections{state="in_use",tunnel="raw"} 0
+greencobra_forward_connections{state="in_use",tunnel="web"} 0
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testutil.CollectAndCompare(NewCollector(m), strings.NewReader(tt.want), tt.metric)
+			if err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"fmt"
+	"go-server/pkg/services/auth"
+	"go-server/pkg/services/ipfilter"
+	"go-server/pkg/services/ratelimit"
+)
+
+// Kind tells how visitors reach a tunnel.
+type Kind string
+
+const (
+	// KindHTTP tunnels are reached through the API listener, routed by host.
+	KindHTTP Kind = "http"
+	// KindTCP tunnels get a dedicated public port, visitor connections are
+	// spliced byte-for-byte onto forward connections.
+	KindTCP Kind = "tcp"
+	// KindUDP tunnels get a dedicated public UDP port, datagrams are framed
+	// over forward connections with a length prefix.
+	KindUDP Kind = "udp"
+	// KindTLS tunnels share the public TLS port with terminated HTTPS, the
+	// TLS stream is routed by SNI and passed through without decryption.
+	KindTLS Kind = "tls"
+)
+
+// Options are the per-tunnel settings chosen when a tunnel is created.
+type Options struct {
+	Kind Kind `json:"kind"`
+
+	// Owner is the ID of the API key which created the tunnel, empty for
+	// anonymous tunnels.
+	Owner string `json:"owner,omitempty"`
+
+	RateLimit *RateLimits `json:"rate_limit,omitempty"`
+	Bandwidth *Bandwidth  `json:"bandwidth,omitempty"`
+
+	// Inspect keeps the recent requests of an HTTP tunnel for debugging.
+	Inspect bool `json:"inspect,omitempty"`
+
+	// Auth are the credentials visitors of an HTTP tunnel must send.
+	Auth *auth.VisitorAuth `json:"auth,omitempty"`
+
+	// IPFilter limits the visitor IPs of the tunnel, it can be changed
+	// while the tunnel runs.
+	IPFilter *ipfilter.Rules `json:"ip_filter,omitempty"`
+}
+
+// RateLimits override the server-wide rate limits of a tunnel, nil ones
+// keep the server setting.
+type RateLimits struct {
+	// Tunnel limits all visitors of the tunnel together.
+	Tunnel *ratelimit.Limit `json:"tunnel,omitempty"`
+	// Visitor limits each visitor IP on its own.
+	Visitor *ratelimit.Limit `json:"visitor,omitempty"`
+}
+
+func (r *RateLimits) Validate() error {
+	for _, l := range []*ratelimit.Limit{r.Tunnel, r.Visitor} {
+		if l == nil {
+			continue
+		}
+
+		err := l.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ParseKind(s string) (Kind, error) {
+	switch Kind(s) {
+	case "", KindHTTP:
+		return KindHTTP, nil
+	case KindTCP:
+		return KindTCP, nil
+	case KindUDP:
+		return KindUDP, nil
+	case KindTLS:
+		return KindTLS, nil
+	}
+
+	return "", fmt.Errorf("unknown tunnel type: %q", s)
+}
+
+// publicPorts is the number of public ports a tunnel of this kind listens
+// on in addition to its forward connections port.
+func (k Kind) publicPorts() int {
+	if k == KindTCP || k == KindUDP {
+		return 1
+	}
+
+	return 0
+}
+
+// Bandwidth caps the traffic of a tunnel in bytes per second. Upload is
+// visitors sending to the client, Download the client answering them.
+type Bandwidth struct {
+	Upload   *ratelimit.Limit `json:"upload,omitempty"`
+	Download *ratelimit.Limit `json:"download,omitempty"`
+}
+
+// Validate checks the requested caps against the maximums of the server.
+func (b *Bandwidth) Validate(maxUpload, maxDownload ratelimit.Limit) error {
+	if b.Upload != nil {
+		err := b.Upload.Validate()
+		if err != nil {
+			return err
+		}
+		if !b.Upload.Within(maxUpload) {
+			return fmt.Errorf("upload bandwidth exceeds the maximum of %.0f bytes/s", maxUpload.Rate)
+		}
+	}
+
+	if b.Download != nil {
+		err := b.Download.Validate()
+		if err != nil {
+			return err
+		}
+		if !b.Download.Within(maxDownload) {
+			return fmt.Errorf("download bandwidth exceeds the maximum of %.0f bytes/s", maxDownload.Rate)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import "context"
+
+// Phases are called as Proxy moves a request along, in the way
+// httptrace.ClientTrace works for net/http. Any hook may be nil.
+type Phases struct {
+	// ConnectionAcquired is called once a forward connection was taken
+	// from the pool, again if the request is retried on another one.
+	ConnectionAcquired func()
+	// RequestWritten is called once the request was sent to the client.
+	RequestWritten func()
+	// ResponseHeaders is called once the response headers were read.
+	ResponseHeaders func()
+}
+
+type phasesKey struct{}
+
+// WithPhases returns a context whose requests report to p when proxied.
+func WithPhases(ctx context.Context, p *Phases) context.Context {
+	return context.WithValue(ctx, phasesKey{}, p)
+}
+
+func phasesFrom(ctx context.Context) *Phases {
+	p, _ := ctx.Value(phasesKey{}).(*Phases)
+	if p == nil {
+		return &Phases{}
+	}
+
+	return p
+}
+
+func call(hook func()) {
+	if hook != nil {
+		hook()
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+// listenPublic binds the public port of a raw TCP tunnel. It runs before
+// any goroutine of the instance starts, so publicListener is never written
+// concurrently with close or GetPublicAddr.
+func (s *TcpProxyInstance) listenPublic() error {
+	var err error
+	s.publicListener, err = net.Listen("tcp", fmt.Sprintf(":%d", s.PublicPort))
+	if err != nil {
+		s.logger.Error().Int("port", s.PublicPort).Err(err).Msg("Unable to create public listener.")
+		return err
+	}
+	s.logger.Info().Str("bind", s.publicListener.Addr().String()).Str("protocol", "tcp").Msg("Listening for visitors...")
+
+	return nil
+}
+
+// acceptPublic accepts visitors on the public listener until it is closed.
+func (s *TcpProxyInstance) acceptPublic() {
+	defer s.publicListener.Close()
+
+	for {
+		conn, err := s.publicListener.Accept()
+		if conn == nil {
+			return
+		}
+		if err != nil {
+			s.logger.Debug().Err(err).Msg("Error while accepting visitor connection.")
+			continue
+		}
+
+		go s.Splice(conn)
+	}
+}
+
+// Splice connects a visitor to a forward connection and copies bytes both
+// ways until either side closes. The forward connection carries an opaque
+// stream afterwards, so it is discarded instead of going back to the pool.
+func (s *TcpProxyInstance) Splice(visitor net.Conn) {
+	defer visitor.Close()
+
+	s.updateActive()
+
+	host, _, _ := net.SplitHostPort(visitor.RemoteAddr().String())
+	if !s.Permit(host) {
+		s.logger.Debug().Str("visitor", visitor.RemoteAddr().String()).Msg("visitor connection denied")
+		return
+	}
+	if !s.Allow(host).Allowed {
+		s.logger.Debug().Str("visitor", visitor.RemoteAddr().String()).Msg("visitor connection rate limited")
+		return
+	}
+
+	s.traffic.visit()
+
+	c, err := s.acquire(context.Background())
+	if err != nil {
+		s.traffic.failed()
+		s.logger.Warn().Err(err).Str("visitor", visitor.RemoteAddr().String()).Msg("failed to splice visitor connection")
+		return
+	}
+	defer func() {
+		c.Close()
+		c.Release()
+	}()
+
+	c.SetIdleTimeout(0)
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(c, visitor)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(visitor, c)
+		errc <- err
+	}()
+
+	err = <-errc
+	if err != nil {
+		s.logger.Debug().Err(err).Msg("spliced connection closed")
+	}
+
+	s.updateActive()
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"bytes"
+	"go-server/pkg/services/ipfilter"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connectEcho opens n forward connections to s whose client echoes every
+// byte back, like a raw TCP service behind the tunnel.
+func connectEcho(t *testing.T, s *TcpProxyInstance, n int) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.connPool.Append(conn)
+	}
+}
+
+func TestSplice(t *testing.T) {
+	tests := []struct {
+		name     string
+		ipFilter *ipfilter.Rules
+		payload  []byte
+		wantEcho bool
+	}{
+		{name: "short", payload: []byte("ping"), wantEcho: true},
+		{name: "large", payload: bytes.Repeat([]byte("0123456789"), 100_000), wantEcho: true},
+		{name: "denied visitor", ipFilter: &ipfilter.Rules{Deny: []string{"127.0.0.1"}}, payload: []byte("ping"), wantEcho: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestInstance(t, Options{Kind: KindTCP, IPFilter: tt.ipFilter})
+			connectEcho(t, s, 1)
+
+			_, port, _ := net.SplitHostPort(s.GetPublicAddr())
+			visitor, err := net.Dial("tcp", "127.0.0.1:"+port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer visitor.Close()
+			visitor.SetDeadline(time.Now().Add(5 * time.Second))
+
+			go visitor.Write(tt.payload)
+
+			got := make([]byte, len(tt.payload))
+			_, err = io.ReadFull(visitor, got)
+			if !tt.wantEcho {
+				if err == nil {
+					t.Error("denied visitor got an echo")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.payload) {
+				t.Error("echo differs from the payload")
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.InMemoryExporter
+)
+
+// recordSpans installs a global tracer provider keeping spans in memory, the
+// package tracer only picks up the first provider set.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	spansOnce.Do(func() {
+		spans = tracetest.NewInMemoryExporter()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	spans.Reset()
+
+	return spans
+}
+
+func TestProxyTracing(t *testing.T) {
+	exporter := recordSpans(t)
+
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	tests := []struct {
+		name       string
+		clients    int
+		wantStatus codes.Code
+	}{
+		{name: "proxied", clients: 1, wantStatus: codes.Unset},
+		{name: "no forward connection", clients: 0, wantStatus: codes.Error},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter.Reset()
+			s := newTestInstance(t, Options{})
+
+			traceparent := make(chan string, 1)
+			if tt.clients > 0 {
+				connectClient(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					traceparent <- r.Header.Get("Traceparent")
+				}), tt.clients)
+			}
+
+			r, _ := http.NewRequest("GET", "http://test.localhost/", nil)
+			r = r.WithContext(trace.ContextWithSpanContext(context.Background(), parent))
+			err, resp := s.Proxy(r)
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			var proxySpan, acquireSpan sdktrace.ReadOnlySpan
+			for _, stub := range exporter.GetSpans().Snapshots() {
+				switch stub.Name() {
+				case "TcpProxyInstance.Proxy":
+					proxySpan = stub
+				case "TcpProxyInstance.acquire":
+					acquireSpan = stub
+				}
+			}
+			if proxySpan == nil || acquireSpan == nil {
+				t.Fatalf("spans = %v, want Proxy and acquire", exporter.GetSpans())
+			}
+
+			if proxySpan.Parent().SpanID() != parent.SpanID() || proxySpan.SpanContext().TraceID() != parent.TraceID() {
+				t.Error("Proxy span is not a child of the visitor's span")
+			}
+			if acquireSpan.Parent().SpanID() != proxySpan.SpanContext().SpanID() {
+				t.Error("acquire span is not a child of the Proxy span")
+			}
+			if proxySpan.SpanKind() != trace.SpanKindClient {
+				t.Errorf("kind = %v, want client", proxySpan.SpanKind())
+			}
+			if proxySpan.Status().Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v", proxySpan.Status().Code, tt.wantStatus)
+			}
+
+			if tt.clients > 0 {
+				got := <-traceparent
+				want := "00-" + parent.TraceID().String() + "-" + proxySpan.SpanContext().SpanID().String() + "-01"
+				if got != want {
+					t.Errorf("traceparent = %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// TrafficStats accounts what visitors did with a tunnel. Requests are HTTP
+// requests, TCP and TLS connections or UDP sessions. Bytes are counted on
+// the forward connections, BytesIn towards the client and BytesOut back.
+type TrafficStats struct {
+	Requests  uint64
+	Status1xx uint64
+	Status2xx uint64
+	Status3xx uint64
+	Status4xx uint64
+	Status5xx uint64
+	Errors    uint64
+
+	// RateLimited counts visitors turned away by rate limits.
+	RateLimited uint64
+	// Denied counts visitors turned away by IP filters.
+	Denied uint64
+
+	BytesIn  uint64
+	BytesOut uint64
+
+	// LastVisitor is nil until the first visitor came.
+	LastVisitor *time.Time
+	CreatedAt   time.Time
+}
+
+type trafficCounters struct {
+	requests    uint64
+	status      [6]uint64
+	errors      uint64
+	rateLimited uint64
+	denied      uint64
+	lastVisitor int64
+}
+
+func (c *trafficCounters) visit() {
+	atomic.AddUint64(&c.requests, 1)
+	atomic.StoreInt64(&c.lastVisitor, time.Now().UnixNano())
+}
+
+func (c *trafficCounters) response(status int) {
+	class := status / 100
+	if class < 1 || class > 5 {
+		return
+	}
+
+	atomic.AddUint64(&c.status[class], 1)
+}
+
+func (c *trafficCounters) failed() {
+	atomic.AddUint64(&c.errors, 1)
+}
+
+func (c *trafficCounters) limited() {
+	atomic.AddUint64(&c.rateLimited, 1)
+}
+
+func (c *trafficCounters) deny() {
+	atomic.AddUint64(&c.denied, 1)
+}
+
+func (s *TcpProxyInstance) Traffic() TrafficStats {
+	sent, received := s.connPool.Traffic()
+
+	stats := TrafficStats{
+		Requests:    atomic.LoadUint64(&s.traffic.requests),
+		Status1xx:   atomic.LoadUint64(&s.traffic.status[1]),
+		Status2xx:   atomic.LoadUint64(&s.traffic.status[2]),
+		Status3xx:   atomic.LoadUint64(&s.traffic.status[3]),
+		Status4xx:   atomic.LoadUint64(&s.traffic.status[4]),
+		Status5xx:   atomic.LoadUint64(&s.traffic.status[5]),
+		Errors:      atomic.LoadUint64(&s.traffic.errors),
+		RateLimited: atomic.LoadUint64(&s.traffic.rateLimited),
+		Denied:      atomic.LoadUint64(&s.traffic.denied),
+		BytesIn:     sent,
+		BytesOut:    received,
+		CreatedAt:   s.CreatedAt,
+	}
+
+	if last := atomic.LoadInt64(&s.traffic.lastVisitor); last != 0 {
+		t := time.Unix(0, last)
+		stats.LastVisitor = &t
+	}
+
+	return stats
+}
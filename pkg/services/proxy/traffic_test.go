@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestTrafficStatusClasses(t *testing.T) {
+	tests := []struct {
+		status int
+		want   [6]uint64
+	}{
+		{status: 101, want: [6]uint64{0, 1, 0, 0, 0, 0}},
+		{status: 200, want: [6]uint64{0, 0, 1, 0, 0, 0}},
+		{status: 204, want: [6]uint64{0, 0, 1, 0, 0, 0}},
+		{status: 302, want: [6]uint64{0, 0, 0, 1, 0, 0}},
+		{status: 404, want: [6]uint64{0, 0, 0, 0, 1, 0}},
+		{status: 503, want: [6]uint64{0, 0, 0, 0, 0, 1}},
+		{status: 99, want: [6]uint64{}},
+		{status: 600, want: [6]uint64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			c := trafficCounters{}
+			c.response(tt.status)
+
+			if c.status != tt.want {
+				t.Errorf("status counters = %v, want %v", c.status, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraffic(t *testing.T) {
+	s := newTestInstance(t, Options{})
+	if s.Traffic().LastVisitor != nil {
+		t.Error("LastVisitor is set before anyone visited")
+	}
+
+	connectClient(t, s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Path[1:])
+		w.WriteHeader(status)
+		w.Write([]byte("body"))
+	}), 1)
+
+	for _, path := range []string{"/200", "/201", "/404", "/500"} {
+		proxyGet(t, s, "GET", path, nil)
+	}
+
+	stats := s.Traffic()
+	tests := []struct {
+		name string
+		got  uint64
+		want uint64
+	}{
+		{name: "requests", got: stats.Requests, want: 4},
+		{name: "2xx", got: stats.Status2xx, want: 2},
+		{name: "4xx", got: stats.Status4xx, want: 1},
+		{name: "5xx", got: stats.Status5xx, want: 1},
+		{name: "errors", got: stats.Errors, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("%s = %d, want %d", tt.name, tt.got, tt.want)
+			}
+		})
+	}
+
+	if stats.BytesIn == 0 || stats.BytesOut == 0 {
+		t.Errorf("bytes in %d out %d, want both counted", stats.BytesIn, stats.BytesOut)
+	}
+	if stats.LastVisitor == nil || !stats.CreatedAt.Equal(s.CreatedAt) {
+		t.Errorf("LastVisitor %v CreatedAt %v, want a visit after creation", stats.LastVisitor, stats.CreatedAt)
+	}
+}
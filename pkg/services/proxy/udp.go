@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-server/pkg/services/forward_connection"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxDatagramSize is the largest payload the 2 byte length prefix can
+	// describe, which also covers any UDP datagram.
+	maxDatagramSize = 1<<16 - 1
+)
+
+// UdpStats counts datagrams relayed by a UDP tunnel. In is traffic from
+// visitors to the client, Out is traffic from the client back to visitors.
+type UdpStats struct {
+	DatagramsIn  uint64
+	DatagramsOut uint64
+	BytesIn      uint64
+	BytesOut     uint64
+	Sessions     int
+}
+
+// writeDatagram frames a datagram as a big-endian uint16 length followed by
+// the payload.
+func writeDatagram(w io.Writer, p []byte) error {
+	if len(p) > maxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes is too large", len(p))
+	}
+
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads one length-prefixed datagram into buf.
+func readDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var size [2]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(size[:]))
+	_, err = io.ReadFull(r, buf[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// udpSession binds a visitor address to the forward connection carrying its
+// datagrams.
+type udpSession struct {
+	addr       net.Addr
+	conn       forward_connection.ForwardConnection
+	lastActive int64
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idleSince(t time.Time) bool {
+	return atomic.LoadInt64(&s.lastActive) < t.UnixNano()
+}
+
+func (s *udpSession) close() {
+	s.conn.Close()
+	s.conn.Release()
+}
+
+type udpSessions struct {
+	m        sync.Mutex
+	sessions map[string]*udpSession
+	// pending are the visitors whose session is being opened.
+	pending map[string]struct{}
+	closed  bool
+}
+
+func newUdpSessions() *udpSessions {
+	return &udpSessions{
+		sessions: make(map[string]*udpSession),
+		pending:  make(map[string]struct{}),
+	}
+}
+
+func (u *udpSessions) get(addr net.Addr) *udpSession {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	return u.sessions[addr.String()]
+}
+
+// reserve marks a session of addr as being opened, false if one already
+// is or the tunnel closed.
+func (u *udpSessions) reserve(addr net.Addr) bool {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	if _, ok := u.pending[addr.String()]; ok || u.closed {
+		return false
+	}
+	u.pending[addr.String()] = struct{}{}
+	return true
+}
+
+// cancel drops the reservation of a session which failed to open.
+func (u *udpSessions) cancel(addr net.Addr) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	delete(u.pending, addr.String())
+}
+
+// add registers the session opened for a reservation, false if the tunnel
+// closed meanwhile.
+func (u *udpSessions) add(s *udpSession) bool {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	delete(u.pending, s.addr.String())
+	if u.closed {
+		return false
+	}
+	u.sessions[s.addr.String()] = s
+	return true
+}
+
+// remove drops the session if it is still the one registered for its
+// address and closes its forward connection.
+func (u *udpSessions) remove(s *udpSession) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	if u.sessions[s.addr.String()] == s {
+		delete(u.sessions, s.addr.String())
+	}
+	s.close()
+}
+
+func (u *udpSessions) expire(before time.Time) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	for k, s := range u.sessions {
+		if s.idleSince(before) {
+			delete(u.sessions, k)
+			s.close()
+		}
+	}
+}
+
+func (u *udpSessions) closeAll() {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	u.closed = true
+	for k, s := range u.sessions {
+		delete(u.sessions, k)
+		s.close()
+	}
+}
+
+func (u *udpSessions) size() int {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	return len(u.sessions)
+}
+
+// listenUDP binds the public UDP port. Like listenPublic it runs before any
+// goroutine of the instance starts.
+func (s *TcpProxyInstance) listenUDP() error {
+	var err error
+	s.packetConn, err = net.ListenPacket("udp", fmt.Sprintf(":%d", s.PublicPort))
+	if err != nil {
+		s.logger.Error().Int("port", s.PublicPort).Err(err).Msg("Unable to create public udp socket.")
+		return err
+	}
+	s.logger.Info().Str("bind", s.packetConn.LocalAddr().String()).Str("protocol", "udp").Msg("Listening for visitors...")
+
+	return nil
+}
+
+// relayUDP relays datagrams between visitors on the public UDP port and
+// the client. Every visitor address gets its own forward connection for as
+// long as it keeps sending, idle sessions are expired.
+func (s *TcpProxyInstance) relayUDP() {
+	defer s.packetConn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(s.conf.Load().UdpSessionIdleTimeout / 2):
+				s.udpSessions.expire(time.Now().Add(-s.conf.Load().UdpSessionIdleTimeout))
+			}
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := s.packetConn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		s.updateActive()
+		atomic.AddUint64(&s.udpStats.DatagramsIn, 1)
+		atomic.AddUint64(&s.udpStats.BytesIn, uint64(n))
+
+		session := s.udpSessions.get(addr)
+		if session == nil {
+			// Opening a session waits for a forward connection, which must
+			// not hold up the other visitors. The datagrams of addr are
+			// dropped until its session is open.
+			if s.udpSessions.reserve(addr) {
+				go s.openUdpSession(addr, append([]byte(nil), buf[:n]...))
+			}
+			continue
+		}
+		session.touch()
+
+		s.forwardDatagram(session, buf[:n])
+	}
+}
+
+func (s *TcpProxyInstance) forwardDatagram(session *udpSession, p []byte) {
+	err := writeDatagram(session.conn, p)
+	if err != nil {
+		s.logger.Debug().Err(err).Str("visitor", session.addr.String()).Msg("failed to forward datagram")
+		s.udpSessions.remove(session)
+	}
+}
+
+// openUdpSession opens the session of a new visitor, reserved by relayUDP,
+// and forwards its first datagram.
+func (s *TcpProxyInstance) openUdpSession(addr net.Addr, first []byte) {
+	c, err := s.acquireUdp(addr)
+	if err != nil {
+		s.udpSessions.cancel(addr)
+		s.logger.Warn().Err(err).Str("visitor", addr.String()).Msg("dropping datagram")
+		return
+	}
+	c.SetIdleTimeout(0)
+
+	session := &udpSession{addr: addr, conn: c}
+	session.touch()
+
+	// the first datagram goes out before the session is registered, so
+	// the next ones of addr can't overtake it
+	err = writeDatagram(c, first)
+	if err != nil {
+		s.udpSessions.cancel(addr)
+		s.logger.Debug().Err(err).Str("visitor", addr.String()).Msg("failed to forward datagram")
+		session.close()
+		return
+	}
+	if !s.udpSessions.add(session) {
+		session.close()
+		return
+	}
+
+	go func() {
+		defer s.udpSessions.remove(session)
+
+		buf := make([]byte, maxDatagramSize)
+		for {
+			p, err := readDatagram(c, buf)
+			if err != nil {
+				return
+			}
+
+			session.touch()
+			_, err = s.packetConn.WriteTo(p, addr)
+			if err != nil {
+				s.logger.Debug().Err(err).Str("visitor", addr.String()).Msg("failed to return datagram")
+				continue
+			}
+
+			atomic.AddUint64(&s.udpStats.DatagramsOut, 1)
+			atomic.AddUint64(&s.udpStats.BytesOut, uint64(len(p)))
+		}
+	}()
+}
+
+// acquireUdp checks a new visitor against the tunnel limits and gets the
+// forward connection of its session.
+func (s *TcpProxyInstance) acquireUdp(addr net.Addr) (forward_connection.ForwardConnection, error) {
+	host, _, _ := net.SplitHostPort(addr.String())
+	if !s.Permit(host) {
+		return nil, errors.New("visitor denied")
+	}
+	if !s.Allow(host).Allowed {
+		return nil, errors.New("visitor rate limited")
+	}
+
+	s.traffic.visit()
+
+	c, err := s.acquire(context.Background())
+	if err != nil {
+		s.traffic.failed()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// UdpStats returns the datagram counters of a UDP tunnel, nil for others.
+func (s *TcpProxyInstance) UdpStats() *UdpStats {
+	if s.Kind != KindUDP {
+		return nil
+	}
+
+	return &UdpStats{
+		DatagramsIn:  atomic.LoadUint64(&s.udpStats.DatagramsIn),
+		DatagramsOut: atomic.LoadUint64(&s.udpStats.DatagramsOut),
+		BytesIn:      atomic.LoadUint64(&s.udpStats.BytesIn),
+		BytesOut:     atomic.LoadUint64(&s.udpStats.BytesOut),
+		Sessions:     s.udpSessions.size(),
+	}
+}
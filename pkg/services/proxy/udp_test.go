@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"bytes"
+	"github.com/rs/zerolog"
+	"go-server/pkg/services/origin"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr bool
+	}{
+		{name: "empty", payload: []byte{}},
+		{name: "short", payload: []byte("ping")},
+		{name: "largest", payload: bytes.Repeat([]byte{0xab}, maxDatagramSize)},
+		{name: "too large", payload: make([]byte, maxDatagramSize+1), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var frame bytes.Buffer
+			err := writeDatagram(&frame, tt.payload)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("writeDatagram() accepted an oversized datagram")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.Len() != 2+len(tt.payload) {
+				t.Errorf("frame is %d bytes, want %d", frame.Len(), 2+len(tt.payload))
+			}
+
+			got, err := readDatagram(&frame, make([]byte, maxDatagramSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.payload) {
+				t.Error("read datagram differs from the written one")
+			}
+		})
+	}
+}
+
+func TestReadDatagramTruncated(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{name: "no frame", frame: nil, want: io.EOF},
+		{name: "half a length", frame: []byte{0}, want: io.ErrUnexpectedEOF},
+		{name: "short payload", frame: []byte{0, 4, 'p', 'i'}, want: io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readDatagram(bytes.NewReader(tt.frame), make([]byte, maxDatagramSize))
+			if err != tt.want {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// connectUdpEcho opens a forward connection to s whose client sends every
+// framed datagram back.
+func connectUdpEcho(t *testing.T, s *TcpProxyInstance) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, maxDatagramSize)
+		for {
+			p, err := readDatagram(conn, buf)
+			if err != nil {
+				return
+			}
+			writeDatagram(conn, p)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.connPool.Append(conn)
+}
+
+func TestUdpRelay(t *testing.T) {
+	s := newTestInstance(t, Options{Kind: KindUDP})
+	connectUdpEcho(t, s)
+
+	_, port, _ := net.SplitHostPort(s.GetPublicAddr())
+	visitor, err := net.Dial("udp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	visitor.SetDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, maxDatagramSize)
+	for _, payload := range []string{"one", "two", "three"} {
+		_, err = visitor.Write([]byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, err := visitor.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != payload {
+			t.Errorf("datagram = %q, want %q", buf[:n], payload)
+		}
+	}
+
+	// the counters of the way back are bumped after the datagram was sent
+	deadline := time.Now().Add(time.Second)
+	for s.UdpStats().DatagramsOut < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := s.UdpStats()
+	if stats.DatagramsIn != 3 || stats.DatagramsOut != 3 || stats.Sessions != 1 {
+		t.Errorf("stats = %+v, want 3 datagrams each way in 1 session", *stats)
+	}
+}
+
+func TestUdpSessionSetup(t *testing.T) {
+	s := newTestInstance(t, Options{Kind: KindUDP})
+	conf := testConfig()
+	conf.AcquireRetries = 1000
+	s.conf.Store(conf)
+	connectUdpEcho(t, s)
+
+	_, port, _ := net.SplitHostPort(s.GetPublicAddr())
+	dial := func() net.Conn {
+		visitor, err := net.Dial("udp", "127.0.0.1:"+port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { visitor.Close() })
+		return visitor
+	}
+	roundTrip := func(visitor net.Conn, payload string, timeout time.Duration) {
+		t.Helper()
+
+		visitor.SetDeadline(time.Now().Add(timeout))
+		_, err := visitor.Write([]byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, maxDatagramSize)
+		n, err := visitor.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", payload, err)
+		}
+		if string(buf[:n]) != payload {
+			t.Errorf("datagram = %q, want %q", buf[:n], payload)
+		}
+	}
+
+	a, b := dial(), dial()
+	roundTrip(a, "a1", 5*time.Second)
+
+	// b waits for a forward connection, the only one is a's
+	_, err := b.Write([]byte("b1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := func() bool {
+		s.udpSessions.m.Lock()
+		defer s.udpSessions.m.Unlock()
+		_, ok := s.udpSessions.pending[b.LocalAddr().String()]
+		return ok
+	}
+	deadline := time.Now().Add(time.Second)
+	for !pending() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	tests := []struct {
+		name    string
+		visitor net.Conn
+		payload string
+	}{
+		{name: "open session", visitor: a, payload: "a2"},
+		{name: "open session again", visitor: a, payload: "a3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roundTrip(tt.visitor, tt.payload, time.Second)
+		})
+	}
+
+	// the datagram which opened b's session is forwarded once it is open
+	connectUdpEcho(t, s)
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, maxDatagramSize)
+	n, err := b.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "b1" {
+		t.Errorf("datagram = %q, want %q", buf[:n], "b1")
+	}
+}
+
+func TestUdpSessionIdleTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		expired bool
+	}{
+		{name: "idle", timeout: 100 * time.Millisecond, expired: true},
+		{name: "within timeout", timeout: time.Minute, expired: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := testConfig()
+			conf.UdpSessionIdleTimeout = tt.timeout
+			u, _ := url.Parse("http://test.localhost:3001")
+			s, err := NewTcpProxyInstance(zerolog.Nop(), 0, 0, NewSharedConfig(conf), "test", origin.NewMeta(u, nil), Options{Kind: KindUDP}, time.Now(), &ServerBandwidth{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(s.RequestClose)
+			connectUdpEcho(t, s)
+
+			_, port, _ := net.SplitHostPort(s.GetPublicAddr())
+			visitor, err := net.Dial("udp", "127.0.0.1:"+port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer visitor.Close()
+			visitor.SetDeadline(time.Now().Add(5 * time.Second))
+
+			_, err = visitor.Write([]byte("one"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = visitor.Read(make([]byte, maxDatagramSize))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deadline := time.Now().Add(500 * time.Millisecond)
+			for s.UdpStats().Sessions != 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if expired := s.UdpStats().Sessions == 0; expired != tt.expired {
+				t.Errorf("session expired = %v, want %v", expired, tt.expired)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets which refilled completely are dropped,
+// so visitors which went away don't pile up.
+const sweepInterval = time.Minute
+
+// Limit is a token bucket refilled with Rate tokens per second, holding up
+// to Burst tokens. A zero Rate disables it.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+func (l Limit) Enabled() bool {
+	return l.Rate > 0
+}
+
+func (l Limit) Validate() error {
+	if l.Rate < 0 || l.Burst < 0 {
+		return errors.New("rate limit must not be negative")
+	}
+
+	return nil
+}
+
+// Within tells whether l is at most as generous as max. A disabled max
+// allows anything, a disabled l exceeds any enabled max.
+func (l Limit) Within(max Limit) bool {
+	if !max.Enabled() {
+		return true
+	}
+
+	return l.Enabled() && l.Rate <= max.Rate && l.capacity() <= max.capacity()
+}
+
+// capacity defaults the burst to one second worth of tokens.
+func (l Limit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// Result describes the state of a bucket after taking a token, it maps to
+// the RateLimit-* response headers.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+
+	// Reset is the time until the bucket is full again, RetryAfter the
+	// time until the next token when the request was denied.
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// limit is the one of the last call, a limiter may hold buckets with
+	// different limits.
+	limit Limit
+}
+
+// refill adds the tokens gained since the last call under limit.
+func (b *bucket) refill(now time.Time, limit Limit) {
+	b.tokens = math.Min(limit.capacity(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	b.limit = limit
+}
+
+func (b *bucket) result(allowed bool) Result {
+	capacity := b.limit.capacity()
+	result := Result{
+		Allowed:   allowed,
+		Limit:     int(capacity),
+		Remaining: int(b.tokens),
+		Reset:     seconds((capacity - b.tokens) / b.limit.Rate),
+	}
+	if !allowed {
+		result.RetryAfter = seconds((1 - b.tokens) / b.limit.Rate)
+	}
+
+	return result
+}
+
+// Bucket names a token bucket of a Limiter and the limit it is held to.
+type Bucket struct {
+	Key   string
+	Limit Limit
+}
+
+// Limiter keeps a token bucket per key. The limit is passed on each call,
+// so a config reload applies to existing buckets right away.
+type Limiter struct {
+	m         sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+func (l *Limiter) Allow(key string, limit Limit) Result {
+	res, _ := l.AllowAll(Bucket{Key: key, Limit: limit})
+
+	return res
+}
+
+// AllowAll takes a token from every enabled bucket, or from none of them
+// when one is empty. It returns the result of the first empty bucket, or
+// of the one with the fewest tokens left, and that bucket's index. The
+// index is -1 when no bucket is enabled.
+func (l *Limiter) AllowAll(buckets ...Bucket) (Result, int) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	taken := make([]*bucket, len(buckets))
+	for i, bk := range buckets {
+		if !bk.Limit.Enabled() {
+			continue
+		}
+
+		b, ok := l.buckets[bk.Key]
+		if !ok {
+			b = &bucket{tokens: bk.Limit.capacity(), last: now}
+			l.buckets[bk.Key] = b
+		}
+		b.refill(now, bk.Limit)
+
+		if b.tokens < 1 {
+			return b.result(false), i
+		}
+		taken[i] = b
+	}
+
+	res, index := Result{Allowed: true}, -1
+	for i, b := range taken {
+		if b == nil {
+			continue
+		}
+
+		b.tokens--
+		if index == -1 || int(b.tokens) < res.Remaining {
+			res, index = b.result(true), i
+		}
+	}
+
+	return res, index
+}
+
+// sweep drops the buckets which would be full by now, each judged by its
+// own limit. It must be called with m held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= b.limit.capacity() {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
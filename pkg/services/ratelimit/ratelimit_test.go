@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitWithin(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit Limit
+		max   Limit
+		want  bool
+	}{
+		{name: "no maximum", limit: Limit{}, max: Limit{}, want: true},
+		{name: "unlimited under a maximum", limit: Limit{}, max: Limit{Rate: 10}, want: false},
+		{name: "lower rate", limit: Limit{Rate: 5}, max: Limit{Rate: 10}, want: true},
+		{name: "higher rate", limit: Limit{Rate: 20}, max: Limit{Rate: 10}, want: false},
+		{name: "default burst is one second", limit: Limit{Rate: 10}, max: Limit{Rate: 10, Burst: 10}, want: true},
+		{name: "larger burst", limit: Limit{Rate: 5, Burst: 50}, max: Limit{Rate: 10}, want: false},
+		{name: "fractional rate", limit: Limit{Rate: 0.5}, max: Limit{Rate: 1, Burst: 1}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.limit.Within(tt.max); got != tt.want {
+				t.Errorf("Within() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllow(t *testing.T) {
+	l := NewLimiter()
+	limit := Limit{Rate: 1, Burst: 3}
+
+	tests := []struct {
+		allowed   bool
+		remaining int
+	}{
+		{allowed: true, remaining: 2},
+		{allowed: true, remaining: 1},
+		{allowed: true, remaining: 0},
+		{allowed: false, remaining: 0},
+	}
+
+	for i, tt := range tests {
+		res := l.Allow("visitor", limit)
+		if res.Allowed != tt.allowed || res.Remaining != tt.remaining || res.Limit != 3 {
+			t.Errorf("request %d: %+v, want allowed %v with %d of 3 left", i, res, tt.allowed, tt.remaining)
+		}
+		if !res.Allowed && (res.RetryAfter <= 0 || res.RetryAfter > time.Second) {
+			t.Errorf("request %d: RetryAfter = %v, want up to a second", i, res.RetryAfter)
+		}
+	}
+
+	if res := l.Allow("other", limit); !res.Allowed {
+		t.Error("another key shares the bucket")
+	}
+	if res := l.Allow("visitor", Limit{}); !res.Allowed || res.Limit != 0 {
+		t.Errorf("disabled limit: %+v, want allowed without a limit", res)
+	}
+}
+
+func TestAllowAll(t *testing.T) {
+	visitor := Bucket{Key: "visitor", Limit: Limit{Rate: 0.001, Burst: 5}}
+	tunnel := Bucket{Key: "tunnel", Limit: Limit{Rate: 0.001, Burst: 2}}
+
+	tests := []struct {
+		name      string
+		buckets   []Bucket
+		allowed   bool
+		index     int
+		remaining int
+	}{
+		{name: "fewest left wins", buckets: []Bucket{visitor, tunnel}, allowed: true, index: 1, remaining: 1},
+		{name: "both take a token", buckets: []Bucket{visitor, tunnel}, allowed: true, index: 1, remaining: 0},
+		{name: "denied by the tunnel", buckets: []Bucket{visitor, tunnel}, allowed: false, index: 1, remaining: 0},
+		{name: "denial took nothing from the visitor", buckets: []Bucket{visitor}, allowed: true, index: 0, remaining: 2},
+		{name: "nothing enabled", buckets: []Bucket{{Key: "off"}}, allowed: true, index: -1},
+	}
+
+	l := NewLimiter()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, i := l.AllowAll(tt.buckets...)
+			if res.Allowed != tt.allowed || i != tt.index || res.Remaining != tt.remaining {
+				t.Errorf("AllowAll() = %+v at %d, want allowed %v at %d with %d left", res, i, tt.allowed, tt.index, tt.remaining)
+			}
+		})
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := NewLimiter()
+	l.Allow("fast", Limit{Rate: 10, Burst: 1})
+	l.Allow("slow", Limit{Rate: 0.001, Burst: 100})
+	l.Allow("recent", Limit{Rate: 1, Burst: 1})
+
+	// fast and slow were last seen two minutes ago, only fast refilled
+	now := time.Now()
+	l.buckets["fast"].last = now.Add(-2 * time.Minute)
+	l.buckets["slow"].last = now.Add(-2 * time.Minute)
+	l.lastSweep = now.Add(-2 * sweepInterval)
+
+	l.sweep(now)
+
+	tests := []struct {
+		key  string
+		kept bool
+	}{
+		{key: "fast", kept: false},
+		{key: "slow", kept: true},
+		{key: "recent", kept: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if _, ok := l.buckets[tt.key]; ok != tt.kept {
+				t.Errorf("kept = %v, want %v", ok, tt.kept)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Throttle paces a byte stream to a Limit by making callers wait for their
+// tokens, unlike Limiter which turns requests away. The zero value is ready
+// to use.
+type Throttle struct {
+	m      sync.Mutex
+	tokens float64
+	last   time.Time
+
+	waited int64
+}
+
+// Wait blocks until n tokens were paid. More than the burst may be taken at
+// once, the bucket goes into debt which is waited off right away.
+func (t *Throttle) Wait(n int, limit Limit) {
+	if !limit.Enabled() || n <= 0 {
+		return
+	}
+
+	t.m.Lock()
+	now := time.Now()
+	capacity := limit.capacity()
+	if t.last.IsZero() {
+		t.tokens = capacity
+	} else {
+		t.tokens = math.Min(capacity, t.tokens+now.Sub(t.last).Seconds()*limit.Rate)
+	}
+	t.last = now
+	t.tokens -= float64(n)
+	debt := -t.tokens
+	t.m.Unlock()
+
+	if debt <= 0 {
+		return
+	}
+
+	d := seconds(debt / limit.Rate)
+	atomic.AddInt64(&t.waited, int64(d))
+	time.Sleep(d)
+}
+
+// Waited is the total time callers spent waiting for tokens.
+func (t *Throttle) Waited() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.waited))
+}
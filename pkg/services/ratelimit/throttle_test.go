@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    Limit
+		writes   []int
+		min, max time.Duration
+	}{
+		{name: "disabled", limit: Limit{}, writes: []int{1 << 20, 1 << 20}, max: 10 * time.Millisecond},
+		{name: "within burst", limit: Limit{Rate: 1000, Burst: 200}, writes: []int{100, 100}, max: 10 * time.Millisecond},
+		{name: "over burst", limit: Limit{Rate: 1000, Burst: 100}, writes: []int{100, 100}, min: 90 * time.Millisecond, max: 300 * time.Millisecond},
+		{name: "one write larger than the burst", limit: Limit{Rate: 1000, Burst: 100}, writes: []int{300}, min: 190 * time.Millisecond, max: 400 * time.Millisecond},
+		{name: "default burst is one second", limit: Limit{Rate: 100}, writes: []int{100, 10}, min: 90 * time.Millisecond, max: 300 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := &Throttle{}
+
+			start := time.Now()
+			for _, n := range tt.writes {
+				th.Wait(n, tt.limit)
+			}
+			took := time.Since(start)
+
+			if took < tt.min || took > tt.max {
+				t.Errorf("took %v, want between %v and %v", took, tt.min, tt.max)
+			}
+			if waited := th.Waited(); waited > took || (tt.min > 0 && waited < tt.min) {
+				t.Errorf("Waited() = %v, took %v", waited, took)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package registry
+
+import (
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var (
+	tunnelsBucket = []byte("tunnels")
+	domainsBucket = []byte("domains")
+)
+
+// BoltStore keeps records in an embedded BoltDB file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{tunnelsBucket, domainsBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Save(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tunnelsBucket).Put([]byte(r.ID), data)
+	})
+}
+
+func (s *BoltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tunnelsBucket).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) List() ([]Record, error) {
+	records := make([]Record, 0)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tunnelsBucket).ForEach(func(_, v []byte) error {
+			r := Record{}
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return err
+			}
+
+			records = append(records, r)
+			return nil
+		})
+	})
+
+	return records, err
+}
+
+func (s *BoltStore) SaveDomain(d DomainRecord) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(domainsBucket).Put([]byte(d.Host), data)
+	})
+}
+
+func (s *BoltStore) DeleteDomain(host string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(domainsBucket).Delete([]byte(host))
+	})
+}
+
+func (s *BoltStore) ListDomains() ([]DomainRecord, error) {
+	domains := make([]DomainRecord, 0)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(domainsBucket).ForEach(func(_, v []byte) error {
+			d := DomainRecord{}
+			err := json.Unmarshal(v, &d)
+			if err != nil {
+				return err
+			}
+
+			domains = append(domains, d)
+			return nil
+		})
+	})
+
+	return domains, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.db")
+	s, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	verified := created.Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		save    []Record
+		delete  []string
+		domains []DomainRecord
+		want    map[string]Record
+	}{
+		{
+			name: "save",
+			save: []Record{
+				{ID: "web", Kind: "http", Port: 30001, OriginURL: "http://web.localhost:3001", Owner: "k1", Options: json.RawMessage(`{"inspect":true}`), CreatedAt: created},
+				{ID: "dns", Kind: "udp", Port: 30002, PublicPort: 30003, OriginURL: "http://dns.localhost:3001", OriginIP: "10.0.0.1", CreatedAt: created},
+			},
+			domains: []DomainRecord{{Host: "app.example.com", TunnelID: "web", Owner: "k1", Token: "t", VerifiedAt: &verified, CreatedAt: created}},
+			want: map[string]Record{
+				"web": {ID: "web", Kind: "http", Port: 30001, OriginURL: "http://web.localhost:3001", Owner: "k1", Options: json.RawMessage(`{"inspect":true}`), CreatedAt: created},
+				"dns": {ID: "dns", Kind: "udp", Port: 30002, PublicPort: 30003, OriginURL: "http://dns.localhost:3001", OriginIP: "10.0.0.1", CreatedAt: created},
+			},
+		},
+		{
+			name: "overwrite",
+			save: []Record{{ID: "web", Kind: "tcp", Port: 30004, OriginURL: "http://web.localhost:3001", CreatedAt: created}},
+			want: map[string]Record{
+				"web": {ID: "web", Kind: "tcp", Port: 30004, OriginURL: "http://web.localhost:3001", CreatedAt: created},
+				"dns": {ID: "dns", Kind: "udp", Port: 30002, PublicPort: 30003, OriginURL: "http://dns.localhost:3001", OriginIP: "10.0.0.1", CreatedAt: created},
+			},
+		},
+		{
+			name:   "delete",
+			delete: []string{"dns", "unknown"},
+			want: map[string]Record{
+				"web": {ID: "web", Kind: "tcp", Port: 30004, OriginURL: "http://web.localhost:3001", CreatedAt: created},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, r := range tt.save {
+				if err := s.Save(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, id := range tt.delete {
+				if err := s.Delete(id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, d := range tt.domains {
+				if err := s.SaveDomain(d); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// every step is read back from a reopened file
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			s, err = NewBoltStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := s.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.want))
+			}
+			for _, got := range records {
+				want := tt.want[got.ID]
+				if got.Kind != want.Kind || got.Port != want.Port || got.PublicPort != want.PublicPort ||
+					got.OriginURL != want.OriginURL || got.OriginIP != want.OriginIP || got.Owner != want.Owner ||
+					string(got.Options) != string(want.Options) || !got.CreatedAt.Equal(want.CreatedAt) {
+					t.Errorf("record = %+v, want %+v", got, want)
+				}
+			}
+		})
+	}
+
+	domains, err := s.ListDomains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0].TunnelID != "web" || domains[0].VerifiedAt == nil || !domains[0].VerifiedAt.Equal(verified) {
+		t.Errorf("domains = %+v, want app.example.com verified for web", domains)
+	}
+
+	err = s.DeleteDomain("app.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains, _ = s.ListDomains()
+	if len(domains) != 0 {
+		t.Errorf("domains = %+v after delete", domains)
+	}
+	s.Close()
+}
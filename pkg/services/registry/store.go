@@ -0,0 +1,86 @@
+package registry
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Record is what is persisted about a tunnel to bring it back with the
+// same name and ports after a restart.
+type Record struct {
+	ID         string `json:"id"`
+	Kind       string `json:"kind"`
+	Port       int    `json:"port"`
+	PublicPort int    `json:"public_port,omitempty"`
+
+	OriginURL string `json:"origin_url"`
+	OriginIP  string `json:"origin_ip,omitempty"`
+
+	Owner string `json:"owner,omitempty"`
+
+	// Options holds the remaining per-tunnel settings, encoded by the
+	// proxy package.
+	Options json.RawMessage `json:"options,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DomainRecord maps a custom hostname to a tunnel. It outlives the tunnel,
+// so a tunnel created again under the same name gets its domain back.
+type DomainRecord struct {
+	Host     string `json:"host"`
+	TunnelID string `json:"tunnel_id"`
+	// Owner is the ID of the API key which added the domain, visitors only
+	// reach tunnels of the same owner through it.
+	Owner string `json:"owner,omitempty"`
+
+	// Token is the value expected in the TXT record proving ownership.
+	Token      string     `json:"token"`
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Store persists tunnel and domain records.
+type Store interface {
+	Save(r Record) error
+	Delete(id string) error
+	List() ([]Record, error)
+
+	SaveDomain(d DomainRecord) error
+	DeleteDomain(host string) error
+	ListDomains() ([]DomainRecord, error)
+
+	Close() error
+}
+
+// NopStore keeps nothing, tunnels live only as long as the process.
+type NopStore struct{}
+
+func (NopStore) Save(Record) error {
+	return nil
+}
+
+func (NopStore) Delete(string) error {
+	return nil
+}
+
+func (NopStore) List() ([]Record, error) {
+	return nil, nil
+}
+
+func (NopStore) SaveDomain(DomainRecord) error {
+	return nil
+}
+
+func (NopStore) DeleteDomain(string) error {
+	return nil
+}
+
+func (NopStore) ListDomains() ([]DomainRecord, error) {
+	return nil, nil
+}
+
+func (NopStore) Close() error {
+	return nil
+}
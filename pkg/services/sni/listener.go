@@ -0,0 +1,113 @@
+package sni
+
+import (
+	"github.com/rs/zerolog"
+	"net"
+	"sync"
+	"time"
+)
+
+const helloTimeout = 10 * time.Second
+
+// Router decides what happens to a visitor connection with the given SNI
+// server name. It returns a handler taking over the raw TLS stream, or nil
+// to let the TLS terminating server handle the connection.
+type Router func(serverName string) func(net.Conn)
+
+// Listener wraps the public TLS listener. Connections routed to a
+// passthrough handler never reach Accept, all others are returned to the
+// TLS terminating server with their ClientHello intact.
+type Listener struct {
+	net.Listener
+
+	logger zerolog.Logger
+	route  Router
+
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func NewListener(logger zerolog.Logger, inner net.Listener, route Router) *Listener {
+	l := &Listener{
+		Listener: inner,
+		logger:   logger,
+		route:    route,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+
+	go l.serve()
+
+	return l
+}
+
+func (l *Listener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+
+			l.close(err)
+			return
+		}
+
+		go l.dispatch(conn)
+	}
+}
+
+func (l *Listener) dispatch(conn net.Conn) {
+	serverName, replay, err := PeekServerName(conn, helloTimeout)
+	if err != nil {
+		l.logger.Debug().Err(err).Str("remote", conn.RemoteAddr().String()).Msg("failed to read client hello")
+		if replay == nil {
+			conn.Close()
+			return
+		}
+	}
+
+	if serverName != "" {
+		if handler := l.route(serverName); handler != nil {
+			handler(replay)
+			return
+		}
+	}
+
+	select {
+	case l.conns <- replay:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		if l.err != nil {
+			return nil, l.err
+		}
+
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.close(nil)
+}
+
+// close records why the listener stopped before Accept can observe it.
+func (l *Listener) close(cause error) error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.err = cause
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+
+	return err
+}
@@ -0,0 +1,89 @@
+package sni
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errHelloRead = errors.New("client hello read")
+
+// PeekServerName reads the TLS ClientHello from conn and returns the SNI
+// server name it carries. The returned connection replays the bytes
+// consumed while peeking, so it can be handed to a TLS server or spliced
+// to a backend as if nothing was read.
+func PeekServerName(conn net.Conn, timeout time.Duration) (string, net.Conn, error) {
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var peeked bytes.Buffer
+	var serverName string
+	var helloRead bool
+
+	err = tls.Server(readOnlyConn{r: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			helloRead = true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	// The hello deadline must not outlive peeking on any path, the replayed
+	// connection is served for as long as the visitor stays.
+	deadlineErr := conn.SetReadDeadline(time.Time{})
+
+	replay := &replayConn{Conn: conn, r: io.MultiReader(&peeked, conn)}
+	if err != nil && !helloRead {
+		return "", replay, err
+	}
+	if deadlineErr != nil {
+		return "", nil, deadlineErr
+	}
+
+	return serverName, replay, nil
+}
+
+// readOnlyConn lets the TLS server read a ClientHello without ever writing
+// to the visitor.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (readOnlyConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (readOnlyConn) Close() error {
+	return nil
+}
+
+func (readOnlyConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (readOnlyConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (readOnlyConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
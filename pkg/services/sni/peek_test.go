@@ -0,0 +1,183 @@
+package sni
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/rs/zerolog"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipe returns both ends of a loopback TCP connection.
+func pipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+// sendHello starts a TLS handshake with serverName on conn, it stalls
+// waiting for the ServerHello which never comes.
+func sendHello(serverName string) func(net.Conn) {
+	return func(conn net.Conn) {
+		tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}
+}
+
+func TestPeekServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		send       func(net.Conn)
+		want       string
+		wantErr    bool
+		wantReplay []byte
+	}{
+		{name: "server name", send: sendHello("app.localhost"), want: "app.localhost"},
+		{name: "no server name", send: sendHello(""), want: ""},
+		{
+			name:       "plain http",
+			send:       func(conn net.Conn) { conn.Write([]byte("GET / HTTP/1.1\r\n\r\n")) },
+			wantErr:    true,
+			wantReplay: []byte("GET / HTTP/1.1\r\n\r\n"),
+		},
+		{name: "silent visitor", send: func(net.Conn) {}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := pipe(t)
+			go tt.send(client)
+
+			got, replay, err := PeekServerName(server, 200*time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("server name = %q, want %q", got, tt.want)
+			}
+			if replay == nil {
+				t.Fatal("no connection to replay")
+			}
+
+			if tt.wantReplay != nil {
+				buf := make([]byte, len(tt.wantReplay))
+				_, err = io.ReadFull(replay, buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf, tt.wantReplay) {
+					t.Errorf("replayed %q, want %q", buf, tt.wantReplay)
+				}
+			}
+		})
+	}
+}
+
+func TestPeekClearsDeadline(t *testing.T) {
+	client, server := pipe(t)
+	go client.Write([]byte("not a hello"))
+
+	_, replay, _ := PeekServerName(server, 50*time.Millisecond)
+	if replay == nil {
+		t.Fatal("no connection to replay")
+	}
+	io.ReadFull(replay, make([]byte, len("not a hello")))
+
+	// well past the hello timeout, the visitor must still be readable
+	time.Sleep(100 * time.Millisecond)
+	client.Write([]byte("more"))
+
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(replay, buf)
+	if err != nil {
+		t.Fatalf("reading after the hello timeout: %v", err)
+	}
+	if string(buf) != "more" {
+		t.Errorf("read %q, want %q", buf, "more")
+	}
+}
+
+func TestListenerRoutes(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passed := make(chan string, 1)
+	l := NewListener(zerolog.Nop(), inner, func(serverName string) func(net.Conn) {
+		if serverName != "passthrough.localhost" {
+			return nil
+		}
+
+		return func(conn net.Conn) {
+			conn.Close()
+			passed <- serverName
+		}
+	})
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	tests := []struct {
+		serverName  string
+		passthrough bool
+	}{
+		{serverName: "passthrough.localhost", passthrough: true},
+		{serverName: "terminated.localhost", passthrough: false},
+		{serverName: "", passthrough: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			conn, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			go sendHello(tt.serverName)(conn)
+
+			select {
+			case name := <-passed:
+				if !tt.passthrough {
+					t.Errorf("%q was passed through", name)
+				}
+			case c := <-accepted:
+				c.Close()
+				if tt.passthrough {
+					t.Error("passthrough connection reached Accept")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection was neither passed through nor accepted")
+			}
+		})
+	}
+}
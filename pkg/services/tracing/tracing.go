@@ -0,0 +1,52 @@
+package tracing
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"strings"
+)
+
+const serviceName = "greencobra"
+
+// Propagator reads and writes W3C traceparent and baggage headers. It is set
+// globally even without an exporter, so traces of visitors keep flowing to
+// the tunnel clients.
+var Propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+func init() {
+	otel.SetTextMapPropagator(Propagator)
+}
+
+// NewOTLPExporter sends spans over OTLP/HTTP. The endpoint is host:port or
+// a URL, plain HTTP is used for http:// URLs or when insecure is set.
+func NewOTLPExporter(ctx context.Context, endpoint string, insecure bool) (sdktrace.SpanExporter, error) {
+	if strings.HasPrefix(endpoint, "http://") {
+		insecure = true
+	}
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://")
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	return otlptracehttp.New(ctx, opts...)
+}
+
+// Setup installs a global tracer provider exporting to exporter, e.g. the
+// OTLP one or an in-memory exporter in tests. The returned function flushes
+// and stops it.
+func Setup(exporter sdktrace.SpanExporter) func(context.Context) error {
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown
+}
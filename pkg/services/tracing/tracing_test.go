@@ -0,0 +1,81 @@
+package tracing
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"net/http"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	shutdown := Setup(exporter)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "request")
+	span.End()
+
+	defer shutdown(context.Background())
+
+	// spans are batched, the in-memory exporter forgets them on shutdown
+	err := otel.GetTracerProvider().(*sdktrace.TracerProvider).ForceFlush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("exported %d spans, want 1", len(spans))
+	}
+	if name, ok := spans[0].Resource.Set().Value(semconv.ServiceNameKey); !ok || name.AsString() != serviceName {
+		t.Errorf("service.name = %v, want %q", name, serviceName)
+	}
+}
+
+func TestPropagator(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   []string
+	}{
+		{
+			name:   "trace context",
+			header: http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}},
+			want:   []string{"Traceparent"},
+		},
+		{
+			name: "trace context and baggage",
+			header: http.Header{
+				"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+				"Baggage":     {"tenant=acme"},
+			},
+			want: []string{"Traceparent", "Baggage"},
+		},
+		{name: "nothing", header: http.Header{}, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(tt.header))
+
+			out := http.Header{}
+			otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(out))
+
+			if len(out) != len(tt.want) {
+				t.Errorf("injected %v, want %v", out, tt.want)
+			}
+			for _, name := range tt.want {
+				if out.Get(name) != tt.header.Get(name) {
+					t.Errorf("%s = %q, want %q", name, out.Get(name), tt.header.Get(name))
+				}
+			}
+			if tt.header.Get("Baggage") != "" && baggage.FromContext(ctx).Member("tenant").Value() != "acme" {
+				t.Error("baggage was not extracted")
+			}
+		})
+	}
+}
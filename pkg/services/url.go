@@ -2,6 +2,7 @@ package services
 
 import (
 	"math/rand"
+	"net"
 	"strings"
 )
 
@@ -13,6 +14,22 @@ func GetTunnelNameFromHost(host string) string {
 	return parts[0]
 }
 
+// IsTunnelHost reports whether a Host header addresses a tunnel subdomain
+// rather than the server itself. Without a base domain any hostname with
+// at least two labels counts, IP addresses never do.
+func IsTunnelHost(host, baseDomain string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if baseDomain != "" {
+		return strings.HasSuffix(host, "."+strings.ToLower(baseDomain))
+	}
+
+	return strings.Contains(host, ".") && net.ParseIP(host) == nil
+}
+
 func GenerateTunnelName() string {
 	return randSeq(10)
 }